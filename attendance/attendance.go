@@ -0,0 +1,410 @@
+//Package attendance 考勤：把 identify 在考勤图库中识别到的人员记录为上下班打卡，
+//同一个人在去重时间窗口内的重复打卡只记录一次，按照班次统计迟到、早退和工作时长，输出日报和月报
+package attendance
+
+import (
+	"encoding/json"
+	"faceserver/pkg/keyring"
+	"faceserver/pkg/linelog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+//打卡方向
+const (
+	DirIn  = "in"  //上班
+	DirOut = "out" //下班
+)
+
+//DefaultWindow 缺省的去重时间窗口
+const DefaultWindow = 5 * time.Minute
+
+//dayLead 考勤日从班次开始前4小时算起，夜班第二天早上的下班打卡属于前一天
+const dayLead = 4 * time.Hour
+
+//日期的格式
+const (
+	DateLayout  = "2006-01-02"
+	MonthLayout = "2006-01"
+)
+
+//Shift 一个班次，时间是本地时间，End 不晚于 Start 时表示跨过午夜
+type Shift struct {
+	Name       string `json:"name"`
+	Start      string `json:"start"`       //上班时间，比如 09:00
+	End        string `json:"end"`         //下班时间，比如 18:00
+	LateGrace  int    `json:"late_grace"`  //上班时间以后多少分钟以内打卡不算迟到
+	EarlyGrace int    `json:"early_grace"` //下班时间以前多少分钟以内打卡不算早退
+
+	start, end time.Duration //距离当天零点的时间
+}
+
+//Settings 考勤的配置文件
+type Settings struct {
+	Shifts    []Shift           `json:"shifts"`
+	Default   string            `json:"default"`    //人员没有指定班次时使用的班次，缺省为第一个班次
+	MetaField string            `json:"meta_field"` //人员 meta 中指定班次的字段，缺省为 shift
+	Sources   map[string]string `json:"sources"`    //来源（摄像头）对应的打卡方向 in 或者 out，没有列出的来源当天第一次为上班，以后为下班
+}
+
+//DefaultSettings 没有配置文件时使用：一个 09:00-18:00 的班次
+var DefaultSettings = Settings{Shifts: []Shift{{Name: "day", Start: "09:00", End: "18:00"}}}
+
+//LoadSettings 读取配置文件，文件为空时使用 DefaultSettings
+func LoadSettings(file string) (*Settings, error) {
+	s := DefaultSettings
+	if len(file) > 0 {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "read attendance settings failed")
+		}
+		s = Settings{}
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, errors.Wrapf(err, "parse %s failed", file)
+		}
+	}
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *Settings) init() error {
+	if len(s.Shifts) == 0 {
+		return errors.New("no shift")
+	}
+	shifts := make([]Shift, len(s.Shifts))
+	names := make(map[string]bool)
+	for i, sh := range s.Shifts {
+		if len(sh.Name) == 0 || names[sh.Name] {
+			return errors.Errorf("shift %d: empty or duplicate name %q", i, sh.Name)
+		}
+		names[sh.Name] = true
+		var err error
+		if sh.start, err = clock(sh.Start); err != nil {
+			return errors.Wrapf(err, "shift %s", sh.Name)
+		}
+		if sh.end, err = clock(sh.End); err != nil {
+			return errors.Wrapf(err, "shift %s", sh.Name)
+		}
+		if sh.end <= sh.start {
+			sh.end += 24 * time.Hour
+		}
+		if sh.LateGrace < 0 || sh.EarlyGrace < 0 {
+			return errors.Errorf("shift %s: negative grace", sh.Name)
+		}
+		shifts[i] = sh
+	}
+	s.Shifts = shifts
+	if len(s.Default) == 0 {
+		s.Default = s.Shifts[0].Name
+	}
+	if !names[s.Default] {
+		return errors.Errorf("default shift %q is not defined", s.Default)
+	}
+	if len(s.MetaField) == 0 {
+		s.MetaField = "shift"
+	}
+	for src, dir := range s.Sources {
+		if dir != DirIn && dir != DirOut {
+			return errors.Errorf("source %s: direction must be in or out", src)
+		}
+	}
+	return nil
+}
+
+//clock 解析 15:04 格式的时间
+func clock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.Errorf("invalid time %q, expect hh:mm", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+//Shift 班次，名称没有定义时使用缺省班次
+func (s *Settings) Shift(name string) *Shift {
+	for i := range s.Shifts {
+		if s.Shifts[i].Name == name {
+			return &s.Shifts[i]
+		}
+	}
+	return s.Shift(s.Default)
+}
+
+//ShiftOf 人员的班次，由 meta 中的 MetaField 字段指定
+func (s *Settings) ShiftOf(meta map[string]string) *Shift {
+	return s.Shift(meta[s.MetaField])
+}
+
+//Day t 所属的考勤日
+func (sh *Shift) Day(t time.Time) string {
+	return t.Add(dayLead - sh.start).Format(DateLayout)
+}
+
+//Bounds 考勤日 date 的上下班时间
+func (sh *Shift) Bounds(date string) (time.Time, time.Time, error) {
+	d, err := time.ParseInLocation(DateLayout, date, time.Local)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return d.Add(sh.start), d.Add(sh.end), nil
+}
+
+//Event 一次打卡
+type Event struct {
+	Time      time.Time `json:"time"`
+	Date      string    `json:"date"` //考勤日
+	PersonID  string    `json:"person_id"`
+	Direction string    `json:"direction"`
+	Shift     string    `json:"shift"`
+	Source    string    `json:"source,omitempty"`
+	Score     float64   `json:"score"`
+}
+
+//Book 考勤记录，每个月的打卡追加到目录中的 <yyyy-mm>.jsonl，按照考勤日所在的月份
+//配置了密钥时每行是一条加密的打卡，文件名作为额外认证的数据
+type Book struct {
+	dir      string
+	window   time.Duration
+	settings *Settings
+	keys     *keyring.Keyring
+
+	mu    sync.Mutex
+	month string            //当前打开的月份
+	f     *os.File          //当前月份的文件
+	last  map[string]*Event //每个人员最后一次记录的打卡，用于去重和判断方向
+}
+
+//Open 打开考勤目录，读取最近两个月的记录以便继续去重，keys 为 nil 时不加密
+func Open(dir string, window time.Duration, settings *Settings, keys *keyring.Keyring) (*Book, error) {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	if settings == nil {
+		var err error
+		if settings, err = LoadSettings(""); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create attendance directory failed")
+	}
+	b := &Book{dir: dir, window: window, settings: settings, keys: keys, last: make(map[string]*Event)}
+	now := time.Now()
+	for _, m := range []time.Time{now.AddDate(0, -1, 0), now} {
+		events, err := b.Events(m.Format(MonthLayout))
+		if err != nil {
+			return nil, err
+		}
+		for i := range events {
+			e := &events[i]
+			if l, ok := b.last[e.PersonID]; !ok || !e.Time.Before(l.Time) {
+				b.last[e.PersonID] = e
+			}
+		}
+	}
+	return b, nil
+}
+
+//Settings 考勤配置
+func (b *Book) Settings() *Settings {
+	return b.settings
+}
+
+//Window 去重时间窗口
+func (b *Book) Window() time.Duration {
+	return b.window
+}
+
+//Record 记录一次识别结果，返回记录的打卡；在去重时间窗口内重复打卡时返回 nil
+//来源配置了方向时，窗口内同一方向的打卡是重复的；否则窗口内的任何打卡都是重复的
+func (b *Book) Record(personID string, meta map[string]string, source string, score float64, t time.Time) (*Event, error) {
+	sh := b.settings.ShiftOf(meta)
+	e := &Event{Time: t, Date: sh.Day(t), PersonID: personID, Shift: sh.Name, Source: source, Score: score}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	last := b.last[personID]
+	e.Direction = b.settings.Sources[source]
+	recent := last != nil && t.Sub(last.Time) < b.window && !t.Before(last.Time)
+	if len(e.Direction) == 0 {
+		if recent {
+			return nil, nil
+		}
+		e.Direction = DirIn
+		if last != nil && last.Date == e.Date {
+			e.Direction = DirOut
+		}
+	} else if recent && last.Direction == e.Direction {
+		return nil, nil
+	}
+	if err := b.append(e); err != nil {
+		return nil, err
+	}
+	b.last[personID] = e
+	return e, nil
+}
+
+func (b *Book) file(month string) string {
+	return filepath.Join(b.dir, month+".jsonl")
+}
+
+func (b *Book) append(e *Event) error {
+	month := e.Date[:len(MonthLayout)]
+	if b.f == nil || b.month != month {
+		if b.f != nil {
+			b.f.Close()
+			b.f = nil
+		}
+		f, err := os.OpenFile(b.file(month), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return errors.Wrap(err, "open attendance file failed")
+		}
+		b.f, b.month = f, month
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if data, err = b.keys.SealLine(data, []byte(filepath.Base(b.file(month)))); err != nil {
+		return errors.Wrap(err, "encrypt attendance record failed")
+	}
+	_, err = b.f.Write(append(data, '\n'))
+	return errors.Wrap(err, "write attendance file failed")
+}
+
+//Events 考勤日在 month（yyyy-mm）中的所有打卡，按照时间排序
+func (b *Book) Events(month string) ([]Event, error) {
+	if _, err := time.Parse(MonthLayout, month); err != nil {
+		return nil, errors.Errorf("invalid month %q, expect yyyy-mm", month)
+	}
+	var events []Event
+	//进程崩溃时写了一半的最后一行被忽略
+	err := linelog.Scan(b.keys, b.file(month), func(line, data []byte) {
+		var e Event
+		if data != nil && json.Unmarshal(data, &e) == nil {
+			events = append(events, e)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events, nil
+}
+
+//Purge 从所有月份中删除人员的打卡，有这个人员的文件重写为临时文件，落盘以后改名
+//返回已经删除的文件，出错时前面的文件已经删除
+func (b *Book) Purge(personID string) ([]linelog.Purged, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	months, err := b.months()
+	if err != nil {
+		return nil, err
+	}
+	var out []linelog.Purged
+	for _, month := range months {
+		if b.month == month && b.f != nil {
+			b.f.Close()
+			b.f = nil
+		}
+		//写了一半的行可能是这个人员的记录，一起删除
+		torn := 0
+		n, err := linelog.Rewrite(b.keys, b.file(month), func(line, data []byte) bool {
+			var e Event
+			if data == nil || json.Unmarshal(data, &e) != nil {
+				torn++
+				return false
+			}
+			return e.PersonID != personID
+		})
+		if err != nil {
+			return out, err
+		}
+		if n > 0 {
+			out = append(out, linelog.Purged{File: b.file(month), Count: n - torn, Torn: torn})
+		}
+	}
+	delete(b.last, personID)
+	return out, nil
+}
+
+//months 已有记录的月份
+func (b *Book) months() ([]string, error) {
+	infos, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read attendance directory failed")
+	}
+	var months []string
+	for _, info := range infos {
+		month := strings.TrimSuffix(info.Name(), ".jsonl")
+		if _, err := time.Parse(MonthLayout, month); err != nil || info.IsDir() || month == info.Name() {
+			continue
+		}
+		months = append(months, month)
+	}
+	return months, nil
+}
+
+//Reseal 用当前密钥重新加密所有月份中不是当前密钥加密的打卡，返回重写的文件数目，密钥轮换使用
+//每个文件单独持有锁，重写期间的打卡等待；写了一半的行同时删除；done 在每个文件处理以后调用，可以为 nil
+func (b *Book) Reseal(done func()) (int, error) {
+	months, err := b.months()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, month := range months {
+		ok, err := b.reseal(month)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+		if done != nil {
+			done()
+		}
+	}
+	return n, nil
+}
+
+func (b *Book) reseal(month string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.month == month && b.f != nil {
+		b.f.Close()
+		b.f = nil
+	}
+	ok, dropped, err := linelog.Reseal(b.keys, b.file(month))
+	if dropped > 0 {
+		glog.Warningf("%d unreadable lines dropped from %s", dropped, b.file(month))
+	}
+	return ok, err
+}
+
+//Close 关闭当前月份的文件
+func (b *Book) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.f == nil {
+		return nil
+	}
+	err := b.f.Close()
+	b.f = nil
+	return err
+}
+
+//minutes 报表中的分钟数
+func minutes(d time.Duration) string {
+	return strconv.Itoa(int(d / time.Minute))
+}
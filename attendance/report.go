@@ -0,0 +1,234 @@
+package attendance
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//日报中的考勤状态
+const (
+	StatusNormal     = "normal"
+	StatusLate       = "late"
+	StatusEarly      = "early"
+	StatusLateEarly  = "late_early"
+	StatusMissingIn  = "missing_in"  //只有下班打卡
+	StatusMissingOut = "missing_out" //只有上班打卡
+	StatusAbsent     = "absent"      //考勤图库中的人员当天没有打卡
+)
+
+//Person 报表中的人员，通常是考勤图库中的所有人员，没有打卡的人员在日报中为 absent
+type Person struct {
+	ID   string
+	Name string
+	Meta map[string]string
+}
+
+//DayRecord 一个人员在一个考勤日的考勤
+type DayRecord struct {
+	Date     string
+	PersonID string
+	Name     string
+	Shift    string
+	CheckIn  time.Time //第一次上班打卡，没有时为零值
+	CheckOut time.Time //上班打卡以后的最后一次下班打卡，没有时为零值
+	Late     time.Duration
+	Early    time.Duration
+	Worked   time.Duration
+	Punches  int
+	Status   string
+}
+
+//MonthRecord 一个人员在一个月中的考勤汇总
+type MonthRecord struct {
+	Month      string
+	PersonID   string
+	Name       string
+	Present    int //有打卡的天数
+	LateDays   int
+	EarlyDays  int
+	Incomplete int //缺少上班或者下班打卡的天数
+	Late       time.Duration
+	Early      time.Duration
+	Worked     time.Duration
+}
+
+//day 根据一个人员在一个考勤日的打卡计算考勤，events 按照时间排序
+func (b *Book) day(date, personID string, events []Event) DayRecord {
+	d := DayRecord{Date: date, PersonID: personID, Shift: events[0].Shift, Punches: len(events)}
+	for _, e := range events {
+		if e.Direction == DirIn && d.CheckIn.IsZero() {
+			d.CheckIn = e.Time.Local()
+		}
+	}
+	for _, e := range events {
+		if e.Direction == DirOut && (d.CheckIn.IsZero() || e.Time.After(d.CheckIn)) {
+			d.CheckOut = e.Time.Local()
+		}
+	}
+	sh := b.settings.Shift(d.Shift)
+	d.Shift = sh.Name
+	start, end, _ := sh.Bounds(date)
+	if !d.CheckIn.IsZero() {
+		if late := d.CheckIn.Sub(start); late > time.Duration(sh.LateGrace)*time.Minute {
+			d.Late = late
+		}
+	}
+	if !d.CheckOut.IsZero() {
+		if early := end.Sub(d.CheckOut); early > time.Duration(sh.EarlyGrace)*time.Minute {
+			d.Early = early
+		}
+	}
+	switch {
+	case d.CheckIn.IsZero():
+		d.Status = StatusMissingIn
+	case d.CheckOut.IsZero():
+		d.Status = StatusMissingOut
+	case d.Late > 0 && d.Early > 0:
+		d.Status = StatusLateEarly
+	case d.Late > 0:
+		d.Status = StatusLate
+	case d.Early > 0:
+		d.Status = StatusEarly
+	default:
+		d.Status = StatusNormal
+	}
+	if !d.CheckIn.IsZero() && !d.CheckOut.IsZero() {
+		d.Worked = d.CheckOut.Sub(d.CheckIn)
+	}
+	return d
+}
+
+//group 按照人员和考勤日分组，每组中的打卡按照时间排序
+func group(events []Event) map[string]map[string][]Event {
+	out := make(map[string]map[string][]Event)
+	for _, e := range events {
+		days, ok := out[e.PersonID]
+		if !ok {
+			days = make(map[string][]Event)
+			out[e.PersonID] = days
+		}
+		days[e.Date] = append(days[e.Date], e)
+	}
+	return out
+}
+
+func names(persons []Person) map[string]Person {
+	m := make(map[string]Person, len(persons))
+	for _, p := range persons {
+		m[p.ID] = p
+	}
+	return m
+}
+
+//Daily 考勤日 date（yyyy-mm-dd）的日报，persons 中没有打卡的人员为 absent，按照人员标识排序
+//有打卡但是不在 persons 中的人员（比如已经删除）同样列出
+func (b *Book) Daily(date string, persons []Person) ([]DayRecord, error) {
+	if _, err := time.Parse(DateLayout, date); err != nil {
+		return nil, errors.Errorf("invalid date %q, expect yyyy-mm-dd", date)
+	}
+	events, err := b.Events(date[:len(MonthLayout)])
+	if err != nil {
+		return nil, err
+	}
+	byPerson := names(persons)
+	var out []DayRecord
+	for id, days := range group(events) {
+		if es, ok := days[date]; ok {
+			d := b.day(date, id, es)
+			d.Name = byPerson[id].Name
+			out = append(out, d)
+		}
+	}
+	seen := make(map[string]bool, len(out))
+	for _, d := range out {
+		seen[d.PersonID] = true
+	}
+	for _, p := range persons {
+		if !seen[p.ID] {
+			out = append(out, DayRecord{Date: date, PersonID: p.ID, Name: p.Name,
+				Shift: b.settings.ShiftOf(p.Meta).Name, Status: StatusAbsent})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].PersonID < out[j].PersonID })
+	return out, nil
+}
+
+//Monthly month（yyyy-mm）的月报，每个人员一行，按照人员标识排序
+func (b *Book) Monthly(month string, persons []Person) ([]MonthRecord, error) {
+	events, err := b.Events(month)
+	if err != nil {
+		return nil, err
+	}
+	byPerson := names(persons)
+	all := make(map[string]*MonthRecord)
+	for _, p := range persons {
+		all[p.ID] = &MonthRecord{Month: month, PersonID: p.ID, Name: p.Name}
+	}
+	for id, days := range group(events) {
+		m, ok := all[id]
+		if !ok {
+			m = &MonthRecord{Month: month, PersonID: id, Name: byPerson[id].Name}
+			all[id] = m
+		}
+		for date, es := range days {
+			d := b.day(date, id, es)
+			m.Present++
+			m.Late += d.Late
+			m.Early += d.Early
+			m.Worked += d.Worked
+			if d.Late > 0 {
+				m.LateDays++
+			}
+			if d.Early > 0 {
+				m.EarlyDays++
+			}
+			if d.CheckIn.IsZero() || d.CheckOut.IsZero() {
+				m.Incomplete++
+			}
+		}
+	}
+	out := make([]MonthRecord, 0, len(all))
+	for _, m := range all {
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].PersonID < out[j].PersonID })
+	return out, nil
+}
+
+func stamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+//WriteDaily 输出日报的 csv，时长的单位是分钟
+func WriteDaily(w io.Writer, records []DayRecord) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"date", "person_id", "name", "shift", "check_in", "check_out",
+		"late_minutes", "early_minutes", "worked_minutes", "punches", "status"})
+	for _, d := range records {
+		cw.Write([]string{d.Date, d.PersonID, d.Name, d.Shift, stamp(d.CheckIn), stamp(d.CheckOut),
+			minutes(d.Late), minutes(d.Early), minutes(d.Worked), strconv.Itoa(d.Punches), d.Status})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+//WriteMonthly 输出月报的 csv，时长的单位是分钟
+func WriteMonthly(w io.Writer, records []MonthRecord) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"month", "person_id", "name", "days_present", "days_late", "days_early", "days_incomplete",
+		"late_minutes", "early_minutes", "worked_minutes"})
+	for _, m := range records {
+		cw.Write([]string{m.Month, m.PersonID, m.Name, strconv.Itoa(m.Present), strconv.Itoa(m.LateDays),
+			strconv.Itoa(m.EarlyDays), strconv.Itoa(m.Incomplete), minutes(m.Late), minutes(m.Early), minutes(m.Worked)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,342 @@
+//Package events 识别事件日志：compare 和 identify 的每个结果作为一条事件追加到按天分区的文件中，
+//按照人员、时间范围、来源和最低分数查询，用于回答某个人什么时候在哪里出现过
+package events
+
+import (
+	"encoding/json"
+	"faceserver/pkg/keyring"
+	"faceserver/pkg/linelog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+//partitionLayout 分区文件名中的日期，按照 UTC 划分
+const partitionLayout = "2006-01-02"
+
+//查询每页的缺省和最大事件数目
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+var (
+	ErrQuery  = errors.New("invalid query")          //查询条件不合法
+	ErrClosed = errors.New("events store is closed") //Close 以后不能再追加
+)
+
+//Rect 人脸框
+type Rect struct {
+	X1 float64 `json:"x1"`
+	Y1 float64 `json:"y1"`
+	X2 float64 `json:"x2"`
+	Y2 float64 `json:"y2"`
+}
+
+//Event 一次识别事件
+type Event struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Cmd       string    `json:"cmd"` //compare 或者 identify
+	Source    string    `json:"source,omitempty"`
+	Gallery   string    `json:"gallery,omitempty"`
+	PersonID  string    `json:"person_id,omitempty"` //identify 的第一个候选人员，没有识别出来或者 compare 时为空
+	Score     float64   `json:"score"`               //identify 为候选人员的相似度，compare 为两个输入的相似度
+	Rect      *Rect     `json:"rect,omitempty"`
+	Thumbnail string    `json:"thumbnail,omitempty"` //base64 编码的 jpeg 人脸缩略图
+}
+
+//Query 查询条件，空值表示不限制
+type Query struct {
+	PersonID string
+	Source   string
+	Gallery  string
+	From     time.Time //包含
+	To       time.Time //不包含
+	MinScore float64
+	Offset   int
+	Limit    int //缺省为 DefaultLimit，最大为 MaxLimit
+}
+
+//Page 查询结果的一页，事件按照时间排序
+type Page struct {
+	Total  int     `json:"total"` //满足条件的事件总数
+	Events []Event `json:"events"`
+}
+
+//Store 只追加的事件日志，每天（UTC）一个 <yyyy-mm-dd>.jsonl 文件
+//配置了密钥时每行是一条加密的事件，文件名作为额外认证的数据
+type Store struct {
+	dir  string
+	seq  uint64
+	keys *keyring.Keyring
+
+	mu      sync.Mutex
+	day     string     //当前打开的分区
+	f       *os.File   //当前分区的文件
+	closed  bool       //Close 以后不再追加，后台写入的事件返回 ErrClosed
+	pending int        //Begin 开始但是还没有追加的后台写入
+	purging int        //正在等待后台写入结束的 Purge，这时新的后台写入等待 Purge 完成
+	cond    *sync.Cond //pending 和 purging 变化时通知，使用 mu
+}
+
+//Open 打开事件目录，不存在时创建，keys 为 nil 时不加密
+func Open(dir string, keys *keyring.Keyring) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create events directory failed")
+	}
+	s := &Store{dir: dir, keys: keys}
+	s.cond = sync.NewCond(&s.mu)
+	return s, nil
+}
+
+func (s *Store) file(day string) string {
+	return filepath.Join(s.dir, day+".jsonl")
+}
+
+//Begin 开始一次后台写入，事件在后台准备好以后用返回的函数追加，不追加时用空参数调用，返回的函数只能调用一次
+//Purge 先等待已经开始的后台写入完成再删除，删除凭证返回以后被删除人员的事件不会再落盘
+func (s *Store) Begin() func(events ...Event) error {
+	s.mu.Lock()
+	for s.purging > 0 {
+		s.cond.Wait()
+	}
+	s.pending++
+	s.mu.Unlock()
+	return func(events ...Event) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.pending--
+		s.cond.Broadcast()
+		return s.append(events)
+	}
+}
+
+//Append 追加事件，没有时间的事件使用当前时间，事件标识由 Store 分配
+func (s *Store) Append(events ...Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(events)
+}
+
+func (s *Store) append(events []Event) error {
+	if s.closed {
+		return ErrClosed
+	}
+	for i := range events {
+		e := &events[i]
+		if e.Time.IsZero() {
+			e.Time = time.Now()
+		}
+		e.ID = strconv.FormatInt(e.Time.UnixNano(), 36) + "-" + strconv.FormatUint(atomic.AddUint64(&s.seq, 1), 36)
+		day := e.Time.UTC().Format(partitionLayout)
+		if s.f == nil || s.day != day {
+			if s.f != nil {
+				s.f.Close()
+				s.f = nil
+			}
+			f, err := os.OpenFile(s.file(day), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				return errors.Wrap(err, "open events file failed")
+			}
+			s.f, s.day = f, day
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if data, err = s.keys.SealLine(data, []byte(filepath.Base(s.file(day)))); err != nil {
+			return errors.Wrap(err, "encrypt event failed")
+		}
+		if _, err := s.f.Write(append(data, '\n')); err != nil {
+			return errors.Wrap(err, "write events file failed")
+		}
+	}
+	return nil
+}
+
+//partitions 和 [from, to) 有交集的分区，按照日期排序
+func (s *Store) partitions(from, to time.Time) ([]string, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read events directory failed")
+	}
+	var days []string
+	for _, info := range infos {
+		day := strings.TrimSuffix(info.Name(), ".jsonl")
+		start, err := time.Parse(partitionLayout, day)
+		if err != nil || info.IsDir() || day == info.Name() {
+			continue
+		}
+		if (!to.IsZero() && !start.Before(to)) || (!from.IsZero() && !start.Add(24*time.Hour).After(from)) {
+			continue
+		}
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+//read 读取一个分区的所有事件，按照时间排序，进程崩溃时写了一半的最后一行被忽略
+func (s *Store) read(day string) ([]Event, error) {
+	var events []Event
+	err := linelog.Scan(s.keys, s.file(day), func(line, data []byte) {
+		var e Event
+		if data != nil && json.Unmarshal(data, &e) == nil {
+			events = append(events, e)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	//事件在后台写入，同一个分区中可能有少量乱序
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events, nil
+}
+
+func (q *Query) match(e *Event) bool {
+	return (len(q.PersonID) == 0 || e.PersonID == q.PersonID) &&
+		(len(q.Source) == 0 || e.Source == q.Source) &&
+		(len(q.Gallery) == 0 || e.Gallery == q.Gallery) &&
+		(q.From.IsZero() || !e.Time.Before(q.From)) &&
+		(q.To.IsZero() || e.Time.Before(q.To)) &&
+		e.Score >= q.MinScore
+}
+
+//Query 按照时间顺序返回满足条件的第 Offset 个开始的最多 Limit 个事件
+func (s *Store) Query(q Query) (*Page, error) {
+	if q.Offset < 0 || q.Limit < 0 || (!q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To)) {
+		return nil, ErrQuery
+	}
+	if q.Limit == 0 {
+		q.Limit = DefaultLimit
+	}
+	if q.Limit > MaxLimit {
+		q.Limit = MaxLimit
+	}
+	days, err := s.partitions(q.From, q.To)
+	if err != nil {
+		return nil, err
+	}
+	page := &Page{Events: []Event{}}
+	for _, day := range days {
+		events, err := s.read(day)
+		if err != nil {
+			return nil, err
+		}
+		for i := range events {
+			if !q.match(&events[i]) {
+				continue
+			}
+			if page.Total >= q.Offset && len(page.Events) < q.Limit {
+				page.Events = append(page.Events, events[i])
+			}
+			page.Total++
+		}
+	}
+	return page, nil
+}
+
+//Purge 从所有分区中删除人员的事件，有这个人员的分区重写为临时文件，落盘以后改名
+//已经开始的后台写入先完成，其中这个人员的事件同样删除
+//返回已经删除的分区，出错时前面的分区已经删除
+func (s *Store) Purge(personID string) ([]linelog.Purged, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	//等待已经开始的后台写入，其中可能有这个人员的事件；等待期间开始的后台写入等到删除完成以后
+	s.purging++
+	for s.pending > 0 {
+		s.cond.Wait()
+	}
+	defer func() {
+		s.purging--
+		s.cond.Broadcast()
+	}()
+	days, err := s.partitions(time.Time{}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	var out []linelog.Purged
+	for _, day := range days {
+		if s.day == day && s.f != nil {
+			s.f.Close()
+			s.f = nil
+		}
+		//写了一半的行可能是这个人员的记录，一起删除
+		torn := 0
+		n, err := linelog.Rewrite(s.keys, s.file(day), func(line, data []byte) bool {
+			var e Event
+			if data == nil || json.Unmarshal(data, &e) != nil {
+				torn++
+				return false
+			}
+			return e.PersonID != personID
+		})
+		if err != nil {
+			return out, err
+		}
+		if n > 0 {
+			out = append(out, linelog.Purged{File: s.file(day), Count: n - torn, Torn: torn})
+		}
+	}
+	return out, nil
+}
+
+//Reseal 用当前密钥重新加密所有分区中不是当前密钥加密的事件，返回重写的分区数目，密钥轮换使用
+//每个分区单独持有锁，重写期间追加的事件等待；写了一半的行同时删除；done 在每个分区处理以后调用，可以为 nil
+func (s *Store) Reseal(done func()) (int, error) {
+	days, err := s.partitions(time.Time{}, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, day := range days {
+		ok, err := s.reseal(day)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+		if done != nil {
+			done()
+		}
+	}
+	return n, nil
+}
+
+func (s *Store) reseal(day string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.day == day && s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+	ok, dropped, err := linelog.Reseal(s.keys, s.file(day))
+	if dropped > 0 {
+		glog.Warningf("%d unreadable lines dropped from %s", dropped, s.file(day))
+	}
+	return ok, err
+}
+
+//Close 关闭当前分区的文件，之后的 Append 返回 ErrClosed，不会重新打开分区
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
@@ -0,0 +1,60 @@
+package events
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/jpeg"
+	_ "image/png" //png 格式的照片同样可以生成缩略图
+
+	"github.com/pkg/errors"
+)
+
+//ThumbnailSize 缩略图的最大边长
+const ThumbnailSize = 96
+
+//thumbnailMargin 人脸框四周扩展的比例
+const thumbnailMargin = 0.2
+
+//Thumbnail 从照片中截取人脸框（四周扩展20%），缩小到不超过 ThumbnailSize，返回 base64 编码的 jpeg
+//照片不是 jpeg 或者 png 时返回错误
+func Thumbnail(img []byte, r Rect) (string, error) {
+	src, _, err := image.Decode(bytes.NewReader(img))
+	if err != nil {
+		return "", errors.Wrap(err, "decode image failed")
+	}
+	mw, mh := (r.X2-r.X1)*thumbnailMargin, (r.Y2-r.Y1)*thumbnailMargin
+	crop := image.Rect(int(r.X1-mw), int(r.Y1-mh), int(r.X2+mw), int(r.Y2+mh)).Intersect(src.Bounds())
+	if crop.Empty() {
+		return "", errors.New("face is out of the image")
+	}
+	w, h := crop.Dx(), crop.Dy()
+	scale := 1.0
+	if w > ThumbnailSize || h > ThumbnailSize {
+		if w > h {
+			scale = float64(ThumbnailSize) / float64(w)
+		} else {
+			scale = float64(ThumbnailSize) / float64(h)
+		}
+	}
+	tw, th := int(float64(w)*scale), int(float64(h)*scale)
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	//最近邻采样，缩略图只用于人工辨认
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		sy := crop.Min.Y + y*h/th
+		for x := 0; x < tw; x++ {
+			dst.Set(x, y, src.At(crop.Min.X+x*w/tw, sy))
+		}
+	}
+	buf := bytes.Buffer{}
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return "", errors.Wrap(err, "encode thumbnail failed")
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
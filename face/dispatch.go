@@ -0,0 +1,78 @@
+package face
+
+import (
+	"fmt"
+	"sync"
+)
+
+//completion 一个已经完成的请求以及它所属的连接
+type completion struct {
+	seq    int64
+	connId uint32
+	resp   Response
+}
+
+//dispatcher 把完成的请求转交给上层
+//cgo回调运行在SDK的线程上，它只把转换好的结果放入队列就返回，
+//由独立的协程调用 OnCompleted，这样慢的客户端不会阻塞SDK
+type dispatcher struct {
+	mu        sync.Mutex
+	queue     []completion
+	notify    chan struct{}
+	delivered uint64
+	maxDepth  int
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{
+		notify: make(chan struct{}, 1),
+	}
+}
+
+//put 放入一个完成的请求，永远不会阻塞
+func (d *dispatcher) put(c completion) {
+	d.mu.Lock()
+	d.queue = append(d.queue, c)
+	if len(d.queue) > d.maxDepth {
+		d.maxDepth = len(d.queue)
+	}
+	d.mu.Unlock()
+
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+}
+
+//take 取出所有待分发的请求
+func (d *dispatcher) take() []completion {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q := d.queue
+	d.queue = nil
+	d.delivered += uint64(len(q))
+	return q
+}
+
+func (d *dispatcher) State() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return fmt.Sprintf("dispatcher depth:%d max_depth:%d delivered:%d\n", len(d.queue), d.maxDepth, d.delivered)
+}
+
+//分发协程，在锁外调用上层回调
+func (x *XFace) dispatch() {
+	defer func() {
+		x.wg.Done()
+	}()
+	for {
+		select {
+		case <-x.done.notify:
+			for _, c := range x.done.take() {
+				x.deliver(c)
+			}
+		case <-x.ctx.Done():
+			return
+		}
+	}
+}
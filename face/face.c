@@ -3,6 +3,11 @@
 #include <malloc.h>
 #include <stdlib.h>
 #include <math.h>
+#ifdef _WIN32
+#include <windows.h>
+#else
+#include <pthread.h>
+#endif
 #include "../xface/xface.h"
 #include "../xface/cJSON.h"
 
@@ -44,11 +49,118 @@ struct Face {
 
 static struct Face *gInstance = NULL;
 
+/*
+ * HobotXFaceExtractFeatureAsyn 返回以后，SDK 还会在自己的线程里读取图片数据，
+ * 所以图片必须复制到C分配的内存中，按照seq登记，在 OnFeature 中释放。
+ * Go 的内存只在 DoFeature 调用期间有效，不能交给 SDK 长期持有。
+ */
+#define IMAGE_BUCKETS 64
+
+struct Image {
+  int64_t seq;
+  unsigned char *buf;
+  struct Image *next;
+};
+
+static struct Image *gImages[IMAGE_BUCKETS];
+static int gPendingImages = 0;
+
+#ifdef _WIN32
+static CRITICAL_SECTION gImageLock;
+static INIT_ONCE gImageLockOnce = INIT_ONCE_STATIC_INIT;
+static BOOL CALLBACK InitImageLock(PINIT_ONCE once, PVOID param, PVOID *ctx) {
+  InitializeCriticalSection(&gImageLock);
+  return TRUE;
+}
+static void LockImages() {
+  InitOnceExecuteOnce(&gImageLockOnce, InitImageLock, NULL, NULL);
+  EnterCriticalSection(&gImageLock);
+}
+static void UnlockImages() {
+  LeaveCriticalSection(&gImageLock);
+}
+#else
+static pthread_mutex_t gImageLock = PTHREAD_MUTEX_INITIALIZER;
+static void LockImages() {
+  pthread_mutex_lock(&gImageLock);
+}
+static void UnlockImages() {
+  pthread_mutex_unlock(&gImageLock);
+}
+#endif
+
+static unsigned char *PutImage(int64_t seq, const void *data, int length) {
+  struct Image *image = malloc(sizeof(struct Image));
+  if (image == NULL) {
+    return NULL;
+  }
+  image->buf = malloc(length);
+  if (image->buf == NULL) {
+    free(image);
+    return NULL;
+  }
+  memcpy(image->buf, data, length);
+  image->seq = seq;
+  int bucket = (int) ((uint64_t) seq % IMAGE_BUCKETS);
+  LockImages();
+  image->next = gImages[bucket];
+  gImages[bucket] = image;
+  gPendingImages++;
+  UnlockImages();
+  return image->buf;
+}
+
+static void FreeImage(int64_t seq) {
+  int bucket = (int) ((uint64_t) seq % IMAGE_BUCKETS);
+  struct Image *found = NULL;
+  LockImages();
+  struct Image **p = &gImages[bucket];
+  while (*p) {
+    if ((*p)->seq == seq) {
+      found = *p;
+      *p = found->next;
+      gPendingImages--;
+      break;
+    }
+    p = &(*p)->next;
+  }
+  UnlockImages();
+  if (found) {
+    free(found->buf);
+    free(found);
+  }
+}
+
+static void FreeAllImages() {
+  LockImages();
+  for (int i = 0; i < IMAGE_BUCKETS; i++) {
+    struct Image *image = gImages[i];
+    while (image) {
+      struct Image *next = image->next;
+      free(image->buf);
+      free(image);
+      image = next;
+    }
+    gImages[i] = NULL;
+  }
+  gPendingImages = 0;
+  UnlockImages();
+}
+
+int PendingImages() {
+  LockImages();
+  int n = gPendingImages;
+  UnlockImages();
+  return n;
+}
+
 static void OnFeature(int64_t seq, HobotXFaceImageFeatures *features) {
   if (gInstance == NULL)
     return;
   gInstance->callback(seq, features);
   HobotXFaceRelease(&features);
+  //SDK 已经处理完这张图片
+  FreeImage(seq);
 }
 
 int InitXFace(const char *conf, const char *model_conf, HobotXFaceHandle *handle) {
@@ -133,12 +245,25 @@ void UnInitFaceLib() {
     free(gInstance);
     gInstance = NULL;
   }
+  //引擎已经释放，没有回调的图片不会再被读取
+  FreeAllImages();
+}
+
+//模型版本，不同版本的模型提取的特征不能比较
+int GetModelVersion(char *version, int length) {
+  if (!gInstance || !gInstance->xface_handle) {
+    return ErrorCode_Uninit;
+  }
+  return HobotXFaceGetModuleVersion(gInstance->xface_handle, version, length);
 }
 
 int DoFeature(int64_t seq, int predict_mode, int max_face_count, const void *data, int length) {
   if (!gInstance) {
     return ErrorCode_Uninit;
   }
+  if (data == NULL || length <= 0) {
+    return ErrorCode_NoImg;
+  }
 
   int predict = PredictMode_Metric | PredictMode_Quality;
   if (predict_mode > 0) {
@@ -148,12 +273,21 @@ int DoFeature(int64_t seq, int predict_mode, int max_face_count, const void *dat
   if (max_face_count > 1) {
     face_count = max_face_count;
   }
+  unsigned char *buf = PutImage(seq, data, length);
+  if (buf == NULL) {
+    return ErrorCode_Other;
+  }
   HobotXFaceImage image;
   memset(&image, 0, sizeof(HobotXFaceImage));
-  image.buf_ = (unsigned char *) (data);
+  image.buf_ = buf;
   image.buf_len_ = length;
   image.buf_type_ = ImgType_None;
   image.predict_mode_ = predict;
   image.max_face_count_ = face_count;
-  return HobotXFaceExtractFeatureAsyn(gInstance->xface_handle, seq, image);
+  int ret = HobotXFaceExtractFeatureAsyn(gInstance->xface_handle, seq, image);
+  if (ret != ErrorCode_OK) {
+    //请求没有被接受，不会有回调
+    FreeImage(seq);
+  }
+  return ret;
 }
@@ -1,9 +1,6 @@
 package face
 
 /*
-#cgo windows LDFLAGS: -L ../xface -lxface_win
-#cgo linux LDFLAGS: -L ../build -L ../xface -lxface_mcil
-#cgo linux LDFLAGS: -Wl,-rpath=./
 #include <stdlib.h>
 #include "face.h"
 #include "../xface/xface_data.h"
@@ -14,7 +11,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"faceserver/pkg/protect"
 	"fmt"
 	"io"
 	"os"
@@ -30,9 +29,42 @@ var (
 	TypeFile   = 0  //表示请求方提供的是文件绝对位置
 	TypeBase64 = 1  //表示请求方提供的是文件base64串
 
-	PErrorParameters   = -1  //请求方的参数错误
-	PErrorFileNotFound = -2  //请求方提供的用于人脸特征提取的文件没找到
-	PErrorNOFeature    = -3  //没有获得人脸特征，第三方库返回空
+	PErrorParameters    = -1  //请求方的参数错误
+	PErrorFileNotFound  = -2  //请求方提供的用于人脸特征提取的文件没找到
+	PErrorNOFeature     = -3  //没有获得人脸特征，第三方库返回空
+	PErrorQueueFull     = -4  //请求所属优先级类别的队列已满
+	PErrorNotFound      = -5  //要取消的请求不存在或者已经完成，或者图库中没有这个人员
+	PErrorInternal      = -6  //服务器内部错误，比如处理结果时发生了panic
+	PErrorMultipleFaces = -7  //登记用的照片中有多张人脸
+	PErrorStorage       = -8  //服务器保存数据失败
+	PErrorNoGallery     = -9  //请求指定的图库不存在
+	PErrorExists        = -10 //要创建的图库已经存在
+	PErrorModelVersion  = -11 //特征的模型版本和图库或者另一个特征不一致，不能比较
+
+	ErrorNoRect = int(C.ErrorCode_NoRect) //第三方库的错误代码：照片中没有人脸
+
+	CmdFeature  = "feature"  //提取人脸特征
+	CmdCancel   = "cancel"   //取消一个尚未完成的请求，id为要取消的请求标识
+	CmdCompare  = "compare"  //1:1比对，inputs 为两张照片或者特征
+	CmdEnroll   = "enroll"   //登记人员到图库，inputs 为照片或者特征
+	CmdDelete   = "delete"   //从图库删除人员
+	CmdList     = "list"     //分页列出图库中的人员
+	CmdGet      = "get"      //查询图库中的一个人员
+	CmdIdentify = "identify" //1:N识别，提取照片中的所有人脸并在图库中检索
+
+	CmdGalleryCreate = "gallery_create"      //创建图库，可以指定阈值、top_k、索引和meta格式
+	CmdGalleryDrop   = "gallery_drop"        //删除图库以及其中的所有人员
+	CmdGalleryList   = "gallery_list"        //列出所有图库
+	CmdCluster       = "cluster"             //提取 inputs 中所有照片的人脸并按人聚类
+	CmdConsistency   = "gallery_consistency" //检查人员模板之间的一致性，找出不像同一个人的登记照片
+	CmdPurge         = "purge"               //从所有图库中彻底删除人员以及登记照片，返回签名的删除凭证
+	CmdSubscribe     = "subscribe"           //订阅关注名单图库的命中事件，任何客户端的请求中出现名单中的人都会推送
+	CmdUnsubscribe   = "unsubscribe"         //取消订阅，id 为订阅请求的标识
+	CmdDedupe        = "gallery_dedupe"      //找出图库中可能是同一个人的重复登记
+	CmdMerge         = "gallery_merge"       //把 merge_ids 中人员的模板合并到 person_id 下并删除这些人员
+	CmdCompareMatrix = "compare_matrix"      //inputs 中的每张人脸和 targets 中的每张人脸比对，返回相似度矩阵或者每行的 top_k
+	CmdVerify        = "verify_identity"     //人证核验：证件照和现场照片比对，检查活体和质量，返回结论并写入审计日志
+	CmdEventsQuery   = "events_query"        //按照人员、时间范围、来源和最低分数查询 compare 和 identify 的识别事件
 
 	HOBOT_XFACE_METRIC_LEN   = 256
 	HOBOT_XFACE_LANDMARK_LEN = 5
@@ -62,8 +94,10 @@ type FaceFeature struct {
 		Roll  float64 `json:"roll"`
 		Yaw   float64 `json:"yaw"`
 	} `json:"pose"`
-	Metric string `json:"metric"`
-	Age    struct {
+	Metric       string `json:"metric"`
+	MetricLen    int    `json:"metric_len"`    //特征的维数
+	ModelVersion string `json:"model_version"` //提取特征的模型版本，不同版本的特征不能比较
+	Age          struct {
 		Classification int     `json:"classification"`
 		Score          float64 `json:"score"`
 	} `json:"age"`
@@ -87,6 +121,15 @@ type FaceFeature struct {
 		Brightness int    `json:"brightness"`
 		Scores     string `json:"scores"`
 	} `json:"quality"`
+
+	Candidates []Candidate `json:"candidates,omitempty"` //identify 命令在图库中检索到的候选人员
+}
+
+//Candidate 图库检索的一个候选人员
+type Candidate struct {
+	PersonID string            `json:"person_id"`
+	Score    float64           `json:"score"` //相似度
+	Meta     map[string]string `json:"meta,omitempty"`
 }
 
 //Response 是服务器给客户端请求的应答包
@@ -95,24 +138,69 @@ type Response struct {
 	Cmd     string        `json:"cmd"` //客户端请求的命令
 	Result  int           `json:"result"` //请求处理的错误代码，0：表示成功，负数表示服务器自定义错误，其他错误由第三方库返回
 	Content []FaceFeature `json:"content"` //人脸特征
+	Data    interface{}   `json:"data,omitempty"` //feature以外的命令的结果，内容由命令决定
+	Source  string        `json:"source,omitempty"` //请求的来源标签
+}
+
+//Input 是命令的一个输入，可以是照片（type/content 的含义和 Request 相同），也可以直接提供特征
+type Input struct {
+	Type         int    `json:"type"`
+	Content      string `json:"content"`
+	Metric       string `json:"metric"`        //FaceFeature.Metric 格式的特征，提供了特征就不再提取
+	ModelVersion string `json:"model_version"` //可选，特征的模型版本，和 FaceFeature.ModelVersion 相同
 }
 
+//InternalConn 服务器内部发起的请求（导入、重新登记、标定等）使用的连接标识，
+//websocket 连接从1开始编号，Cancel 和 CancelConn 不会取消这些请求
+const InternalConn uint32 = 0
+
 //Request 是客户端的请求包格式，可以指定文件名或者文件的base64字符串
 type Request struct {
 	ConnId       uint32 //连接标识
 	ReqId        int64  //请求标识
 	ID           string `json:"id"`  //客户端请求标识串
-	Cmd          string `json:"cmd"` //请求的命令，目前只支持 'feature'，标识提取人脸特征
+	Cmd          string `json:"cmd"` //请求的命令，缺省为 'feature'，表示提取人脸特征
 	PredictMode  int    `json:"predict_mode"` //可选参数，参考第三方文档
 	MaxFaceCount int    `json:"max_face_count"` //可选最大提取人脸数目，默认为1
 	Type         int    `json:"type"` //指定content字段的内容，0：表示提供的是文件绝对路径，1：表示提供的是文件内容base64串
 	Content      string `json:"content"` //根据 type 不同内容不同
+	Priority     string `json:"priority"` //可选优先级：realtime，normal，bulk，默认为normal
+	Inputs       []Input `json:"inputs"` //compare等命令的输入
+	Targets      []Input `json:"targets"` //compare_matrix 的第二组输入，矩阵的列
+	Threshold    float64 `json:"threshold"` //可选的比对阈值，不指定时使用服务器配置
+	PersonID     string  `json:"person_id"` //图库命令操作的人员标识
+	Meta         map[string]string `json:"meta"` //enroll 时人员的附加信息
+	Offset       int     `json:"offset"` //list 的分页参数
+	Limit        int     `json:"limit"`
+	TopK         int     `json:"top_k"` //identify 每张人脸最多返回的候选人员数目
+	Gallery      string  `json:"gallery"` //compare、identify和图库命令操作的图库，缺省为默认图库
+	Index        string  `json:"index"` //gallery_create 的索引类型
+	Schema       json.RawMessage `json:"schema"` //gallery_create 的meta格式
+	Method       string  `json:"method"` //cluster 的算法：dbscan 或者 chinese_whispers
+	MinSamples   int     `json:"min_samples"` //cluster 的最少人数
+	Fusion       string  `json:"fusion"` //gallery_create 和 enroll 的模板融合策略：max、mean 或者 quality_mean
+	Source       string  `json:"source"` //可选的来源标签，比如摄像头编号；subscribe 时按照来源过滤
+	MinScore     float64 `json:"min_score"` //subscribe 推送的最低相似度，不指定时使用图库的阈值
+	Buffer       int     `json:"buffer"` //subscribe 的事件缓冲区长度，缺省为256，最大4096
+	MergeIDs     []string `json:"merge_ids"` //gallery_merge 合并到 person_id 的人员
+	Document     Input    `json:"document"` //verify_identity 的证件照
+	Live         Input    `json:"live"` //verify_identity 的现场照片
+	From         string   `json:"from"` //events_query 的时间范围，RFC3339 格式，包含 from 不包含 to，为空表示不限制
+	To           string   `json:"to"`
+
+	reply chan Response //服务器内部发起的请求通过这个通道应答，不经过 OnCompleted
 }
 
 //XFace 人脸特征提取对象
 type XFace struct {
 	reqs        map[int64]Request  //请求队列缓存，因为请求是异步的，所以需要缓存
-	writeCh     chan *Request   //网络模块通过此通道向本模块写入请求
+	sched       *scheduler   //网络模块写入的请求按照优先级在这里排队
+	done        *dispatcher  //完成的请求在这里等待分发给上层
+	health      health       //回调失败的统计以及引擎重启策略
+	engine      sync.RWMutex //重启引擎时不能再向引擎提交请求
+	conf        string       //引擎配置，重启引擎时使用
+	version     string       //引擎的模型版本，初始化引擎时读取
+	protect     *protect.Set //每个图库的模板保护密钥，nil 表示返回原始特征
 	mu          sync.Mutex
 	ctx         context.Context
 	cancel      context.CancelFunc
@@ -135,7 +223,8 @@ func GetFaceInstance() *XFace {
 	once.Do(func() {
 		XFaceSingleInstance = &XFace{
 			reqs:    make(map[int64]Request),
-			writeCh: make(chan *Request),
+			sched:   newScheduler(DefaultClasses),
+			done:    newDispatcher(),
 		}
 		XFaceSingleInstance.ctx, XFaceSingleInstance.cancel = context.WithCancel(context.Background())
 	})
@@ -158,33 +247,126 @@ func (x *XFace) Init() error {
 		return err
 	}
 
-	confStr := buf.String()
-	cConf := C.CString(confStr)
-	cModel := C.CString(modelName)
+	x.conf = buf.String()
 	//改变当前工作目录
 	os.Chdir(dir)
-	//调用C方法初始化第三方库引擎
+	err = x.initEngine()
+	if err != nil {
+		return err
+	}
+	x.wg.Add(2)
+	go x.run()
+	go x.dispatch()
+	return nil
+}
+
+//调用C方法初始化第三方库引擎
+func (x *XFace) initEngine() error {
+	cConf := C.CString(x.conf)
+	cModel := C.CString(modelName)
 	ret := C.InitFaceLib(cConf, cModel, (C.Callback)(unsafe.Pointer(C.go_callback_proxy)))
 	C.free(unsafe.Pointer(cConf))
 	C.free(unsafe.Pointer(cModel))
 	if ret != 0 {
 		return errors.New(fmt.Sprintf("init xface failed:%d", ret))
 	}
-	x.wg.Add(1)
-	go x.run()
+	version := make([]byte, 64)
+	if C.GetModelVersion((*C.char)(unsafe.Pointer(&version[0])), C.int(len(version))) == 0 {
+		x.mu.Lock()
+		x.version = strings.TrimRight(string(version), "\x00")
+		x.mu.Unlock()
+	}
 	return nil
 }
 
+//ModelVersion 引擎的模型版本，引擎还没有初始化时为空
+func (x *XFace) ModelVersion() string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.version
+}
+
+//SetProtection 设置模板保护的密钥，之后提取的特征在返回以前变换为受保护的模板，必须在 Init 之前调用
+func (x *XFace) SetProtection(s *protect.Set) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.protect = s
+}
+
+//Protected 图库是否启用了模板保护，gallery 为空表示默认图库
+func (x *XFace) Protected(gallery string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.protect.For(gallery) != nil
+}
+
+//TemplateVersion 图库中的模板应该具有的模型版本，启用了模板保护时包括密钥指纹，引擎还没有初始化时为空
+func (x *XFace) TemplateVersion(gallery string) string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if t := x.protect.For(gallery); t != nil && len(x.version) > 0 {
+		return t.Version(x.version)
+	}
+	return x.version
+}
+
+//CheckMetric 客户端提供的模型版本为 version 的特征 m 能否在图库中使用，返回0或者错误码：
+//启用了模板保护时必须是同一个密钥保护的模板，否则原始特征会绕过保护被保存或者比较；
+//只看版本不够，带着受保护版本的原始特征同样要拒绝，所以还要检查维数和取值
+func (x *XFace) CheckMetric(gallery, version string, m []float32) int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	t := x.protect.For(gallery)
+	if t == nil {
+		return 0
+	}
+	if !strings.HasSuffix(version, t.Version("")) {
+		return PErrorModelVersion
+	}
+	if !t.Valid(m) {
+		return PErrorParameters
+	}
+	return 0
+}
+
+//protectFeature 把特征替换为受保护的模板，无法解析时清空特征，不返回原始特征
+func protectFeature(f *FaceFeature, t *protect.Transform, version string) {
+	m, err := ParseMetric(f.Metric)
+	if err != nil {
+		f.Metric, f.MetricLen = "", 0
+		return
+	}
+	f.Metric = FormatMetric(t.Apply(m))
+	f.MetricLen = t.Bits
+	f.ModelVersion = t.Version(version)
+}
+
 //析构XFace 引擎
 func (x *XFace) UnInit() {
 	x.cancel()
 	x.wg.Wait()
+	x.engine.Lock()
+	defer x.engine.Unlock()
 	C.UnInitFaceLib()
 }
 
+//设置各优先级类别的权重和队列上限
+func (x *XFace) SetClasses(conf map[string]ClassConfig) {
+	x.sched.configure(conf)
+}
+
 //网络模块通过此方法向引擎申请人脸特征提取
+//请求所属类别的队列已满时，直接通知客户端
 func (x *XFace) DoFeature(r *Request) {
-	x.writeCh <- r
+	if err := x.sched.push(r); err != nil {
+		r.Content = ""
+		x.sendErrorResponse(*r, PErrorQueueFull)
+	}
+}
+
+//调度队列、分发队列以及回调失败的统计数据
+func (x *XFace) State() string {
+	return x.sched.State() + x.done.State() + x.health.State()
 }
 
 func (x *XFace) run() {
@@ -193,8 +375,14 @@ func (x *XFace) run() {
 	}()
 	for {
 		select {
-		case req := <-x.writeCh:
-			x.doRequest(req)
+		case <-x.sched.notify:
+			//每次只取出一个请求，这样新到达的高优先级请求可以插到前面
+			for req := x.sched.pop(); req != nil; req = x.sched.pop() {
+				x.doRequest(req)
+				if x.ctx.Err() != nil {
+					return
+				}
+			}
 		case <-x.ctx.Done():
 			//上层通知要退出
 			return
@@ -202,42 +390,135 @@ func (x *XFace) run() {
 	}
 }
 
+//取消connId连接上标识为id的请求
+//请求还在排队时直接移除；已经提交给引擎时，丢弃它的应答
+//返回false表示没有找到这个请求
+func (x *XFace) Cancel(connId uint32, id string) bool {
+	if connId == InternalConn {
+		return false
+	}
+	if x.sched.remove(connId, id) > 0 {
+		return true
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	found := false
+	for seq, r := range x.reqs {
+		if r.ConnId == connId && r.ID == id {
+			delete(x.reqs, seq)
+			found = true
+		}
+	}
+	return found
+}
+
+//取消connId连接上所有未完成的请求，连接关闭时调用
+func (x *XFace) CancelConn(connId uint32) {
+	if connId == InternalConn {
+		return
+	}
+	x.sched.remove(connId, "")
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for seq, r := range x.reqs {
+		if r.ConnId == connId {
+			delete(x.reqs, seq)
+		}
+	}
+}
+
 //处理客户端请求
+//请求在加载照片之前就登记到 reqs 中，这样在处理过程中也可以被取消，
+//而且引擎的回调不会早于登记
 func (x *XFace) doRequest(r *Request) {
+	content := r.Content
+	//Content内容较大，我们不再需要，尽早释放内存
+	r.Content = ""
+	x.mu.Lock()
+	x.reqs[r.ReqId] = *r
+	x.mu.Unlock()
+
 	buf := bytes.Buffer{}
 	var err error
 	var result int
 	if r.Type == TypeFile {
 		//从本地文件中加载照片
-		err = x.loadFile(r.Content, &buf)
+		err = x.loadFile(content, &buf)
 		if err != nil {
 			result = PErrorFileNotFound
 		}
 	} else {
 		//从content 解码照片
-		err = x.decode(r.Content, &buf)
+		err = x.decode(content, &buf)
 		if err != nil {
 			result = PErrorParameters
 		}
 	}
-	//Content内容较大，我们不再需要，尽早释放内存
-	r.Content = ""
+	content = ""
 
 	if err != nil {
 		//加载照片失败了，我们需要通知客户端
-		x.sendErrorResponse(*r, result)
+		x.finish(r.ReqId, result, nil)
+		return
+	}
+	//在引擎的读锁中检查，否则检查以后重启引擎结束了这个请求，它仍然会提交给新的引擎
+	x.engine.RLock()
+	if !x.pending(r.ReqId) {
+		//加载照片期间请求被取消了，或者被重启引擎结束了
+		x.engine.RUnlock()
 		return
 	}
 	//调用C方法处理请求
 	n := x.feature(r.ReqId, r.PredictMode, r.MaxFaceCount, buf)
+	x.engine.RUnlock()
 	if n != 0 {
 		//引擎返回失败，我们通知客户端
-		x.sendErrorResponse(*r, n)
-		return
+		x.finish(r.ReqId, n, nil)
 	}
+}
+
+//请求是否还没有完成或者被取消
+func (x *XFace) pending(seq int64) bool {
 	x.mu.Lock()
 	defer x.mu.Unlock()
-	x.reqs[r.ReqId] = *r
+	_, ok := x.reqs[seq]
+	return ok
+}
+
+//结束一个请求并交给分发协程通知上层，请求已经被取消时不再应答
+//转换结果的过程中请求一直留在 reqs 中，发生panic时 recoverCallback 仍然可以找到它并应答内部错误；
+//转换完成以后才取出请求，已经被取消或者被其他路径应答过的请求不再应答
+func (x *XFace) finish(seq int64, result int, features []FaceFeature) {
+	x.mu.Lock()
+	r, ok := x.reqs[seq]
+	version := x.version
+	t := x.protect.For(r.Gallery)
+	x.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	for i := range features {
+		features[i].ModelVersion = version
+		if t != nil {
+			protectFeature(&features[i], t, version)
+		}
+	}
+	x.mu.Lock()
+	_, ok = x.reqs[seq]
+	delete(x.reqs, seq)
+	x.mu.Unlock()
+	if !ok {
+		return
+	}
+	resp := Response{
+		ID:      r.ID,
+		Cmd:     r.Cmd,
+		Result:  result,
+		Content: features,
+		Source:  r.Source,
+	}
+	x.complete(seq, r, resp)
 }
 
 func (x *XFace) sendErrorResponse(r Request, result int) {
@@ -247,7 +528,38 @@ func (x *XFace) sendErrorResponse(r Request, result int) {
 		Result:  result,
 		Content: nil,
 	}
-	x.OnCompleted(r.ConnId, resp)
+	x.complete(r.ReqId, r, resp)
+}
+
+//内部请求直接应答给发起方，其他请求交给分发协程
+func (x *XFace) complete(seq int64, r Request, resp Response) {
+	if r.reply != nil {
+		r.reply <- resp
+		return
+	}
+	x.done.put(completion{seq: seq, connId: r.ConnId, resp: resp})
+}
+
+//Extract 服务器内部使用的同步提取接口，请求和客户端请求一样排队
+//调用方需要填写 ConnId（内部请求为 InternalConn）、ReqId、ID 等字段，ctx 结束时请求被取消并返回 PErrorInternal
+func (x *XFace) Extract(ctx context.Context, r *Request) Response {
+	r.reply = make(chan Response, 1)
+	x.DoFeature(r)
+	select {
+	case resp := <-r.reply:
+		return resp
+	case <-ctx.Done():
+		x.cancelSeq(r.ReqId)
+		return Response{ID: r.ID, Cmd: r.Cmd, Result: PErrorInternal}
+	}
+}
+
+//按照请求标识取消一个请求
+func (x *XFace) cancelSeq(seq int64) {
+	x.sched.removeSeq(seq)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.reqs, seq)
 }
 
 func (x *XFace) loadFile(name string, buf *bytes.Buffer) error {
@@ -279,38 +591,46 @@ func (x *XFace) decode(c string, buf *bytes.Buffer) error {
 	return nil
 }
 
+//调用C方法提交图片，C层会把图片复制到自己分配的内存中，
+//所以 data 只需要在本次调用期间有效
 func (x *XFace) feature(seq int64, predictMode int, maxFaceCount int, data bytes.Buffer) int {
 	b := data.Bytes()
-	var t C.int = C.DoFeature(C.int64_t(seq), C.int(predictMode), C.int(maxFaceCount), unsafe.Pointer(&b[0]), C.int(data.Len()))
+	if len(b) == 0 {
+		return PErrorParameters
+	}
+	var t C.int = C.DoFeature(C.int64_t(seq), C.int(predictMode), C.int(maxFaceCount), unsafe.Pointer(&b[0]), C.int(len(b)))
+	if submitted != nil {
+		submitted(b)
+	}
 	return int(t)
 }
 
-func (x *XFace) onCallback(seq int64, result int, features []FaceFeature) {
-	x.mu.Lock()
-	defer x.mu.Unlock()
+//已经提交给引擎但是还没有回调的图片数量
+func (x *XFace) PendingImages() int {
+	return int(C.PendingImages())
+}
 
-	if r, ok := x.reqs[seq]; ok {
-		resp := Response{
-			ID:      r.ID,
-			Cmd:     r.Cmd,
-			Result:  result,
-			Content: features,
-		}
-		x.OnCompleted(r.ConnId, resp)
-	}
+func (x *XFace) onCallback(seq int64, result int, features []FaceFeature) {
+	x.finish(seq, result, features)
 }
 
 //export callbackOnCgo
-func callbackOnCgo(seq C.int, result *C.HobotXFaceImageFeatures) {
+func callbackOnCgo(seq C.int64_t, result *C.HobotXFaceImageFeatures) {
 	x := GetFaceInstance()
+	//运行在SDK的线程上，任何panic都不能让整个进程退出
+	defer x.recoverCallback(int64(seq))
+	code, features := convertFeatures(result)
+	x.onCallback(int64(seq), code, features)
+}
+
+//把引擎的结果转换为go的数据结构
+func convertFeatures(result *C.HobotXFaceImageFeatures) (int, []FaceFeature) {
 	if result == nil {
-		x.onCallback(int64(seq), PErrorNOFeature, nil)
-		return
+		return PErrorNOFeature, nil
 	}
 
 	if result.error_code_ != 0 {
-		x.onCallback(int64(seq), int(result.error_code_), nil)
-		return
+		return int(result.error_code_), nil
 	}
 
 	features := []FaceFeature{}
@@ -344,6 +664,7 @@ func callbackOnCgo(seq C.int, result *C.HobotXFaceImageFeatures) {
 				b.WriteString(",")
 			}
 			f.Metric = b.String()
+			f.MetricLen = HOBOT_XFACE_METRIC_LEN
 			b.Reset()
 		}
 
@@ -382,5 +703,5 @@ func callbackOnCgo(seq C.int, result *C.HobotXFaceImageFeatures) {
 		}
 		features = append(features, f)
 	}
-	x.onCallback(int64(seq), 0, features)
+	return 0, features
 }
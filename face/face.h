@@ -12,5 +12,9 @@ int DoFeature(int64_t seq, int predict_mode, int max_face_count, const void *dat
 
 void UnInitFaceLib();
 
+int PendingImages();
+
+int GetModelVersion(char *version, int length);
+
 #endif //FACE_H_
 
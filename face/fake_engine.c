@@ -0,0 +1,308 @@
+// +build fakeengine
+
+/*
+ * 用于测试的假引擎，实现了 face.c 用到的 xface.h 接口，不需要第三方库和模型。
+ * 编译：go build -tags fakeengine
+ *
+ * 异步接口在独立的线程中延迟读取整张图片，和真实SDK一样在调用返回以后才访问图片内存。
+ * 特征由图片内容确定，相同的图片得到相同的特征。
+ * 图片可以用一行文本头控制结果，格式为 "FAKE:key=value;key=value\n"：
+ *   faces=n          返回n张人脸，默认1，0表示没有人脸
+ *   person=a,b       每张人脸对应的身份，相同身份的特征相近
+ *   noise=0.1        在身份特征上叠加的噪声幅度，默认0.1
+ *   liveness=0.9     活体分数，默认0.9
+ *   quality=0.8      质量分数，默认0.8
+ *   stress=1         图片最后8字节是前面内容的校验和，读取时校验失败返回 ErrorCode_Other
+ * xface.json 中的 "fake_model_version" 设置模型版本，默认 fake-model-1.0，
+ * 其他版本的特征和默认版本不相关，用于模拟模型升级
+ */
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <math.h>
+#include <pthread.h>
+#include <unistd.h>
+#include "../xface/xface.h"
+
+#define FAKE_MAX_FACES 16
+#define FAKE_MAX_NAME 64
+
+#define FAKE_MODEL_VERSION "fake-model-1.0"
+
+struct FakeHandle {
+  HobotXFaceCallback callback;
+  char model_version[FAKE_MAX_NAME];
+};
+
+//正在运行的任务数，HobotXFaceFree 要等待所有任务结束
+static int gRunning = 0;
+static pthread_mutex_t gRunningLock = PTHREAD_MUTEX_INITIALIZER;
+static pthread_cond_t gRunningCond = PTHREAD_COND_INITIALIZER;
+
+struct FakeTask {
+  struct FakeHandle *handle;
+  int64_t seq;
+  HobotXFaceImage image;
+};
+
+struct FakeHeader {
+  int faces;
+  int persons;
+  char person[FAKE_MAX_FACES][FAKE_MAX_NAME];
+  float noise;
+  float liveness;
+  float quality;
+  int stress;
+  int length; //文本头的长度
+};
+
+static uint64_t Fnv(const unsigned char *data, int length, uint64_t h) {
+  for (int i = 0; i < length; i++) {
+    h ^= data[i];
+    h *= 1099511628211ULL;
+  }
+  return h;
+}
+
+static uint64_t NextRandom(uint64_t *state) {
+  uint64_t x = *state;
+  x ^= x << 13;
+  x ^= x >> 7;
+  x ^= x << 17;
+  *state = x;
+  return x;
+}
+
+//返回 [-1,1) 之间的随机数
+static float RandomFloat(uint64_t *state) {
+  return (float) ((NextRandom(state) >> 11) * (1.0 / 9007199254740992.0)) * 2.0f - 1.0f;
+}
+
+static void ParseHeader(const unsigned char *buf, int length, struct FakeHeader *h) {
+  memset(h, 0, sizeof(struct FakeHeader));
+  h->faces = 1;
+  h->noise = 0.1f;
+  h->liveness = 0.9f;
+  h->quality = 0.8f;
+  if (length < 5 || memcmp(buf, "FAKE:", 5) != 0) {
+    return;
+  }
+  int end = 5;
+  while (end < length && buf[end] != '\n') {
+    end++;
+  }
+  h->length = end < length ? end + 1 : end;
+
+  char line[1024] = {0};
+  int n = end - 5 < (int) sizeof(line) - 1 ? end - 5 : (int) sizeof(line) - 1;
+  memcpy(line, buf + 5, n);
+  char *save = NULL;
+  for (char *kv = strtok_r(line, ";", &save); kv; kv = strtok_r(NULL, ";", &save)) {
+    char *value = strchr(kv, '=');
+    if (!value) {
+      continue;
+    }
+    *value++ = 0;
+    if (strcmp(kv, "faces") == 0) {
+      h->faces = atoi(value);
+    } else if (strcmp(kv, "noise") == 0) {
+      h->noise = (float) atof(value);
+    } else if (strcmp(kv, "liveness") == 0) {
+      h->liveness = (float) atof(value);
+    } else if (strcmp(kv, "quality") == 0) {
+      h->quality = (float) atof(value);
+    } else if (strcmp(kv, "stress") == 0) {
+      h->stress = atoi(value);
+    } else if (strcmp(kv, "person") == 0) {
+      char *psave = NULL;
+      for (char *p = strtok_r(value, ",", &psave); p && h->persons < FAKE_MAX_FACES;
+           p = strtok_r(NULL, ",", &psave)) {
+        strncpy(h->person[h->persons++], p, FAKE_MAX_NAME - 1);
+      }
+    }
+  }
+  if (h->faces < 0) {
+    h->faces = 0;
+  }
+  if (h->faces > FAKE_MAX_FACES) {
+    h->faces = FAKE_MAX_FACES;
+  }
+}
+
+static void MakeFeature(const struct FakeHeader *h, const char *model_version, uint64_t image_hash, int index,
+                        HobotXFaceFeature *f) {
+  memset(f, 0, sizeof(HobotXFaceFeature));
+  uint64_t identity = image_hash ^ (uint64_t) (index + 1) * 0x9E3779B97F4A7C15ULL;
+  if (index < h->persons) {
+    identity = Fnv((const unsigned char *) h->person[index], (int) strlen(h->person[index]),
+                   14695981039346656037ULL);
+  }
+  if (strcmp(model_version, FAKE_MODEL_VERSION) != 0) {
+    identity = Fnv((const unsigned char *) model_version, (int) strlen(model_version), identity);
+  }
+  uint64_t noise = image_hash ^ (uint64_t) (index + 1) * 0xBF58476D1CE4E5B9ULL;
+  if (identity == 0) {
+    identity = 1;
+  }
+  if (noise == 0) {
+    noise = 1;
+  }
+  float norm = 0;
+  for (int k = 0; k < HOBOT_XFACE_METRIC_LEN; k++) {
+    float v = RandomFloat(&identity) + h->noise * RandomFloat(&noise);
+    f->metric_[k] = v;
+    norm += v * v;
+  }
+  norm = sqrtf(norm);
+  for (int k = 0; k < HOBOT_XFACE_METRIC_LEN; k++) {
+    f->metric_[k] /= norm;
+  }
+  f->face_rect_.x1_ = 10.0f + 100.0f * index;
+  f->face_rect_.y1_ = 10.0f;
+  f->face_rect_.x2_ = f->face_rect_.x1_ + 80.0f - index;
+  f->face_rect_.y2_ = 90.0f - index;
+  f->face_rect_.score_ = 0.99f;
+  f->liveness_score_ = h->liveness;
+  f->quality_score_ = h->quality;
+  for (int k = 0; k < HOBOT_XFACE_LANDMARK_LEN; k++) {
+    f->landmark_[k].x_ = f->face_rect_.x1_ + 10.0f * k;
+    f->landmark_[k].y_ = 40.0f;
+    f->landmark_[k].visible_ = 1;
+  }
+  for (int k = 0; k < HOBOT_XFACE_QUALITY_LEN; k++) {
+    f->quality_.scores_[k] = h->quality;
+  }
+}
+
+static void *RunTask(void *arg) {
+  struct FakeTask *task = (struct FakeTask *) arg;
+  //模拟引擎的处理时间，这期间调用方早已返回
+  usleep((useconds_t) (rand() % 2000));
+
+  const unsigned char *buf = task->image.buf_;
+  int length = task->image.buf_len_;
+  struct FakeHeader h;
+  ParseHeader(buf, length, &h);
+
+  HobotXFaceImageFeatures *result = calloc(1, sizeof(HobotXFaceImageFeatures));
+  uint64_t hash = Fnv(buf, length, 14695981039346656037ULL);
+  if (h.stress) {
+    uint64_t sum = 0;
+    if (length >= h.length + 8) {
+      memcpy(&sum, buf + length - 8, 8);
+    }
+    if (length < h.length + 8 || sum != Fnv(buf, length - 8, 14695981039346656037ULL)) {
+      result->error_code_ = ErrorCode_Other;
+    }
+  }
+  int faces = h.faces;
+  if (task->image.max_face_count_ > 0 && faces > task->image.max_face_count_) {
+    faces = task->image.max_face_count_;
+  }
+  if (result->error_code_ == ErrorCode_OK && faces == 0) {
+    result->error_code_ = ErrorCode_NoRect;
+  }
+  if (result->error_code_ == ErrorCode_OK) {
+    result->features_ = calloc(faces, sizeof(HobotXFaceFeature));
+    result->features_count_ = faces;
+    for (int i = 0; i < faces; i++) {
+      MakeFeature(&h, task->handle->model_version, hash, i, &result->features_[i]);
+    }
+  }
+  task->handle->callback(task->seq, result);
+  free(task);
+
+  pthread_mutex_lock(&gRunningLock);
+  if (--gRunning == 0) {
+    pthread_cond_broadcast(&gRunningCond);
+  }
+  pthread_mutex_unlock(&gRunningLock);
+  return NULL;
+}
+
+HobotXFaceStatus HobotXFaceGetVersion(char *sdk_version, int length) {
+  snprintf(sdk_version, length, "fake-sdk-1.0");
+  return ErrorCode_OK;
+}
+
+const char *HobotXFaceGetLicenseInfo() {
+  return "fake";
+}
+
+HobotXFaceStatus HobotXFaceGetModuleVersion(const HobotXFaceHandle handle, char *model_version, int length) {
+  snprintf(model_version, length, "%s", ((struct FakeHandle *) handle)->model_version);
+  return ErrorCode_OK;
+}
+
+const char *HobotXFaceGetErrorDetail(HobotXFaceErrorCode error_code) {
+  return "fake engine error";
+}
+
+HobotXFaceStatus HobotXFaceCreate(HobotXFaceHandle *handle) {
+  struct FakeHandle *h = calloc(1, sizeof(struct FakeHandle));
+  snprintf(h->model_version, FAKE_MAX_NAME, "%s", FAKE_MODEL_VERSION);
+  *handle = h;
+  return ErrorCode_OK;
+}
+
+HobotXFaceStatus HobotXFaceSetConfig(const HobotXFaceHandle handle, const char *key, const char *value) {
+  if (strcmp(key, "fake_model_version") == 0 && value) {
+    snprintf(((struct FakeHandle *) handle)->model_version, FAKE_MAX_NAME, "%s", value);
+  }
+  return ErrorCode_OK;
+}
+
+HobotXFaceStatus HobotXFaceInit(const HobotXFaceHandle handle) {
+  return ErrorCode_OK;
+}
+
+HobotXFaceStatus HobotXFaceFree(HobotXFaceHandle handle) {
+  pthread_mutex_lock(&gRunningLock);
+  while (gRunning > 0) {
+    pthread_cond_wait(&gRunningCond, &gRunningLock);
+  }
+  pthread_mutex_unlock(&gRunningLock);
+  free(handle);
+  return ErrorCode_OK;
+}
+
+HobotXFaceStatus HobotXFaceSetCallback(const HobotXFaceHandle handle, const HobotXFaceCallback cb) {
+  ((struct FakeHandle *) handle)->callback = cb;
+  return ErrorCode_OK;
+}
+
+HobotXFaceStatus HobotXFaceExtractFeatureAsyn(const HobotXFaceHandle handle, int64_t seq, const HobotXFaceImage image) {
+  struct FakeHandle *h = (struct FakeHandle *) handle;
+  if (h == NULL || h->callback == NULL) {
+    return ErrorCode_Uninit;
+  }
+  if (image.buf_ == NULL || image.buf_len_ <= 0) {
+    return ErrorCode_NoImg;
+  }
+  struct FakeTask *task = malloc(sizeof(struct FakeTask));
+  task->handle = h;
+  task->seq = seq;
+  task->image = image;
+  pthread_mutex_lock(&gRunningLock);
+  gRunning++;
+  pthread_mutex_unlock(&gRunningLock);
+  pthread_t tid;
+  if (pthread_create(&tid, NULL, RunTask, task) != 0) {
+    free(task);
+    pthread_mutex_lock(&gRunningLock);
+    gRunning--;
+    pthread_mutex_unlock(&gRunningLock);
+    return ErrorCode_Other;
+  }
+  pthread_detach(tid);
+  return ErrorCode_OK;
+}
+
+HobotXFaceStatus HobotXFaceRelease(HobotXFaceImageFeatures **features) {
+  if (features && *features) {
+    free((*features)->features_);
+    free(*features);
+    *features = NULL;
+  }
+  return ErrorCode_OK;
+}
@@ -0,0 +1,13 @@
+// +build !fakeengine
+
+package face
+
+/*
+#cgo windows LDFLAGS: -L ../xface -lxface_win
+#cgo linux LDFLAGS: -L ../build -L ../xface -lxface_mcil
+#cgo linux LDFLAGS: -Wl,-rpath=./
+*/
+import "C"
+
+//submitted 只有假引擎的压力测试设置
+var submitted func(data []byte)
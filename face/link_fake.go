@@ -0,0 +1,16 @@
+// +build fakeengine
+
+package face
+
+/*
+#cgo linux LDFLAGS: -lpthread -lm
+*/
+import "C"
+
+//submitted 图片提交给引擎以后用提交的内存调用，压力测试用来改写这块内存，检查引擎使用的是自己的副本
+var submitted func(data []byte)
+
+//OnSubmitted 设置图片提交以后的回调，只有假引擎提供，必须在 Init 以前设置
+func OnSubmitted(fn func(data []byte)) {
+	submitted = fn
+}
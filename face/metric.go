@@ -0,0 +1,91 @@
+package face
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//ParseMetric 解析 FaceFeature.Metric 的字符串格式，逗号分隔的浮点数，允许以逗号结尾
+func ParseMetric(s string) ([]float32, error) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimSuffix(s, ",")
+	if len(s) == 0 {
+		return nil, errors.New("empty metric")
+	}
+	fields := strings.Split(s, ",")
+	m := make([]float32, 0, len(fields))
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metric value at %d: %v", i, err)
+		}
+		//NaN 和 Inf 的相似度也是 NaN，比较结果没有意义，应答也无法编码为 json
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("invalid metric value at %d: %v", i, v)
+		}
+		m = append(m, float32(v))
+	}
+	return m, nil
+}
+
+//FormatMetric 把特征转换为 FaceFeature.Metric 的字符串格式
+func FormatMetric(m []float32) string {
+	b := strings.Builder{}
+	for _, v := range m {
+		b.WriteString(strconv.FormatFloat(float64(v), 'g', -1, 32))
+		b.WriteString(",")
+	}
+	return b.String()
+}
+
+//Normalize 返回L2归一化以后的特征，全零向量原样返回
+func Normalize(m []float32) []float32 {
+	var sum float64
+	for _, v := range m {
+		sum += float64(v) * float64(v)
+	}
+	out := make([]float32, len(m))
+	if sum == 0 {
+		copy(out, m)
+		return out
+	}
+	n := math.Sqrt(sum)
+	for i, v := range m {
+		out[i] = float32(float64(v) / n)
+	}
+	return out
+}
+
+//Cosine 两个特征的余弦相似度，取值范围[-1,1]，长度不同时返回错误
+func Cosine(a, b []float32) (float64, error) {
+	if len(a) != len(b) {
+		return 0, fmt.Errorf("metric length mismatch: %d != %d", len(a), len(b))
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0, nil
+	}
+	return dot / math.Sqrt(na*nb), nil
+}
+
+//LargestFace 返回人脸框面积最大的人脸的序号，没有人脸时返回-1
+func LargestFace(features []FaceFeature) int {
+	index := -1
+	var area float64
+	for i, f := range features {
+		a := (f.Rect.X2 - f.Rect.X1) * (f.Rect.Y2 - f.Rect.Y1)
+		if index < 0 || a > area {
+			index = i
+			area = a
+		}
+	}
+	return index
+}
@@ -0,0 +1,109 @@
+package face
+
+/*
+#include "face.h"
+*/
+import "C"
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+//health 回调失败的统计以及引擎重启策略
+type health struct {
+	callbackFailures uint64 //cgo回调中发生panic的次数
+	dispatchFailures uint64 //OnCompleted 中发生panic的次数
+	consecutive      int64  //cgo回调连续失败的次数，成功一次就清零
+	restarts         uint64 //引擎重启的次数
+	restartAfter     int64  //cgo回调连续失败多少次以后重启引擎，0表示不重启
+	restarting       int32
+}
+
+func (h *health) State() string {
+	return fmt.Sprintf("callback failures:%d consecutive:%d dispatch failures:%d engine restarts:%d\n",
+		atomic.LoadUint64(&h.callbackFailures),
+		atomic.LoadInt64(&h.consecutive),
+		atomic.LoadUint64(&h.dispatchFailures),
+		atomic.LoadUint64(&h.restarts))
+}
+
+//设置cgo回调连续失败多少次以后重启引擎，0表示不重启
+func (x *XFace) SetRestartPolicy(n int) {
+	atomic.StoreInt64(&x.health.restartAfter, int64(n))
+}
+
+//cgo回调的panic恢复，记录请求标识并且用内部错误应答这个请求
+//必须直接在 defer 中调用
+func (x *XFace) recoverCallback(seq int64) {
+	v := recover()
+	if v == nil {
+		atomic.StoreInt64(&x.health.consecutive, 0)
+		return
+	}
+	glog.Errorf("capture a panic in callback of request[%d]: %v\n%s", seq, v, debug.Stack())
+	atomic.AddUint64(&x.health.callbackFailures, 1)
+	n := atomic.AddInt64(&x.health.consecutive, 1)
+	x.finish(seq, PErrorInternal, nil)
+
+	limit := atomic.LoadInt64(&x.health.restartAfter)
+	if limit > 0 && n >= limit {
+		//不能在SDK的线程上释放引擎
+		go x.restart()
+	}
+}
+
+//调用上层的 OnCompleted，发生panic时改为应答内部错误
+func (x *XFace) deliver(c completion) {
+	defer func() {
+		if v := recover(); v != nil {
+			glog.Errorf("capture a panic in OnCompleted of request[%d]: %v\n%s", c.seq, v, debug.Stack())
+			atomic.AddUint64(&x.health.dispatchFailures, 1)
+			if c.resp.Result != PErrorInternal {
+				x.deliver(completion{
+					seq:    c.seq,
+					connId: c.connId,
+					resp:   Response{ID: c.resp.ID, Cmd: c.resp.Cmd, Result: PErrorInternal},
+				})
+			}
+		}
+	}()
+	x.OnCompleted(c.connId, c.resp)
+}
+
+//重启引擎，所有已经提交给引擎的请求都以内部错误结束
+func (x *XFace) restart() {
+	if !atomic.CompareAndSwapInt32(&x.health.restarting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&x.health.restarting, 0)
+
+	x.engine.Lock()
+	defer x.engine.Unlock()
+	if x.ctx.Err() != nil {
+		//正在退出，由 UnInit 释放引擎
+		return
+	}
+	glog.Warningf("callback failed %d times in a row, restart xface engine",
+		atomic.LoadInt64(&x.health.consecutive))
+	C.UnInitFaceLib()
+
+	x.mu.Lock()
+	seqs := make([]int64, 0, len(x.reqs))
+	for seq := range x.reqs {
+		seqs = append(seqs, seq)
+	}
+	x.mu.Unlock()
+	for _, seq := range seqs {
+		x.finish(seq, PErrorInternal, nil)
+	}
+
+	if err := x.initEngine(); err != nil {
+		glog.Errorf("restart xface engine failed: %v", err)
+		return
+	}
+	atomic.StoreInt64(&x.health.consecutive, 0)
+	atomic.AddUint64(&x.health.restarts, 1)
+}
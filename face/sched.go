@@ -0,0 +1,242 @@
+package face
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//请求的优先级类别
+const (
+	PriorityRealtime = "realtime" //实时请求，比如门禁开门
+	PriorityNormal   = "normal"   //普通请求，默认类别
+	PriorityBulk     = "bulk"     //批量请求，比如后台重建索引
+)
+
+//ClassConfig 某个优先级类别的调度参数
+type ClassConfig struct {
+	Weight int //权重，权重越大，分到的引擎份额越多
+	Limit  int //队列上限，队列满了以后新的请求会被拒绝
+}
+
+//DefaultClasses 默认的调度参数
+var DefaultClasses = map[string]ClassConfig{
+	PriorityRealtime: {Weight: 8, Limit: 64},
+	PriorityNormal:   {Weight: 4, Limit: 256},
+	PriorityBulk:     {Weight: 1, Limit: 1024},
+}
+
+//ParseClasses 解析命令行中的调度参数，格式为 name:weight:limit,name:weight:limit
+//没有指定的类别使用默认参数
+func ParseClasses(s string) (map[string]ClassConfig, error) {
+	classes := make(map[string]ClassConfig)
+	for k, v := range DefaultClasses {
+		classes[k] = v
+	}
+	if len(s) == 0 {
+		return classes, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		fields := strings.Split(strings.TrimSpace(item), ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid class config: %s", item)
+		}
+		if _, ok := DefaultClasses[fields[0]]; !ok {
+			return nil, fmt.Errorf("unknown priority class: %s", fields[0])
+		}
+		weight, err := strconv.Atoi(fields[1])
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid weight of class %s: %s", fields[0], fields[1])
+		}
+		limit, err := strconv.Atoi(fields[2])
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid limit of class %s: %s", fields[0], fields[2])
+		}
+		classes[fields[0]] = ClassConfig{Weight: weight, Limit: limit}
+	}
+	return classes, nil
+}
+
+var errQueueFull = errors.New("queue is full")
+
+//item 队列中的一个请求
+type item struct {
+	req    *Request
+	finish float64   //虚拟完成时间
+	at     time.Time //入队时间
+}
+
+//class 一个优先级类别的队列以及统计数据
+type class struct {
+	name     string
+	conf     ClassConfig
+	queue    []item
+	finish   float64 //最后一个入队请求的虚拟完成时间
+	enqueued uint64
+	dequeued uint64
+	rejected uint64
+	wait     time.Duration //已出队请求的总等待时间
+	maxDepth int
+}
+
+//scheduler 加权公平队列，替代原来单一的请求通道
+//每个请求入队时按照 max(系统虚拟时间, 本类别上一个请求的完成时间) + 1/权重 计算虚拟完成时间，
+//出队时总是选择虚拟完成时间最小的请求，这样各类别按照权重比例分享引擎，
+//同时空闲类别不会积累额度
+type scheduler struct {
+	mu      sync.Mutex
+	classes map[string]*class
+	order   []string //固定的遍历顺序，保证输出稳定
+	vtime   float64
+	notify  chan struct{}
+}
+
+func newScheduler(conf map[string]ClassConfig) *scheduler {
+	s := &scheduler{
+		classes: make(map[string]*class),
+		notify:  make(chan struct{}, 1),
+	}
+	s.configure(conf)
+	return s
+}
+
+//configure 更新调度参数，已经在队列中的请求不受影响
+func (s *scheduler) configure(conf map[string]ClassConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range []string{PriorityRealtime, PriorityNormal, PriorityBulk} {
+		c, ok := conf[name]
+		if !ok {
+			c = DefaultClasses[name]
+		}
+		if cl, ok := s.classes[name]; ok {
+			cl.conf = c
+			continue
+		}
+		s.classes[name] = &class{name: name, conf: c}
+		s.order = append(s.order, name)
+	}
+}
+
+//className 未知或者没有指定的优先级都按照普通请求处理
+func (s *scheduler) className(priority string) string {
+	if _, ok := s.classes[priority]; ok {
+		return priority
+	}
+	return PriorityNormal
+}
+
+//push 请求入队，队列满了返回错误
+func (s *scheduler) push(r *Request) error {
+	s.mu.Lock()
+	c := s.classes[s.className(r.Priority)]
+	if len(c.queue) >= c.conf.Limit {
+		c.rejected++
+		s.mu.Unlock()
+		return errQueueFull
+	}
+	start := s.vtime
+	if c.finish > start {
+		start = c.finish
+	}
+	c.finish = start + 1/float64(c.conf.Weight)
+	c.queue = append(c.queue, item{req: r, finish: c.finish, at: time.Now()})
+	c.enqueued++
+	if len(c.queue) > c.maxDepth {
+		c.maxDepth = len(c.queue)
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+//pop 取出虚拟完成时间最小的请求，没有请求返回nil
+func (s *scheduler) pop() *Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next *class
+	for _, name := range s.order {
+		c := s.classes[name]
+		if len(c.queue) == 0 {
+			continue
+		}
+		if next == nil || c.queue[0].finish < next.queue[0].finish {
+			next = c
+		}
+	}
+	if next == nil {
+		return nil
+	}
+	it := next.queue[0]
+	next.queue[0] = item{}
+	next.queue = next.queue[1:]
+	s.vtime = it.finish
+	next.dequeued++
+	next.wait += time.Since(it.at)
+	return it.req
+}
+
+//State 各类别队列的统计数据
+func (s *scheduler) State() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := strings.Builder{}
+	for _, name := range s.order {
+		c := s.classes[name]
+		var avg time.Duration
+		if c.dequeued > 0 {
+			avg = c.wait / time.Duration(c.dequeued)
+		}
+		fmt.Fprintf(&b, "class[%s] weight:%d limit:%d depth:%d max_depth:%d enqueued:%d dequeued:%d rejected:%d avg_wait:%v\n",
+			c.name, c.conf.Weight, c.conf.Limit, len(c.queue), c.maxDepth, c.enqueued, c.dequeued, c.rejected, avg)
+	}
+	return b.String()
+}
+
+//remove 移除connId连接上标识为id的排队请求，id为空时移除该连接的所有请求
+//返回移除的请求数量
+func (s *scheduler) remove(connId uint32, id string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, name := range s.order {
+		c := s.classes[name]
+		queue := c.queue[:0]
+		for _, it := range c.queue {
+			if it.req.ConnId == connId && (len(id) == 0 || it.req.ID == id) {
+				n++
+				continue
+			}
+			queue = append(queue, it)
+		}
+		for i := len(queue); i < len(c.queue); i++ {
+			c.queue[i] = item{}
+		}
+		c.queue = queue
+	}
+	return n
+}
+
+//removeSeq 按照请求标识移除一个排队的请求
+func (s *scheduler) removeSeq(seq int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range s.order {
+		c := s.classes[name]
+		for i, it := range c.queue {
+			if it.req.ReqId == seq {
+				copy(c.queue[i:], c.queue[i+1:])
+				c.queue[len(c.queue)-1] = item{}
+				c.queue = c.queue[:len(c.queue)-1]
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package gallery
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//ErrMergeSelf 合并的人员中包含目标人员
+var ErrMergeSelf = errors.New("cannot merge a person into itself")
+
+//Neighbors 和人员最相似的k个其他人员，用人员在索引中的每个向量检索，得分取最大值
+//只检索索引，不需要和图库中的所有人员比较，HNSW 索引的结果是近似的
+func (g *Gallery) Neighbors(id string, k int, threshold float64) ([]Match, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	p, ok := g.persons[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	best := make(map[string]float64)
+	for _, v := range g.indexVectors(p) {
+		//人员自己占一个位置
+		for _, m := range g.index.search(v, k+1, threshold) {
+			if m.ID == id {
+				continue
+			}
+			if s, ok := best[m.ID]; !ok || m.Score > s {
+				best[m.ID] = m.Score
+			}
+		}
+	}
+	matches := make([]Match, 0, len(best))
+	for id, s := range best {
+		matches = append(matches, Match{ID: id, Score: s})
+	}
+	return sortMatches(matches, k), nil
+}
+
+//Merge 把 ids 中人员的模板移到 target 下并删除这些人员，用于合并同一个人的重复登记
+//target 的 meta 和融合策略不变，缺少的 meta 字段从被合并的人员中补充；和已有模板相同的模板被跳过
+//先写入 target 再删除其他人员，中途失败时模板可能同时存在于两个人员中，但是不会丢失，返回移动的模板数目
+func (g *Gallery) Merge(target string, ids []string) (*Person, int, error) {
+	if len(ids) == 0 {
+		return nil, 0, ErrInvalidID
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	old, ok := g.persons[target]
+	if !ok {
+		return nil, 0, ErrNotFound
+	}
+	sources := make([]*Person, 0, len(ids))
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if id == target {
+			return nil, 0, ErrMergeSelf
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		s, ok := g.persons[id]
+		if !ok {
+			return nil, 0, ErrNotFound
+		}
+		sources = append(sources, s)
+	}
+
+	p := old.clone()
+	vectors := personVectors(p)
+	moved := 0
+	var skipped []string
+	for _, s := range sources {
+		for k, v := range s.Meta {
+			if _, ok := p.Meta[k]; !ok {
+				p.Meta[k] = v
+			}
+		}
+		for _, t := range s.Templates {
+			v := normalize(t.Metric)
+			if containsVector(vectors, v) {
+				if len(t.Image) > 0 {
+					skipped = append(skipped, t.Image)
+				}
+				continue
+			}
+			t.Metric = append([]float32(nil), t.Metric...)
+			p.Templates = append(p.Templates, t)
+			vectors = append(vectors, v)
+			moved++
+		}
+	}
+	if err := g.conf.Schema.validate(p.Meta); err != nil {
+		return nil, 0, err
+	}
+	p.Updated = time.Now()
+	if err := g.append(walRecord{Op: walPut, ID: p.ID, Person: p}); err != nil {
+		return nil, 0, err
+	}
+	g.persons[p.ID] = p
+	g.index.add(p.ID, g.indexVectors(p))
+	for _, s := range sources {
+		if err := g.append(walRecord{Op: walDelete, ID: s.ID}); err != nil {
+			return nil, moved, err
+		}
+		delete(g.persons, s.ID)
+		g.index.remove(s.ID)
+	}
+	g.removeImages(skipped)
+	return p.clone(), moved, nil
+}
@@ -0,0 +1,141 @@
+package gallery
+
+import (
+	"faceserver/pkg/keyring"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//readSealed 读取文件并用 keys 解密，文件名作为额外认证的数据，加密的文件不能换名使用
+//配置了密钥时明文文件只在迁移模式下接受，读取文件失败时返回原始的错误，调用方可以用 os.IsNotExist 判断
+func readSealed(keys *keyring.Keyring, name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	plain, _, err := keys.Open(data, []byte(filepath.Base(name)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "decrypt %s failed", filepath.Base(name))
+	}
+	return plain, nil
+}
+
+//writeSealed 用 keys 的当前密钥加密以后原子写入，keys 为 nil 时写入明文
+func writeSealed(keys *keyring.Keyring, name string, data []byte) error {
+	sealed, err := keys.Seal(data, []byte(filepath.Base(name)))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(name, sealed)
+}
+
+//writeFileAtomic 先写临时文件并落盘，再改名覆盖目标文件
+//进程在任何时刻崩溃，目标文件要么是旧的内容，要么是新的内容
+func writeFileAtomic(name string, data []byte) error {
+	dir := filepath.Dir(name)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "create temp file failed")
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "write %s failed", tmp)
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "sync %s failed", tmp)
+	}
+	if err = f.Close(); err != nil {
+		return errors.Wrapf(err, "close %s failed", tmp)
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		return errors.Wrapf(err, "rename %s failed", tmp)
+	}
+	return syncDir(dir)
+}
+
+//syncDir 让目录项的修改（创建、改名、删除）落盘，windows 不支持，忽略错误
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer d.Close()
+	_ = d.Sync()
+	return nil
+}
+
+//Reseal 用当前密钥重新加密图库目录中不是当前密钥加密的文件（包括明文和照片副本），返回重新加密的文件数目
+//先做快照，用旧密钥加密的日志随之删除；每个文件单独持有写锁，轮换期间图库可以正常使用；
+//done 在每个文件处理以后调用，可以为 nil
+func (g *Gallery) Reseal(done func()) (int, error) {
+	if err := g.Snapshot(); err != nil {
+		return 0, err
+	}
+	g.wal.snap.Lock()
+	defer g.wal.snap.Unlock()
+	files, err := ioutil.ReadDir(g.dir)
+	if err != nil {
+		return 0, errors.Wrapf(err, "read gallery dir %s failed", g.dir)
+	}
+	var names []string
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") ||
+			!(strings.HasSuffix(fi.Name(), ".json") || fi.Name() == indexName) {
+			continue
+		}
+		names = append(names, filepath.Join(g.dir, fi.Name()))
+	}
+	copies, err := ioutil.ReadDir(filepath.Join(g.dir, imagesDir))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, errors.Wrapf(err, "read images dir of %s failed", g.dir)
+	}
+	for _, fi := range copies {
+		if !fi.IsDir() && !strings.HasPrefix(fi.Name(), ".") {
+			names = append(names, filepath.Join(g.dir, imagesDir, fi.Name()))
+		}
+	}
+	n := 0
+	for _, name := range names {
+		ok, err := g.reseal(name)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+		if done != nil {
+			done()
+		}
+	}
+	return n, nil
+}
+
+func (g *Gallery) reseal(name string) (bool, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		//已经被删除
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "read %s failed", name)
+	}
+	active := g.opts.Keys.Active()
+	if keyring.KeyID(data) == active {
+		return false, nil
+	}
+	plain, _, err := g.opts.Keys.Open(data, []byte(filepath.Base(name)))
+	if err != nil {
+		return false, errors.Wrapf(err, "decrypt %s failed", name)
+	}
+	return true, writeSealed(g.opts.Keys, name, plain)
+}
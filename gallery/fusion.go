@@ -0,0 +1,151 @@
+package gallery
+
+import (
+	"math"
+	"sort"
+)
+
+//人员多个模板的融合策略，决定索引中人员的向量
+const (
+	FusionMax     = "max"          //保留所有模板，人员得分取模板得分的最大值，缺省策略
+	FusionMean    = "mean"         //所有模板归一化以后的平均值
+	FusionQuality = "quality_mean" //按照模板的质量分数加权的平均值，质量分数都为0时等同于 mean
+)
+
+//ErrFusion 未知的融合策略
+var ErrFusion = &SchemaError{Field: "fusion", Reason: "unknown fusion strategy"}
+
+func checkFusion(fusion string) error {
+	switch fusion {
+	case "", FusionMax, FusionMean, FusionQuality:
+		return nil
+	}
+	return ErrFusion
+}
+
+//fusion 人员使用的融合策略，人员没有指定时使用图库的配置
+func (g *Gallery) fusion(p *Person) string {
+	if len(p.Fusion) > 0 {
+		return p.Fusion
+	}
+	if len(g.conf.Fusion) > 0 {
+		return g.conf.Fusion
+	}
+	return FusionMax
+}
+
+//indexVectors 人员在索引中的向量，融合时只有长度相同的模板才合并，每种长度得到一个向量
+//和图库模型版本不一致的模板不进入索引
+func (g *Gallery) indexVectors(p *Person) [][]float32 {
+	p = g.current(p)
+	strategy := g.fusion(p)
+	if strategy == FusionMax || len(p.Templates) < 2 {
+		return personVectors(p)
+	}
+	groups := make(map[int][]int)
+	for i, t := range p.Templates {
+		groups[len(t.Metric)] = append(groups[len(t.Metric)], i)
+	}
+	lengths := make([]int, 0, len(groups))
+	for n := range groups {
+		lengths = append(lengths, n)
+	}
+	sort.Ints(lengths)
+	vectors := make([][]float32, 0, len(groups))
+	for _, n := range lengths {
+		sum := make([]float64, n)
+		var total float64
+		for _, i := range groups[n] {
+			w := 1.0
+			if strategy == FusionQuality {
+				w = math.Max(p.Templates[i].Quality, 0)
+			}
+			total += w
+			for k, v := range normalize(p.Templates[i].Metric) {
+				sum[k] += w * float64(v)
+			}
+		}
+		if total == 0 {
+			//质量分数都为0，退化为平均值
+			for _, i := range groups[n] {
+				for k, v := range normalize(p.Templates[i].Metric) {
+					sum[k] += float64(v)
+				}
+			}
+		}
+		fused := make([]float32, n)
+		for k, v := range sum {
+			fused[k] = float32(v)
+		}
+		vectors = append(vectors, normalize(fused))
+	}
+	return vectors
+}
+
+//TemplateScore 一致性报告中的一个模板
+type TemplateScore struct {
+	Index   int     `json:"index"`   //模板序号
+	Source  string  `json:"source,omitempty"`
+	Score   float64 `json:"score"`   //和其他模板平均值的相似度
+	Outlier bool    `json:"outlier"` //相似度低于阈值，可能不是同一个人或者照片质量太差
+}
+
+//Consistency 人员模板之间的一致性
+type Consistency struct {
+	PersonID  string          `json:"person_id"`
+	Mean      float64         `json:"mean"` //模板两两相似度的平均值
+	Templates []TemplateScore `json:"templates"`
+	Outliers  int             `json:"outliers"`
+}
+
+//Consistency 计算人员模板之间的一致性：每个模板和其余模板归一化平均值的相似度低于 threshold 时标记为异常
+//只有一个模板或者模板长度、模型版本不同时无法比较，Templates 为空
+func (g *Gallery) Consistency(id string, threshold float64) (*Consistency, error) {
+	p, err := g.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return consistency(p, threshold), nil
+}
+
+func consistency(p *Person, threshold float64) *Consistency {
+	c := &Consistency{PersonID: p.ID, Templates: []TemplateScore{}}
+	vectors := personVectors(p)
+	if len(vectors) < 2 {
+		return c
+	}
+	n := len(vectors[0])
+	for i, v := range vectors {
+		if len(v) != n || p.Templates[i].ModelVersion != p.Templates[0].ModelVersion {
+			return c
+		}
+	}
+	total := make([]float64, n)
+	for _, v := range vectors {
+		for k, x := range v {
+			total[k] += float64(x)
+		}
+	}
+	var pairs float64
+	for i := range vectors {
+		for j := i + 1; j < len(vectors); j++ {
+			c.Mean += float64(dot(vectors[i], vectors[j]))
+			pairs++
+		}
+	}
+	c.Mean /= pairs
+	for i, v := range vectors {
+		//去掉自己以后其余模板的平均值
+		rest := make([]float32, n)
+		for k := range rest {
+			rest[k] = float32(total[k] - float64(v[k]))
+		}
+		s := TemplateScore{Index: i, Source: p.Templates[i].Source, Score: float64(dot(v, normalize(rest)))}
+		s.Outlier = s.Score < threshold
+		if s.Outlier {
+			c.Outliers++
+		}
+		c.Templates = append(c.Templates, s)
+	}
+	return c
+}
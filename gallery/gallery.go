@@ -0,0 +1,436 @@
+//Package gallery 人脸图库，保存人员和他们的特征模板
+//每个人员保存为图库目录下的一个json文件，修改先写入预写日志，由快照写入人员文件
+//多个相互隔离的图库由 Store 管理，每个图库一个目录
+package gallery
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNotFound  = errors.New("person not found")
+	ErrInvalidID = errors.New("invalid person id")
+	ErrNoMetric  = errors.New("no template")
+)
+
+//maxIDLen 人员标识的最大长度，标识会编码到文件名中
+const maxIDLen = 100
+
+//Template 人员的一份特征模板
+type Template struct {
+	Metric       []float32 `json:"metric"`
+	Quality      float64   `json:"quality"`
+	Source       string    `json:"source,omitempty"`        //提取模板的照片路径，输入是特征或者 base64 时为空
+	Image        string    `json:"image,omitempty"`         //登记照片在图库中的加密副本，重新提取特征时使用
+	ModelVersion string    `json:"model_version,omitempty"` //提取特征的模型版本，为空表示不知道版本
+	Created      time.Time `json:"created"`
+	Photo        []byte    `json:"-"` //登记照片的内容，Enroll 和 Import 把它保存为 Image，不保存在人员中
+}
+
+//Person 图库中的一个人员
+type Person struct {
+	ID        string            `json:"id"`
+	Meta      map[string]string `json:"meta"`
+	Templates []Template        `json:"templates"`
+	Fusion    string            `json:"fusion,omitempty"` //模板的融合策略，为空时使用图库的配置
+	Created   time.Time         `json:"created"`
+	Updated   time.Time         `json:"updated"`
+}
+
+//clone 深拷贝，图库内部的数据不会交给调用方修改
+func (p *Person) clone() *Person {
+	c := *p
+	c.Meta = make(map[string]string, len(p.Meta))
+	for k, v := range p.Meta {
+		c.Meta[k] = v
+	}
+	c.Templates = make([]Template, len(p.Templates))
+	for i, t := range p.Templates {
+		c.Templates[i] = t
+		c.Templates[i].Metric = append([]float32(nil), t.Metric...)
+	}
+	return &c
+}
+
+//Gallery 人脸图库
+type Gallery struct {
+	dir     string
+	mu      sync.RWMutex
+	persons map[string]*Person
+	opts    Options
+	conf    Config
+	index   index //归一化以后的模板，检索时使用
+	wal     *wal  //人员修改的预写日志
+}
+
+//索引文件名，只有 HNSW 索引需要保存
+const indexName = "index.hnsw"
+
+//Open 打开数据目录中的图库，目录不存在时创建
+func Open(dir string, opts Options) (*Gallery, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "create gallery dir %s failed", dir)
+	}
+	g := &Gallery{
+		dir:     dir,
+		persons: make(map[string]*Person),
+		opts:    opts,
+		conf:    Config{Name: filepath.Base(dir)},
+	}
+	if data, err := readSealed(opts.Keys, filepath.Join(dir, configName)); err == nil {
+		if err = json.Unmarshal(data, &g.conf); err != nil {
+			return nil, errors.Wrapf(err, "parse %s failed", configName)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "read %s failed", filepath.Join(dir, configName))
+	}
+	if len(g.conf.Index) > 0 {
+		g.opts.Index = g.conf.Index
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read gallery dir %s failed", dir)
+	}
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".json") || strings.HasPrefix(fi.Name(), ".") || fi.Name() == configName {
+			continue
+		}
+		data, err := readSealed(opts.Keys, filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "read %s failed", filepath.Join(dir, fi.Name()))
+		}
+		p := &Person{}
+		if err = json.Unmarshal(data, p); err != nil {
+			return nil, errors.Wrapf(err, "parse %s failed", fi.Name())
+		}
+		g.persons[p.ID] = p
+	}
+	if _, err = g.recover(); err != nil {
+		return nil, err
+	}
+	g.openIndex()
+	g.startLoop()
+	return g, nil
+}
+
+//打开索引，HNSW 索引优先读取保存的文件，文件和图库不一致时重建
+func (g *Gallery) openIndex() {
+	if g.opts.Index != IndexHNSW {
+		g.rebuildIndex()
+		return
+	}
+	counts := make(map[string]int, len(g.persons))
+	for id, p := range g.persons {
+		counts[id] = len(g.indexVectors(p))
+	}
+	h, err := loadHNSW(filepath.Join(g.dir, indexName), g.opts.HNSW, g.opts.Keys, counts)
+	if err == nil {
+		g.index = h
+		return
+	}
+	if !os.IsNotExist(err) {
+		glog.Warningf("gallery %s: rebuild hnsw index: %v", g.dir, err)
+	}
+	g.rebuildIndex()
+}
+
+//rebuildIndex 用所有人员重新构建索引
+func (g *Gallery) rebuildIndex() {
+	var idx index
+	if g.opts.Index == IndexHNSW {
+		idx = newHNSWIndex(g.opts.HNSW)
+	} else {
+		idx = newFlatIndex()
+	}
+	for id, p := range g.persons {
+		idx.add(id, g.indexVectors(p))
+	}
+	g.index = idx
+}
+
+//Config 图库的配置
+func (g *Gallery) Config() Config {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	c := g.conf
+	c.Schema = append(Schema(nil), g.conf.Schema...)
+	return c
+}
+
+//Calibrate 保存校准结果，并把图库的阈值设置为 threshold
+func (g *Gallery) Calibrate(threshold float64, c *Calibration) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	conf := g.conf
+	conf.Threshold = threshold
+	conf.Calibration = c
+	return g.saveConfig(conf)
+}
+
+//Close 把日志写入快照并保存索引，之后不能再使用图库
+func (g *Gallery) Close() error {
+	g.stopLoop()
+	err := g.Snapshot()
+	if cerr := g.closeLog(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		//日志在下次打开时重放，索引重建
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if h, ok := g.index.(*hnswIndex); ok {
+		return h.save(filepath.Join(g.dir, indexName), g.opts.Keys)
+	}
+	return nil
+}
+
+//人员文件名，标识做hex编码，避免非法字符
+func (g *Gallery) path(id string) string {
+	return filepath.Join(g.dir, hex.EncodeToString([]byte(id))+".json")
+}
+
+func (g *Gallery) save(p *Person) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return errors.Wrap(err, "marshal person failed")
+	}
+	return writeSealed(g.opts.Keys, g.path(p.ID), data)
+}
+
+func checkID(id string) error {
+	if len(id) == 0 || len(id) > maxIDLen {
+		return ErrInvalidID
+	}
+	return nil
+}
+
+//Enroll 登记人员，人员已经存在时追加模板并更新meta中给出的字段
+//fusion 不为空时修改人员的融合策略
+func (g *Gallery) Enroll(id string, meta map[string]string, templates []Template, fusion string) (*Person, error) {
+	if err := checkFusion(fusion); err != nil {
+		return nil, err
+	}
+	templates, images, err := g.saveImages(templates)
+	if err != nil {
+		return nil, err
+	}
+	p, _, err := g.enroll(id, meta, templates, fusion, false)
+	g.releaseImages(images, p)
+	return p, err
+}
+
+//Import 和 Enroll 相同，但是跳过和人员已有模板相同的模板，重复导入同一个文件不会产生重复的模板
+//返回实际追加的模板数目
+func (g *Gallery) Import(id string, meta map[string]string, templates []Template) (int, error) {
+	templates, images, err := g.saveImages(templates)
+	if err != nil {
+		return 0, err
+	}
+	p, n, err := g.enroll(id, meta, templates, "", true)
+	g.releaseImages(images, p)
+	return n, err
+}
+
+//duplicateScore 相似度不低于这个值的两个模板认为是同一个模板
+const duplicateScore = 0.9999
+
+func (g *Gallery) enroll(id string, meta map[string]string, templates []Template, fusion string, unique bool) (*Person, int, error) {
+	if err := checkID(id); err != nil {
+		return nil, 0, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	old, exists := g.persons[id]
+	var p *Person
+	if exists {
+		p = old.clone()
+	} else {
+		p = &Person{ID: id, Meta: make(map[string]string), Created: now}
+	}
+	if !exists && len(templates) == 0 {
+		return nil, 0, ErrNoMetric
+	}
+	for k, v := range meta {
+		p.Meta[k] = v
+	}
+	if err := g.conf.Schema.validate(p.Meta); err != nil {
+		return nil, 0, err
+	}
+	if len(fusion) > 0 {
+		p.Fusion = fusion
+	}
+	//图库还没有模型版本时使用第一个带版本的模板的版本
+	version := g.conf.ModelVersion
+	for _, t := range templates {
+		if !compatible(t.ModelVersion, version) {
+			return nil, 0, ErrModelVersion
+		}
+		if len(version) == 0 {
+			version = t.ModelVersion
+		}
+	}
+	//vectors 只用来去重，索引中的向量由融合策略决定
+	vectors := personVectors(p)
+	added := 0
+	for _, t := range templates {
+		v := normalize(t.Metric)
+		if unique && containsVector(vectors, v) {
+			continue
+		}
+		if t.Created.IsZero() {
+			t.Created = now
+		}
+		p.Templates = append(p.Templates, t)
+		vectors = append(vectors, v)
+		added++
+	}
+	if exists && unique && added == 0 && sameMeta(old.Meta, p.Meta) && old.Fusion == p.Fusion {
+		return old.clone(), 0, nil
+	}
+	p.Updated = now
+	if version != g.conf.ModelVersion {
+		conf := g.conf
+		conf.ModelVersion = version
+		if err := g.saveConfig(conf); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := g.append(walRecord{Op: walPut, ID: id, Person: p}); err != nil {
+		return nil, 0, err
+	}
+	g.persons[id] = p
+	g.index.add(id, g.indexVectors(p))
+	return p.clone(), added, nil
+}
+
+func containsVector(vectors [][]float32, v []float32) bool {
+	for _, u := range vectors {
+		if len(u) == len(v) && dot(u, v) >= duplicateScore {
+			return true
+		}
+	}
+	return false
+}
+
+func sameMeta(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+//Export 按照标识的顺序遍历所有人员，fn 返回错误时停止遍历
+//遍历时不持有锁，遍历期间的修改可能看不到
+func (g *Gallery) Export(fn func(p *Person) error) error {
+	g.mu.RLock()
+	ids := make([]string, 0, len(g.persons))
+	for id := range g.persons {
+		ids = append(ids, id)
+	}
+	g.mu.RUnlock()
+	sort.Strings(ids)
+	for _, id := range ids {
+		p, err := g.Get(id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Delete 删除人员以及他的所有模板和照片副本
+func (g *Gallery) Delete(id string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	p, ok := g.persons[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := g.append(walRecord{Op: walDelete, ID: id}); err != nil {
+		return err
+	}
+	delete(g.persons, id)
+	g.index.remove(id)
+	g.removeImages(images(p.Templates))
+	return nil
+}
+
+//Get 查询一个人员
+func (g *Gallery) Get(id string) (*Person, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	p, ok := g.persons[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return p.clone(), nil
+}
+
+//List 按照标识排序分页列出人员，返回人员总数
+func (g *Gallery) List(offset, limit int) ([]*Person, int) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	ids := make([]string, 0, len(g.persons))
+	for id := range g.persons {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	total := len(ids)
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	persons := make([]*Person, 0, end-offset)
+	for _, id := range ids[offset:end] {
+		persons = append(persons, g.persons[id].clone())
+	}
+	return persons, total
+}
+
+//IDs 按照标识排序的所有人员
+func (g *Gallery) IDs() []string {
+	g.mu.RLock()
+	ids := make([]string, 0, len(g.persons))
+	for id := range g.persons {
+		ids = append(ids, id)
+	}
+	g.mu.RUnlock()
+	sort.Strings(ids)
+	return ids
+}
+
+//Count 人员数目
+func (g *Gallery) Count() int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return len(g.persons)
+}
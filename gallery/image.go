@@ -0,0 +1,115 @@
+package gallery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+//imagesDir 图库目录中保存登记照片副本的子目录
+const imagesDir = "images"
+
+//ErrInvalidImage 照片副本的名称不合法
+var ErrInvalidImage = errors.New("invalid image name")
+
+//imagePath 照片副本的路径，名称只能是 saveImages 生成的文件名
+func (g *Gallery) imagePath(name string) (string, error) {
+	if len(name) == 0 || filepath.Base(name) != name || name[0] == '.' {
+		return "", ErrInvalidImage
+	}
+	return filepath.Join(g.dir, imagesDir, name), nil
+}
+
+//saveImages 把模板的 Photo 加密保存为图库中的副本，返回设置了 Image 的模板和保存的副本名称
+//失败时已经保存的副本被删除
+func (g *Gallery) saveImages(templates []Template) ([]Template, []string, error) {
+	var names []string
+	out := make([]Template, len(templates))
+	for i, t := range templates {
+		out[i] = t
+		out[i].Photo = nil
+		if len(t.Photo) == 0 {
+			continue
+		}
+		if len(names) == 0 {
+			if err := os.MkdirAll(filepath.Join(g.dir, imagesDir), 0700); err != nil {
+				return nil, nil, errors.Wrap(err, "create images dir failed")
+			}
+		}
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			g.removeImages(names)
+			return nil, nil, errors.Wrap(err, "generate image name failed")
+		}
+		name := hex.EncodeToString(id) + ".img"
+		if err := writeSealed(g.opts.Keys, filepath.Join(g.dir, imagesDir, name), t.Photo); err != nil {
+			g.removeImages(names)
+			return nil, nil, err
+		}
+		out[i].Image = name
+		names = append(names, name)
+	}
+	return out, names, nil
+}
+
+//releaseImages 删除没有保存到人员 p 中的副本：登记失败（p 为 nil），或者导入时和已有模板相同而被跳过
+func (g *Gallery) releaseImages(names []string, p *Person) {
+	used := make(map[string]bool)
+	if p != nil {
+		for _, t := range p.Templates {
+			used[t.Image] = true
+		}
+	}
+	var unused []string
+	for _, name := range names {
+		if !used[name] {
+			unused = append(unused, name)
+		}
+	}
+	g.removeImages(unused)
+}
+
+//images 模板的照片副本
+func images(templates []Template) []string {
+	var names []string
+	for _, t := range templates {
+		if len(t.Image) > 0 {
+			names = append(names, t.Image)
+		}
+	}
+	return names
+}
+
+//removeImages 删除不再使用的副本，失败时只记录日志
+func (g *Gallery) removeImages(names []string) {
+	for _, name := range names {
+		if err := g.RemoveImage(name); err != nil && !os.IsNotExist(errors.Cause(err)) {
+			glog.Warningf("gallery %s: %v", g.dir, err)
+		}
+	}
+}
+
+//LoadImage 读取并解密模板的照片副本，用于重新提取特征
+func (g *Gallery) LoadImage(name string) ([]byte, error) {
+	path, err := g.imagePath(name)
+	if err != nil {
+		return nil, err
+	}
+	return readSealed(g.opts.Keys, path)
+}
+
+//RemoveImage 删除模板的照片副本，副本不存在时返回的错误可以用 os.IsNotExist 判断
+func (g *Gallery) RemoveImage(name string) error {
+	path, err := g.imagePath(name)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
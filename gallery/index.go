@@ -0,0 +1,181 @@
+package gallery
+
+import (
+	"bytes"
+	"faceserver/pkg/hnsw"
+	"faceserver/pkg/keyring"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//索引类型
+const (
+	IndexFlat = "flat" //暴力检索，结果精确，适合几万人以内的图库
+	IndexHNSW = "hnsw" //近似最近邻索引，适合百万级的图库
+)
+
+//Options 图库的检索参数
+type Options struct {
+	Index string           //索引类型，IndexFlat 或者 IndexHNSW
+	HNSW  hnsw.Config      //HNSW 索引的参数
+	Keys  *keyring.Keyring //落盘加密的密钥，nil 表示不加密
+	WAL   WALConfig        //预写日志和快照的参数
+}
+
+//index 人员特征的检索结构，每个人员可以有多个模板，人员的得分取模板得分的最大值
+//调用方负责加锁
+type index interface {
+	add(id string, vectors [][]float32)
+	remove(id string)
+	search(q []float32, k int, threshold float64) []Match
+}
+
+//sortMatches 按照得分从大到小排序，得分相同时按照标识排序，保留前k个
+func sortMatches(matches []Match, k int) []Match {
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].ID < matches[j].ID
+	})
+	if k > 0 && len(matches) > k {
+		matches = matches[:k]
+	}
+	return matches
+}
+
+//flatIndex 暴力检索
+type flatIndex struct {
+	vectors map[string][][]float32
+}
+
+func newFlatIndex() *flatIndex {
+	return &flatIndex{vectors: make(map[string][][]float32)}
+}
+
+func (f *flatIndex) add(id string, vectors [][]float32) {
+	f.vectors[id] = vectors
+}
+
+func (f *flatIndex) remove(id string) {
+	delete(f.vectors, id)
+}
+
+func (f *flatIndex) search(q []float32, k int, threshold float64) []Match {
+	var matches []Match
+	for id, vs := range f.vectors {
+		best := float32(-2)
+		for _, v := range vs {
+			if len(v) != len(q) {
+				continue
+			}
+			if s := dot(q, v); s > best {
+				best = s
+			}
+		}
+		if best >= -1 && float64(best) >= threshold {
+			matches = append(matches, Match{ID: id, Score: float64(best)})
+		}
+	}
+	return sortMatches(matches, k)
+}
+
+//hnswIndex 每个模板是索引中的一个节点，节点的键为 人员标识\x00模板序号
+type hnswIndex struct {
+	index  *hnsw.Index
+	counts map[string]int //每个人员的模板数目
+}
+
+func newHNSWIndex(conf hnsw.Config) *hnswIndex {
+	return &hnswIndex{index: hnsw.New(conf), counts: make(map[string]int)}
+}
+
+func nodeKey(id string, n int) string {
+	return id + "\x00" + strconv.Itoa(n)
+}
+
+func nodeID(key string) string {
+	if i := strings.LastIndexByte(key, 0); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+func (h *hnswIndex) add(id string, vectors [][]float32) {
+	h.remove(id)
+	for i, v := range vectors {
+		h.index.Insert(nodeKey(id, i), v)
+	}
+	h.counts[id] = len(vectors)
+}
+
+func (h *hnswIndex) remove(id string) {
+	for i := 0; i < h.counts[id]; i++ {
+		h.index.Delete(nodeKey(id, i))
+	}
+	delete(h.counts, id)
+}
+
+func (h *hnswIndex) search(q []float32, k int, threshold float64) []Match {
+	//一个人员可能占用多个节点，多取一些节点再按人员合并
+	results := h.index.Search(q, k*4+8)
+	best := make(map[string]float64)
+	for _, r := range results {
+		if float64(r.Score) < threshold {
+			continue
+		}
+		id := nodeID(r.Key)
+		if s, ok := best[id]; !ok || float64(r.Score) > s {
+			best[id] = float64(r.Score)
+		}
+	}
+	matches := make([]Match, 0, len(best))
+	for id, s := range best {
+		matches = append(matches, Match{ID: id, Score: s})
+	}
+	return sortMatches(matches, k)
+}
+
+//loadHNSW 读取保存的索引，counts 是每个人员在索引中的向量数目，
+//索引中的节点必须和这些向量一一对应，否则返回错误由调用方重建
+func loadHNSW(name string, conf hnsw.Config, keys *keyring.Keyring, counts map[string]int) (*hnswIndex, error) {
+	data, err := readSealed(keys, name)
+	if err != nil {
+		return nil, err
+	}
+	index, err := hnsw.Load(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	expected := 0
+	for _, n := range counts {
+		expected += n
+	}
+	if index.Len() != expected {
+		return nil, errors.Errorf("index has %d nodes, gallery has %d vectors", index.Len(), expected)
+	}
+	for _, key := range index.Keys() {
+		i := strings.LastIndexByte(key, 0)
+		n, err := strconv.Atoi(key[i+1:])
+		if i < 0 || err != nil || n >= counts[key[:i]] {
+			return nil, errors.Errorf("index node %q not in gallery", key)
+		}
+	}
+	index.SetEfSearch(conf.EfSearch)
+	return &hnswIndex{index: index, counts: counts}, nil
+}
+
+//saveHNSW 保存索引，删除的节点较多时先压缩
+func (h *hnswIndex) save(name string, keys *keyring.Keyring) error {
+	if h.index.Deleted() > h.index.Len()/4 {
+		h.index = h.index.Compact()
+	}
+	buf := bytes.Buffer{}
+	if err := h.index.Save(&buf); err != nil {
+		return err
+	}
+	return writeSealed(keys, name, buf.Bytes())
+}
@@ -0,0 +1,78 @@
+package gallery
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+//Purged 从一个图库中清除的人员数据，用于生成删除凭证
+type Purged struct {
+	Templates int      //删除的模板数目
+	Sources   []string //模板的照片路径，是客户端的文件，不属于服务器，不删除
+	Images    []string //模板在图库中的照片副本，由调用方用 RemoveImage 删除
+	File      string   //删除的人员文件，人员不在图库中时为空
+	Logs      []string //快照以后删除的日志文件，其中有人员的修改记录
+	Nodes     int      //从 HNSW 索引中清除的已删除节点数目，这些节点仍然保存着特征
+	Index     bool     //是否删除了保存的索引文件
+}
+
+//Purge 彻底清除人员：删除人员以后立刻做快照，日志中人员的修改记录随之删除；
+//HNSW 索引删除节点时只做标记，特征仍然在内存和保存的索引文件中，压缩索引并删除索引文件（关闭时重新保存）
+//人员已经被删除时也清除日志和索引中的残留，图库中没有任何残留时返回 ErrNotFound
+func (g *Gallery) Purge(id string) (*Purged, error) {
+	if err := checkID(id); err != nil {
+		return nil, err
+	}
+	r := &Purged{}
+	g.mu.Lock()
+	p, exists := g.persons[id]
+	_, logged := g.wal.dirty[id]
+	if _, ok := g.wal.pending[id]; ok {
+		logged = true
+	}
+	if exists {
+		if err := g.append(walRecord{Op: walDelete, ID: id}); err != nil {
+			g.mu.Unlock()
+			return nil, err
+		}
+		delete(g.persons, id)
+		g.index.remove(id)
+		r.Templates = len(p.Templates)
+		r.File = filepath.Base(g.path(id))
+		for _, t := range p.Templates {
+			if len(t.Source) > 0 {
+				r.Sources = append(r.Sources, t.Source)
+			}
+		}
+		r.Images = images(p.Templates)
+	}
+	if h, ok := g.index.(*hnswIndex); ok && h.index.Deleted() > 0 {
+		r.Nodes = h.index.Deleted()
+		h.index = h.index.Compact()
+	}
+	g.mu.Unlock()
+	if !exists && !logged && r.Nodes == 0 {
+		return nil, ErrNotFound
+	}
+
+	//保存的索引文件可能在人员删除以前保存，快照只在有修改时删除，这里无论如何都要删除
+	index := filepath.Join(g.dir, indexName)
+	if _, err := os.Stat(index); err == nil {
+		r.Index = true
+	}
+	if exists || logged {
+		logs, err := g.snapshot()
+		if err != nil {
+			return r, err
+		}
+		for _, name := range logs {
+			r.Logs = append(r.Logs, filepath.Base(name))
+		}
+	}
+	if err := os.Remove(index); err != nil && !os.IsNotExist(err) {
+		return r, errors.Wrapf(err, "remove %s failed", index)
+	}
+	return r, syncDir(g.dir)
+}
@@ -0,0 +1,220 @@
+package gallery
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//导入导出的文件格式
+const (
+	FormatJSONL = "jsonl" //每行一个人员的json
+	FormatCSV   = "csv"   //每行一个模板，列为 person_id,meta,image,metric,quality,model_version
+)
+
+//FormatOf 按照扩展名判断文件格式，.csv 为 CSV，其他都按照 JSONL 处理
+func FormatOf(name string) string {
+	if strings.HasSuffix(strings.ToLower(name), ".csv") {
+		return FormatCSV
+	}
+	return FormatJSONL
+}
+
+//Record 导入导出文件中的一行
+//模板可以是照片路径（相对路径相对于文件所在目录）或者 FaceFeature.Metric 格式的特征
+//同一个人员可以出现在多行中，模板依次追加
+type Record struct {
+	PersonID      string            `json:"person_id"`
+	Meta          map[string]string `json:"meta,omitempty"`
+	Images        []string          `json:"images,omitempty"`
+	Metrics       []string          `json:"metrics,omitempty"`
+	Qualities     []float64         `json:"qualities,omitempty"`      //和 Metrics 一一对应，可以省略
+	ModelVersions []string          `json:"model_versions,omitempty"` //特征的模型版本，和 Metrics 一一对应，可以省略
+}
+
+//RecordError 某一行的格式错误，调用方可以记录以后继续读取
+type RecordError struct {
+	Row int
+	Err error
+}
+
+func (e *RecordError) Error() string {
+	return "row " + strconv.Itoa(e.Row) + ": " + e.Err.Error()
+}
+
+//旧版本导出的文件没有 model_version 列，读取时缺少的列为空
+var csvHeader = []string{"person_id", "meta", "image", "metric", "quality", "model_version"}
+
+//RecordReader 逐行读取导入文件
+type RecordReader struct {
+	format string
+	lines  *bufio.Reader
+	csv    *csv.Reader
+	row    int
+}
+
+//NewRecordReader 创建读取器，CSV 文件的第一行如果是表头会被跳过
+func NewRecordReader(r io.Reader, format string) *RecordReader {
+	rr := &RecordReader{format: format}
+	if format == FormatCSV {
+		rr.csv = csv.NewReader(r)
+		rr.csv.FieldsPerRecord = -1
+		rr.csv.ReuseRecord = true
+	} else {
+		rr.lines = bufio.NewReaderSize(r, 1<<16)
+	}
+	return rr
+}
+
+//Row 最后一次 Next 返回的行号，从1开始，跳过的空行和表头也计数
+func (rr *RecordReader) Row() int {
+	return rr.row
+}
+
+//Next 读取下一行，文件结束时返回 io.EOF
+//某一行格式错误时返回 *RecordError，其他错误是读取文件失败
+func (rr *RecordReader) Next() (*Record, error) {
+	if rr.format == FormatCSV {
+		return rr.nextCSV()
+	}
+	return rr.nextJSONL()
+}
+
+func (rr *RecordReader) nextJSONL() (*Record, error) {
+	for {
+		line, err := rr.lines.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			return nil, err
+		}
+		rr.row++
+		line = []byte(strings.TrimSpace(string(line)))
+		if len(line) == 0 {
+			continue
+		}
+		rec := &Record{}
+		if err := json.Unmarshal(line, rec); err != nil {
+			return nil, &RecordError{Row: rr.row, Err: errors.Wrap(err, "invalid json")}
+		}
+		return rec, nil
+	}
+}
+
+func (rr *RecordReader) nextCSV() (*Record, error) {
+	for {
+		fields, err := rr.csv.Read()
+		if err == io.EOF {
+			return nil, err
+		}
+		rr.row++
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				return nil, &RecordError{Row: rr.row, Err: err}
+			}
+			return nil, err
+		}
+		if rr.row == 1 && len(fields) > 0 && fields[0] == csvHeader[0] {
+			continue
+		}
+		if len(fields) == 1 && len(strings.TrimSpace(fields[0])) == 0 {
+			continue
+		}
+		for len(fields) < len(csvHeader) {
+			fields = append(fields, "")
+		}
+		rec := &Record{PersonID: fields[0]}
+		if len(fields[1]) > 0 {
+			if err := json.Unmarshal([]byte(fields[1]), &rec.Meta); err != nil {
+				return nil, &RecordError{Row: rr.row, Err: errors.Wrap(err, "invalid meta")}
+			}
+		}
+		if len(fields[2]) > 0 {
+			rec.Images = []string{fields[2]}
+		}
+		if len(fields[3]) > 0 {
+			rec.Metrics = []string{fields[3]}
+			if len(fields[4]) > 0 {
+				q, err := strconv.ParseFloat(fields[4], 64)
+				if err != nil {
+					return nil, &RecordError{Row: rr.row, Err: errors.Wrap(err, "invalid quality")}
+				}
+				rec.Qualities = []float64{q}
+			}
+			if len(fields[5]) > 0 {
+				rec.ModelVersions = []string{fields[5]}
+			}
+		}
+		return rec, nil
+	}
+}
+
+//RecordWriter 写导出文件
+type RecordWriter struct {
+	format string
+	w      io.Writer
+	csv    *csv.Writer
+}
+
+//NewRecordWriter 创建写入器，CSV 格式会先写表头
+func NewRecordWriter(w io.Writer, format string) (*RecordWriter, error) {
+	rw := &RecordWriter{format: format, w: w}
+	if format == FormatCSV {
+		rw.csv = csv.NewWriter(w)
+		if err := rw.csv.Write(csvHeader); err != nil {
+			return nil, err
+		}
+	}
+	return rw, nil
+}
+
+//Write 写一个人员，CSV 格式每个模板一行，每行都带上 meta
+func (rw *RecordWriter) Write(rec *Record) error {
+	if rw.format != FormatCSV {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		_, err = rw.w.Write(append(data, '\n'))
+		return err
+	}
+	meta := ""
+	if len(rec.Meta) > 0 {
+		data, err := json.Marshal(rec.Meta)
+		if err != nil {
+			return err
+		}
+		meta = string(data)
+	}
+	for i, m := range rec.Metrics {
+		quality := ""
+		if i < len(rec.Qualities) {
+			quality = strconv.FormatFloat(rec.Qualities[i], 'g', -1, 64)
+		}
+		version := ""
+		if i < len(rec.ModelVersions) {
+			version = rec.ModelVersions[i]
+		}
+		if err := rw.csv.Write([]string{rec.PersonID, meta, "", m, quality, version}); err != nil {
+			return err
+		}
+	}
+	for _, img := range rec.Images {
+		if err := rw.csv.Write([]string{rec.PersonID, meta, img, "", "", ""}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Flush 把缓存的内容写入底层的 io.Writer
+func (rw *RecordWriter) Flush() error {
+	if rw.csv != nil {
+		rw.csv.Flush()
+		return rw.csv.Error()
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package gallery
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//meta 字段的类型，meta 的值总是字符串，类型只约束字符串的格式
+const (
+	FieldString = "string"
+	FieldInt    = "int"
+	FieldFloat  = "float"
+	FieldBool   = "bool"
+	FieldDate   = "date" //格式为 2006-01-02
+)
+
+//Field 图库 meta 的一个字段
+type Field struct {
+	Name     string `json:"name"`
+	Type     string `json:"type,omitempty"` //缺省为 string
+	Required bool   `json:"required,omitempty"`
+}
+
+//Schema 图库 meta 的格式，为空时不做检查
+//不为空时 meta 只能包含 Schema 中的字段，登记以后人员必须有所有必需的字段
+type Schema []Field
+
+//SchemaError 人员的 meta 不符合图库的格式
+type SchemaError struct {
+	Field  string
+	Reason string
+}
+
+func (e *SchemaError) Error() string {
+	return "meta field " + e.Field + ": " + e.Reason
+}
+
+//check 检查 Schema 本身是否合法
+func (s Schema) check() error {
+	names := make(map[string]bool, len(s))
+	for _, f := range s {
+		if len(f.Name) == 0 {
+			return errors.New("empty field name")
+		}
+		if names[f.Name] {
+			return errors.Errorf("duplicate field %s", f.Name)
+		}
+		names[f.Name] = true
+		switch f.Type {
+		case "", FieldString, FieldInt, FieldFloat, FieldBool, FieldDate:
+		default:
+			return errors.Errorf("unknown type %s of field %s", f.Type, f.Name)
+		}
+	}
+	return nil
+}
+
+//validate 检查合并以后的 meta
+func (s Schema) validate(meta map[string]string) error {
+	if len(s) == 0 {
+		return nil
+	}
+	fields := make(map[string]Field, len(s))
+	for _, f := range s {
+		fields[f.Name] = f
+		if _, ok := meta[f.Name]; f.Required && !ok {
+			return &SchemaError{Field: f.Name, Reason: "required"}
+		}
+	}
+	for k, v := range meta {
+		f, ok := fields[k]
+		if !ok {
+			return &SchemaError{Field: k, Reason: "not in schema"}
+		}
+		var err error
+		switch f.Type {
+		case FieldInt:
+			_, err = strconv.ParseInt(v, 10, 64)
+		case FieldFloat:
+			_, err = strconv.ParseFloat(v, 64)
+		case FieldBool:
+			_, err = strconv.ParseBool(v)
+		case FieldDate:
+			_, err = time.Parse("2006-01-02", v)
+		}
+		if err != nil {
+			return &SchemaError{Field: k, Reason: "not a valid " + f.Type}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package gallery
+
+import (
+	"math"
+)
+
+//Match 检索结果中的一个候选人员
+type Match struct {
+	ID    string  `json:"person_id"`
+	Score float64 `json:"score"` //余弦相似度
+}
+
+//normalize 返回L2归一化以后的向量
+func normalize(m []float32) []float32 {
+	var sum float64
+	for _, v := range m {
+		sum += float64(v) * float64(v)
+	}
+	out := make([]float32, len(m))
+	if sum == 0 {
+		return out
+	}
+	n := float32(math.Sqrt(sum))
+	for i, v := range m {
+		out[i] = v / n
+	}
+	return out
+}
+
+//dot 两个等长向量的内积
+func dot(a, b []float32) float32 {
+	var s float32
+	for i := range a {
+		s += a[i] * b[i]
+	}
+	return s
+}
+
+//personVectors 人员所有模板归一化以后的向量
+func personVectors(p *Person) [][]float32 {
+	vs := make([][]float32, 0, len(p.Templates))
+	for _, t := range p.Templates {
+		vs = append(vs, normalize(t.Metric))
+	}
+	return vs
+}
+
+//Search 在图库中检索和 metric 最相似的k个人员，只返回相似度不低于 threshold 的人员
+//人员的相似度取他所有模板中的最大值，长度和 metric 不同的模板被忽略
+//version 是 metric 的模型版本，和图库的模型版本不一致时返回 ErrModelVersion
+func (g *Gallery) Search(metric []float32, version string, k int, threshold float64) ([]Match, error) {
+	q := normalize(metric)
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if !compatible(version, g.conf.ModelVersion) {
+		return nil, ErrModelVersion
+	}
+	return g.index.search(q, k, threshold), nil
+}
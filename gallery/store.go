@@ -0,0 +1,247 @@
+package gallery
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNoGallery   = errors.New("gallery not found")
+	ErrExists      = errors.New("gallery already exists")
+	ErrInvalidName = errors.New("invalid gallery name")
+)
+
+//DefaultName 默认图库，请求没有指定图库时使用，不能删除
+const DefaultName = "default"
+
+//configName 图库配置的文件名，保存在图库目录中
+const configName = "gallery.json"
+
+//图库名称只能包含字母、数字、下划线和减号，名称就是目录名
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+//Config 图库的配置，除了阈值可以由校准结果更新、模型版本由登记更新以外，创建以后不能修改
+type Config struct {
+	Name         string       `json:"name"`
+	Threshold    float64      `json:"threshold,omitempty"`     //比对和识别的默认阈值，0表示使用服务器配置
+	TopK         int          `json:"top_k,omitempty"`         //识别的默认候选数目，0表示使用服务器配置
+	Index        string       `json:"index,omitempty"`         //索引类型，为空时使用服务器配置
+	Fusion       string       `json:"fusion,omitempty"`        //人员模板的默认融合策略，为空时为 max
+	ModelVersion string       `json:"model_version,omitempty"` //索引中模板的模型版本，为空表示还没有登记过带版本的模板
+	Schema       Schema       `json:"schema,omitempty"`        //meta 的格式
+	Calibration  *Calibration `json:"calibration,omitempty"`   //最近一次校准的结果
+	Created      time.Time    `json:"created"`
+}
+
+//Calibration 阈值校准的摘要，完整的结果由 calibrate 命令输出
+type Calibration struct {
+	Time         time.Time      `json:"time"`
+	Source       string         `json:"source"` //校准用的数据目录
+	Genuine      int            `json:"genuine"`
+	Impostor     int            `json:"impostor"`
+	EER          float64        `json:"eer"`
+	EERThreshold float64        `json:"eer_threshold"`
+	TargetFAR    float64        `json:"target_far"` //图库阈值对应的误识率
+	Thresholds   []FARThreshold `json:"thresholds"`
+}
+
+//FARThreshold 指定误识率下的阈值
+type FARThreshold struct {
+	FAR       float64 `json:"far"`
+	Threshold float64 `json:"threshold"`
+	TAR       float64 `json:"tar"`
+}
+
+//Info 图库的配置以及人员数目
+type Info struct {
+	Config
+	Persons int `json:"persons"`
+}
+
+//Store 多个相互隔离的图库，每个图库是数据目录下的一个子目录，有自己的索引和配置
+type Store struct {
+	dir       string
+	opts      Options
+	mu        sync.RWMutex
+	galleries map[string]*Gallery
+}
+
+//OpenStore 打开数据目录中的所有图库，没有默认图库时创建
+//旧版本的单一图库（<dir>/gallery）会被移动为默认图库
+func OpenStore(dir string, opts Options) (*Store, error) {
+	s := &Store{
+		dir:       filepath.Join(dir, "galleries"),
+		opts:      opts,
+		galleries: make(map[string]*Gallery),
+	}
+	if err := opts.WAL.check(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "create gallery dir %s failed", s.dir)
+	}
+	legacy := filepath.Join(dir, "gallery")
+	def := filepath.Join(s.dir, DefaultName)
+	if _, err := os.Stat(legacy); err == nil {
+		if _, err := os.Stat(def); os.IsNotExist(err) {
+			if err := os.Rename(legacy, def); err != nil {
+				return nil, errors.Wrapf(err, "move %s to %s failed", legacy, def)
+			}
+			glog.Infof("gallery %s moved to %s", legacy, def)
+		}
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read gallery dir %s failed", s.dir)
+	}
+	for _, fi := range files {
+		if !fi.IsDir() || !validName.MatchString(fi.Name()) {
+			continue
+		}
+		g, err := Open(filepath.Join(s.dir, fi.Name()), opts)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.galleries[fi.Name()] = g
+	}
+	if _, ok := s.galleries[DefaultName]; !ok {
+		if _, err := s.Create(Config{Name: DefaultName}); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+//Create 创建图库，先在临时目录中写好配置再改名，创建是原子的
+func (s *Store) Create(conf Config) (*Gallery, error) {
+	if !validName.MatchString(conf.Name) {
+		return nil, ErrInvalidName
+	}
+	if err := conf.Schema.check(); err != nil {
+		return nil, &SchemaError{Field: "schema", Reason: err.Error()}
+	}
+	switch conf.Index {
+	case "", IndexFlat, IndexHNSW:
+	default:
+		return nil, &SchemaError{Field: "index", Reason: "unknown index " + conf.Index}
+	}
+	if err := checkFusion(conf.Fusion); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.galleries[conf.Name]; ok {
+		return nil, ErrExists
+	}
+	conf.Created = time.Now()
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal gallery config failed")
+	}
+	tmp, err := ioutil.TempDir(s.dir, "."+conf.Name+".tmp")
+	if err != nil {
+		return nil, errors.Wrap(err, "create temp dir failed")
+	}
+	defer os.RemoveAll(tmp)
+	if err = writeSealed(s.opts.Keys, filepath.Join(tmp, configName), data); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(s.dir, conf.Name)
+	if err = os.Rename(tmp, dir); err != nil {
+		return nil, errors.Wrapf(err, "rename %s failed", tmp)
+	}
+	if err = syncDir(s.dir); err != nil {
+		return nil, err
+	}
+	g, err := Open(dir, s.opts)
+	if err != nil {
+		return nil, err
+	}
+	s.galleries[conf.Name] = g
+	return g, nil
+}
+
+//Drop 删除图库以及其中的所有人员，默认图库不能删除
+//先把目录改名再删除，删除到一半时崩溃也不会留下不完整的图库
+func (s *Store) Drop(name string) error {
+	if name == DefaultName {
+		return ErrInvalidName
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.galleries[name]
+	if !ok {
+		return ErrNoGallery
+	}
+	//关闭日志，不需要快照
+	g.stopLoop()
+	if err := g.closeLog(); err != nil {
+		glog.Warningf("close wal of gallery %s failed: %v", name, err)
+	}
+	dropped := filepath.Join(s.dir, fmt.Sprintf(".%s.dropped.%d", name, time.Now().UnixNano()))
+	if err := os.Rename(g.dir, dropped); err != nil {
+		return errors.Wrapf(err, "rename %s failed", g.dir)
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	delete(s.galleries, name)
+	if err := os.RemoveAll(dropped); err != nil {
+		glog.Warningf("remove dropped gallery %s failed: %v", dropped, err)
+	}
+	return nil
+}
+
+//Get 按照名称查询图库，名称为空时返回默认图库
+func (s *Store) Get(name string) (*Gallery, error) {
+	if len(name) == 0 {
+		name = DefaultName
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	g, ok := s.galleries[name]
+	if !ok {
+		return nil, ErrNoGallery
+	}
+	return g, nil
+}
+
+//List 按照名称排序列出所有图库
+func (s *Store) List() []Info {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	infos := make([]Info, 0, len(s.galleries))
+	for _, g := range s.galleries {
+		infos = append(infos, Info{Config: g.Config(), Persons: g.Count()})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+//Close 保存所有图库的索引
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var first error
+	for _, g := range s.galleries {
+		if err := g.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,133 @@
+package gallery
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrModelVersion = errors.New("model version mismatch")
+	ErrModified     = errors.New("person modified")
+)
+
+//compatible 模型版本为 version 的特征是否可以在模型版本为 gallery 的图库中使用
+//版本为空表示不知道版本（旧版本保存的模板或者客户端提供的特征），只有图库也没有版本时才可以使用，
+//不能假定它和图库的版本相同
+func compatible(version, gallery string) bool {
+	return len(gallery) == 0 || version == gallery
+}
+
+//ModelVersion 图库的模型版本，只有这个版本的模板在索引中
+func (g *Gallery) ModelVersion() string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.conf.ModelVersion
+}
+
+//Compatible 模型版本为 version 的特征是否可以在图库中检索
+func (g *Gallery) Compatible(version string) bool {
+	return compatible(version, g.ModelVersion())
+}
+
+//current 只保留和图库模型版本一致的模板，其他版本的模板保存在人员中但是不进入索引
+func (g *Gallery) current(p *Person) *Person {
+	stale := 0
+	for _, t := range p.Templates {
+		if !compatible(t.ModelVersion, g.conf.ModelVersion) {
+			stale++
+		}
+	}
+	if stale == 0 {
+		return p
+	}
+	c := *p
+	c.Templates = make([]Template, 0, len(p.Templates)-stale)
+	for _, t := range p.Templates {
+		if compatible(t.ModelVersion, g.conf.ModelVersion) {
+			c.Templates = append(c.Templates, t)
+		}
+	}
+	return &c
+}
+
+//saveConfig 保存图库配置，调用方持有写锁
+func (g *Gallery) saveConfig(conf Config) error {
+	if conf.Created.IsZero() {
+		conf.Created = time.Now()
+	}
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return errors.Wrap(err, "marshal gallery config failed")
+	}
+	if err = writeSealed(g.opts.Keys, filepath.Join(g.dir, configName), data); err != nil {
+		return err
+	}
+	g.conf = conf
+	return nil
+}
+
+//Upgrade 把图库的模型版本改为 version，重建索引
+//之后只有 version 版本的模板参与检索，旧版本的模板需要重新提取（见 ReplaceTemplates）
+func (g *Gallery) Upgrade(version string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.conf.ModelVersion == version {
+		return nil
+	}
+	conf := g.conf
+	conf.ModelVersion = version
+	if err := g.saveConfig(conf); err != nil {
+		return err
+	}
+	//保存的索引是旧版本的模板，节点数目可能碰巧一致，必须删除
+	if err := os.Remove(filepath.Join(g.dir, indexName)); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("gallery %s: remove index failed: %v", g.dir, err)
+	}
+	g.rebuildIndex()
+	return nil
+}
+
+//ReplaceTemplates 替换人员的所有模板，meta 不变，新模板中没有的照片副本被删除
+//base 是调用方读取的人员，之后人员被修改过时返回 ErrModified，调用方重新读取以后再试
+func (g *Gallery) ReplaceTemplates(base *Person, templates []Template) (*Person, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	old, ok := g.persons[base.ID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !old.Updated.Equal(base.Updated) {
+		return nil, ErrModified
+	}
+	p := old.clone()
+	p.Templates = make([]Template, len(templates))
+	for i, t := range templates {
+		p.Templates[i] = t
+		p.Templates[i].Metric = append([]float32(nil), t.Metric...)
+		p.Templates[i].Photo = nil
+	}
+	p.Updated = time.Now()
+	if err := g.append(walRecord{Op: walPut, ID: p.ID, Person: p}); err != nil {
+		return nil, err
+	}
+	g.persons[p.ID] = p
+	g.index.add(p.ID, g.indexVectors(p))
+	//被替换掉的模板的照片副本不再使用
+	kept := make(map[string]bool)
+	for _, name := range images(p.Templates) {
+		kept[name] = true
+	}
+	var unused []string
+	for _, name := range images(old.Templates) {
+		if !kept[name] {
+			unused = append(unused, name)
+		}
+	}
+	g.removeImages(unused)
+	return p.clone(), nil
+}
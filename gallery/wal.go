@@ -0,0 +1,466 @@
+package gallery
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+//预写日志：人员的修改先追加到图库目录中的 wal.log，按照落盘策略 fsync 以后才返回，
+//人员文件是日志的快照，由快照统一写入，之后删除已经写入快照的日志。
+//启动时在人员文件的基础上按顺序重放剩下的日志。
+//
+//每条记录为 4字节长度 | 4字节 CRC32C | 内容，内容是 walRecord 的 json（配置了密钥时加密），
+//进程在写记录的过程中崩溃只会留下不完整的最后一条记录，重放时校验失败，丢弃之后的内容
+
+//日志文件名，快照时把 wal.log 改名为 wal.<最后一条记录的序号>.old，快照完成以后删除
+const (
+	walName   = "wal.log"
+	walPrefix = "wal."
+	walSuffix = ".old"
+)
+
+//WAL 的落盘策略
+const (
+	SyncAlways   = "always"   //每条记录都 fsync，返回成功的修改在掉电以后也不会丢失，缺省策略
+	SyncInterval = "interval" //每隔 WALConfig.SyncInterval fsync 一次，掉电最多丢失这段时间内的修改
+	SyncNone     = "none"     //由操作系统决定何时落盘，只保证进程崩溃不丢失修改
+)
+
+const (
+	defaultSyncInterval = time.Second
+	defaultSnapshot     = 1000
+	walHeaderSize       = 8
+	maxRecordSize       = 64 << 20
+)
+
+//WALConfig 预写日志和快照的参数
+type WALConfig struct {
+	Sync             string        //落盘策略，为空时为 SyncAlways
+	SyncInterval     time.Duration //SyncInterval 策略的落盘间隔，0 使用 1 秒
+	Snapshot         int           //日志中的记录数达到这个值时做快照，0 使用 1000
+	SnapshotInterval time.Duration //日志不为空时做快照的间隔，0 表示只按照记录数做快照
+}
+
+func (c WALConfig) check() error {
+	switch c.Sync {
+	case "", SyncAlways, SyncInterval, SyncNone:
+		return nil
+	}
+	return errors.Errorf("unknown wal sync policy %q", c.Sync)
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+//日志记录的操作
+const (
+	walPut    = "put"    //Person 是人员修改以后的完整内容
+	walDelete = "delete" //删除人员 ID
+)
+
+type walRecord struct {
+	Seq    uint64  `json:"seq"`
+	Op     string  `json:"op"`
+	ID     string  `json:"id"`
+	Person *Person `json:"person,omitempty"`
+}
+
+//wal 图库的日志状态，除了 snap 以外由 Gallery.mu 保护
+type wal struct {
+	conf     WALConfig
+	f        *os.File
+	size     int64  //wal.log 中完整记录的长度，写入失败时截断到这里
+	seq      uint64 //最后一条记录的序号
+	records  int    //wal.log 中的记录数
+	unsynced bool
+	//日志中修改过、还没有写入人员文件的人员，值为 nil 表示删除
+	dirty map[string]*Person
+	//上一次快照失败时没有写入的人员，下一次快照一起写入，对应的 .old 日志保留到那时
+	pending map[string]*Person
+
+	snap sync.Mutex //快照和重新加密互斥，写人员文件时不持有 Gallery.mu
+	kick chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+//oldLogs 按照序号排列的 .old 日志
+func oldLogs(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read gallery dir %s failed", dir)
+	}
+	var names []string
+	for _, fi := range files {
+		if !fi.IsDir() && strings.HasPrefix(fi.Name(), walPrefix) && strings.HasSuffix(fi.Name(), walSuffix) {
+			names = append(names, filepath.Join(dir, fi.Name()))
+		}
+	}
+	//序号是定长的，按名称排序就是按序号排序
+	sort.Strings(names)
+	return names, nil
+}
+
+//recover 在人员文件的基础上重放日志，有记录时立刻做快照，之后打开新的 wal.log
+//返回是否重放了记录，这时保存的索引已经过期
+func (g *Gallery) recover() (bool, error) {
+	g.wal = &wal{
+		conf:  g.opts.WAL,
+		dirty: make(map[string]*Person),
+		kick:  make(chan struct{}, 1),
+	}
+	if g.wal.conf.SyncInterval <= 0 {
+		g.wal.conf.SyncInterval = defaultSyncInterval
+	}
+	if g.wal.conf.Snapshot <= 0 {
+		g.wal.conf.Snapshot = defaultSnapshot
+	}
+	logs, err := oldLogs(g.dir)
+	if err != nil {
+		return false, err
+	}
+	logs = append(logs, filepath.Join(g.dir, walName))
+	n := 0
+	for _, name := range logs {
+		c, err := g.replay(name)
+		if err != nil {
+			return false, err
+		}
+		n += c
+	}
+	if n > 0 {
+		glog.Infof("gallery %s: %d records replayed from wal", g.dir, n)
+		//人员文件写好以后才删除日志，快照失败时下次启动重新重放
+		if err = g.writeSnapshot(g.wal.dirty); err != nil {
+			return false, err
+		}
+		g.wal.dirty = make(map[string]*Person)
+	}
+	for _, name := range logs {
+		if err = os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return false, errors.Wrapf(err, "remove %s failed", name)
+		}
+	}
+	if err = g.openLog(); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+//replay 重放一个日志文件，返回重放的记录数；不完整或者校验失败的记录以及之后的内容被丢弃
+func (g *Gallery) replay(name string) (int, error) {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrapf(err, "read %s failed", name)
+	}
+	n := 0
+	for off := 0; off < len(data); {
+		if len(data)-off < walHeaderSize {
+			glog.Warningf("gallery %s: %s truncated at %d, %d bytes discarded", g.dir, filepath.Base(name), off, len(data)-off)
+			break
+		}
+		size := int(binary.LittleEndian.Uint32(data[off:]))
+		sum := binary.LittleEndian.Uint32(data[off+4:])
+		if size > maxRecordSize || len(data)-off-walHeaderSize < size ||
+			crc32.Checksum(data[off+walHeaderSize:off+walHeaderSize+size], crcTable) != sum {
+			glog.Warningf("gallery %s: %s corrupted at %d, %d bytes discarded", g.dir, filepath.Base(name), off, len(data)-off)
+			break
+		}
+		//校验通过以后解密失败说明密钥不对，不能当作不完整的记录丢弃
+		plain, _, err := g.opts.Keys.Open(data[off+walHeaderSize:off+walHeaderSize+size], []byte(walName))
+		if err != nil {
+			return n, errors.Wrapf(err, "decrypt %s failed", name)
+		}
+		rec := walRecord{}
+		if err = json.Unmarshal(plain, &rec); err != nil {
+			return n, errors.Wrapf(err, "parse %s at %d failed", name, off)
+		}
+		if g.wal.seq > 0 && rec.Seq != g.wal.seq+1 {
+			glog.Warningf("gallery %s: wal record %d follows %d", g.dir, rec.Seq, g.wal.seq)
+		}
+		g.wal.seq = rec.Seq
+		switch rec.Op {
+		case walPut:
+			if rec.Person == nil || rec.Person.ID != rec.ID {
+				return n, errors.Errorf("%s at %d: invalid put record", name, off)
+			}
+			g.persons[rec.ID] = rec.Person
+			g.wal.dirty[rec.ID] = rec.Person
+		case walDelete:
+			delete(g.persons, rec.ID)
+			g.wal.dirty[rec.ID] = nil
+		default:
+			return n, errors.Errorf("%s at %d: unknown op %q", name, off, rec.Op)
+		}
+		off += walHeaderSize + size
+		n++
+	}
+	return n, nil
+}
+
+//openLog 创建空的 wal.log
+func (g *Gallery) openLog() error {
+	name := filepath.Join(g.dir, walName)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "create %s failed", name)
+	}
+	if err = syncDir(g.dir); err != nil {
+		f.Close()
+		return err
+	}
+	g.wal.f = f
+	g.wal.size = 0
+	g.wal.records = 0
+	g.wal.unsynced = false
+	return nil
+}
+
+//append 追加一条日志记录，按照落盘策略落盘以后才返回，调用方持有写锁
+//写入失败时截断不完整的记录，日志不会在中间出现坏的记录
+func (g *Gallery) append(rec walRecord) error {
+	w := g.wal
+	if w.f == nil {
+		return errors.New("gallery is closed")
+	}
+	rec.Seq = w.seq + 1
+	plain, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "marshal wal record failed")
+	}
+	payload, err := g.opts.Keys.Seal(plain, []byte(walName))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.Checksum(payload, crcTable))
+	copy(buf[walHeaderSize:], payload)
+	if _, err = w.f.Write(buf); err == nil && (w.conf.Sync == "" || w.conf.Sync == SyncAlways) {
+		err = w.f.Sync()
+	}
+	if err != nil {
+		//返回失败的修改不能在重放时出现
+		if terr := w.f.Truncate(w.size); terr != nil {
+			//日志末尾是坏的记录，之后的记录在重放时都会被丢弃，不能再写入
+			w.f.Close()
+			w.f = nil
+			glog.Errorf("gallery %s: truncate wal failed, gallery is read-only: %v", g.dir, terr)
+		}
+		return errors.Wrap(err, "write wal failed")
+	}
+	if w.conf.Sync == SyncInterval || w.conf.Sync == SyncNone {
+		w.unsynced = true
+	}
+	w.size += int64(len(buf))
+	w.seq = rec.Seq
+	w.records++
+	w.dirty[rec.ID] = rec.Person
+	if w.records >= w.conf.Snapshot {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+//startLoop 启动后台任务：按照落盘策略定时 fsync，按照记录数和时间间隔做快照
+func (g *Gallery) startLoop() {
+	w := g.wal
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	go func() {
+		defer close(w.done)
+		var syncC, snapC <-chan time.Time
+		if w.conf.Sync == SyncInterval {
+			t := time.NewTicker(w.conf.SyncInterval)
+			defer t.Stop()
+			syncC = t.C
+		}
+		if w.conf.SnapshotInterval > 0 {
+			t := time.NewTicker(w.conf.SnapshotInterval)
+			defer t.Stop()
+			snapC = t.C
+		}
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-syncC:
+				if err := g.syncLog(); err != nil {
+					glog.Errorf("gallery %s: %v", g.dir, err)
+				}
+			case <-snapC:
+				if err := g.Snapshot(); err != nil {
+					glog.Errorf("gallery %s: snapshot failed: %+v", g.dir, err)
+				}
+			case <-w.kick:
+				if err := g.Snapshot(); err != nil {
+					glog.Errorf("gallery %s: snapshot failed: %+v", g.dir, err)
+				}
+			}
+		}
+	}()
+}
+
+//stopLoop 停止后台任务
+func (g *Gallery) stopLoop() {
+	w := g.wal
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+		w.stop = nil
+	}
+}
+
+//closeLog 落盘并关闭日志，之后不能再修改图库
+func (g *Gallery) closeLog() error {
+	w := g.wal
+	w.snap.Lock()
+	defer w.snap.Unlock()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Sync()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f = nil
+	return err
+}
+
+func (g *Gallery) syncLog() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	w := g.wal
+	if w.f == nil || !w.unsynced {
+		return nil
+	}
+	if err := w.f.Sync(); err != nil {
+		return errors.Wrap(err, "sync wal failed")
+	}
+	w.unsynced = false
+	return nil
+}
+
+//Snapshot 把日志中的修改写入人员文件并删除这些日志
+//先把 wal.log 改名，之后的修改写入新的 wal.log，写人员文件期间不阻塞图库的读写
+func (g *Gallery) Snapshot() error {
+	_, err := g.snapshot()
+	return err
+}
+
+//snapshot 返回删除的日志文件
+func (g *Gallery) snapshot() ([]string, error) {
+	w := g.wal
+	w.snap.Lock()
+	defer w.snap.Unlock()
+
+	g.mu.Lock()
+	if w.f == nil || (w.records == 0 && w.pending == nil) {
+		g.mu.Unlock()
+		return nil, nil
+	}
+	dirty := w.pending
+	if dirty == nil {
+		dirty = make(map[string]*Person, len(w.dirty))
+	}
+	for id, p := range w.dirty {
+		dirty[id] = p
+	}
+	if w.records > 0 {
+		if err := g.rotateLog(); err != nil {
+			g.mu.Unlock()
+			return nil, err
+		}
+	}
+	w.dirty = make(map[string]*Person)
+	w.pending = nil
+	g.mu.Unlock()
+
+	logs, err := oldLogs(g.dir)
+	if err == nil {
+		err = g.writeSnapshot(dirty)
+	}
+	if err != nil {
+		g.mu.Lock()
+		//之后的修改覆盖这次没有写入的内容
+		for id, p := range w.dirty {
+			dirty[id] = p
+		}
+		w.pending = dirty
+		g.mu.Unlock()
+		return nil, err
+	}
+	for _, name := range logs {
+		if err = os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "remove %s failed", name)
+		}
+	}
+	return logs, syncDir(g.dir)
+}
+
+//rotateLog 把 wal.log 改名为 .old 日志并创建新的 wal.log，调用方持有写锁
+func (g *Gallery) rotateLog() error {
+	w := g.wal
+	if err := w.f.Sync(); err != nil {
+		return errors.Wrap(err, "sync wal failed")
+	}
+	if err := w.f.Close(); err != nil {
+		return errors.Wrap(err, "close wal failed")
+	}
+	w.f = nil
+	name := filepath.Join(g.dir, walName)
+	old := filepath.Join(g.dir, fmt.Sprintf("%s%020d%s", walPrefix, w.seq, walSuffix))
+	if err := os.Rename(name, old); err != nil {
+		//重新打开原来的日志继续追加
+		if f, ferr := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600); ferr == nil {
+			w.f = f
+		}
+		return errors.Wrapf(err, "rename %s failed", name)
+	}
+	return g.openLog()
+}
+
+//writeSnapshot 写入修改过的人员文件，删除已经删除的人员的文件
+//保存的索引不再和人员一致，同时删除，下次启动时重建
+func (g *Gallery) writeSnapshot(dirty map[string]*Person) error {
+	if len(dirty) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(dirty))
+	for id := range dirty {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if p := dirty[id]; p != nil {
+			if err := g.save(p); err != nil {
+				return err
+			}
+		} else if err := os.Remove(g.path(id)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "remove person %s failed", id)
+		}
+	}
+	if err := os.Remove(filepath.Join(g.dir, indexName)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "remove %s failed", indexName)
+	}
+	return syncDir(g.dir)
+}
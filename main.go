@@ -2,19 +2,64 @@ package main
 
 import "C"
 import (
+	"faceserver/attendance"
+	"faceserver/face"
+	"faceserver/gallery"
+	"faceserver/pkg/hnsw"
+	"faceserver/pkg/keyring"
+	"faceserver/pkg/protect"
 	"faceserver/pkg/shell"
 	"faceserver/server"
 	"flag"
 	"fmt"
 	"github.com/golang/glog"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type cmdLine struct {
-	cmd     string
-	listen  string
-	version bool
+	cmd       string
+	listen    string
+	version   bool
+	sched     string
+	queue     int
+	policy    string
+	restart   int
+	threshold float64
+	data      string
+	topK      int
+	index     string
+	hnswM     int
+	hnswEfc   int
+	hnswEf    int
+	gImport   string
+	gExport   string
+	gName     string
+	gReenroll bool
+	keyFile   string
+	keyID     string
+	keyPlain  bool
+	walSync   string
+	walSyncIv time.Duration
+	snapshot  int
+	snapIv    time.Duration
+	receipt   string
+	protKeys  string
+	protBits  int
+	liveness  float64
+	quality   float64
+	verifyThr float64
+	audit     string
+	attName   string
+	attWindow time.Duration
+	attConf   string
+	noEvents  bool
+	evThumb   bool
 }
 
 var cmd cmdLine
@@ -23,16 +68,144 @@ func init() {
 	flag.StringVar(&cmd.cmd, "cmd", "", "cmd")
 	flag.StringVar(&cmd.listen, "listen", "", "listen")
 	flag.BoolVar(&cmd.version, "version", false, "version")
+	flag.StringVar(&cmd.sched, "sched", "", "priority classes, name:weight:limit[,...]")
+	flag.IntVar(&cmd.queue, "outbound_queue", 64, "outbound queue size of each connection")
+	flag.StringVar(&cmd.policy, "outbound_policy", "drop", "when outbound queue is full: drop or disconnect")
+	flag.IntVar(&cmd.restart, "restart_after", 0, "restart engine after n consecutive callback failures, 0: never")
+	flag.Float64Var(&cmd.threshold, "match_threshold", 0.6, "default similarity threshold of compare")
+	flag.StringVar(&cmd.data, "data", "data", "data directory")
+	flag.IntVar(&cmd.topK, "top_k", 5, "default number of candidates of identify")
+	flag.StringVar(&cmd.index, "index", "flat", "gallery search index: flat or hnsw")
+	flag.IntVar(&cmd.hnswM, "hnsw_m", hnsw.DefaultConfig.M, "hnsw: neighbours per node")
+	flag.IntVar(&cmd.hnswEfc, "hnsw_ef_construction", hnsw.DefaultConfig.EfConstruction, "hnsw: candidate list size when inserting")
+	flag.StringVar(&cmd.gImport, "gallery-import", "", "import persons from a jsonl or csv file without starting the server")
+	flag.StringVar(&cmd.gExport, "gallery-export", "", "export the gallery to a jsonl or csv file without starting the server")
+	flag.StringVar(&cmd.gName, "gallery", "", "gallery of -gallery-import, -gallery-export and -gallery-reenroll, default gallery if empty")
+	flag.BoolVar(&cmd.gReenroll, "gallery-reenroll", false, "re-extract templates of the gallery with the current model without starting the server")
+	flag.IntVar(&cmd.hnswEf, "hnsw_ef", hnsw.DefaultConfig.EfSearch, "hnsw: candidate list size when searching")
+	flag.StringVar(&cmd.keyFile, "key_file", "", "encrypt data at rest with keys in this file, one <id>:<base64 key> per line; keys in $"+keyring.EnvKeys+" are also used")
+	flag.StringVar(&cmd.keyID, "key_id", "", "id of the key used to encrypt, the last key if empty")
+	flag.BoolVar(&cmd.keyPlain, "key_migrate", false, "accept plaintext data written before keys were configured, run key_rotate to encrypt it and restart without this flag")
+	flag.StringVar(&cmd.walSync, "wal_sync", gallery.SyncAlways, "when gallery changes are fsynced: always, interval or none")
+	flag.DurationVar(&cmd.walSyncIv, "wal_sync_interval", time.Second, "fsync interval of -wal_sync=interval")
+	flag.IntVar(&cmd.snapshot, "snapshot_records", 1000, "write a gallery snapshot when the wal has this many records")
+	flag.StringVar(&cmd.receipt, "receipt_key", "", "ed25519 key signing erasure receipts, base64 seed; data/receipt.key is generated if empty")
+	flag.StringVar(&cmd.protKeys, "protect_keys", "", "protect templates with per-gallery secrets in this file, one <gallery>:<base64 secret> per line, * for other galleries")
+	flag.IntVar(&cmd.protBits, "protect_bits", protect.DefaultBits, "bits of protected templates")
+	flag.Float64Var(&cmd.liveness, "verify_liveness", 0.5, "verify_identity: minimum liveness score of the live image")
+	flag.Float64Var(&cmd.quality, "verify_quality", 0.3, "verify_identity: minimum quality score of the live image")
+	flag.Float64Var(&cmd.verifyThr, "verify_threshold", 0, "verify_identity: similarity threshold, -match_threshold if 0; requests may only raise it")
+	flag.StringVar(&cmd.audit, "verify_audit", "", "verify_identity audit log, relative to -data; verify_audit.log in -data if empty")
+	flag.StringVar(&cmd.attName, "attendance_gallery", "", "record identify results in this gallery as attendance check-ins, disabled if empty")
+	flag.DurationVar(&cmd.attWindow, "attendance_window", attendance.DefaultWindow, "attendance: ignore repeated check-ins of a person within this window")
+	flag.StringVar(&cmd.attConf, "attendance_conf", "", "attendance: json file of shifts and source directions, a 09:00-18:00 shift if empty")
+	flag.BoolVar(&cmd.noEvents, "no_events", false, "do not record compare and identify results in the event log")
+	flag.BoolVar(&cmd.evThumb, "events_thumbnail", false, "store face thumbnails (jpeg and png images only) in the event log")
+	flag.DurationVar(&cmd.snapIv, "snapshot_interval", 10*time.Minute, "write a gallery snapshot at this interval if the wal is not empty, 0: only by -snapshot_records")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "calibrate" {
+		calibrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "cluster" {
+		clusterImages(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		keygen(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		verifyReceipt(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		readAudit(os.Args[2:])
+		return
+	}
 	flag.Parse()
 	defer glog.Flush()
 
-	if len(cmd.listen) > 0 {
-		//表示是服务器侦听
-		app := server.NewApp()
-		err := app.Run(cmd.listen)
+	if len(cmd.listen) > 0 || len(cmd.gImport) > 0 || len(cmd.gExport) > 0 || cmd.gReenroll {
+		classes, err := face.ParseClasses(cmd.sched)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return
+		}
+		keys, err := keyring.Load(cmd.keyFile, cmd.keyID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return
+		}
+		if keys != nil {
+			keys.AllowPlaintext(cmd.keyPlain)
+		}
+		protection, err := protect.Load(cmd.protKeys, cmd.protBits)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return
+		}
+		attSettings, err := attendance.LoadSettings(cmd.attConf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return
+		}
+		app := server.NewApp(server.Config{
+			Classes:    classes,
+			QueueSize:  cmd.queue,
+			Policy:     cmd.policy,
+			Restart:    cmd.restart,
+			Threshold:  cmd.threshold,
+			DataDir:    cmd.data,
+			TopK:       cmd.topK,
+			ReceiptKey: cmd.receipt,
+			Protect:    protection,
+			Verify: server.VerifyPolicy{
+				MinLiveness: cmd.liveness,
+				MinQuality:  cmd.quality,
+				Threshold:   cmd.verifyThr,
+				AuditLog:    cmd.audit,
+			},
+			Attendance: server.AttendanceConfig{
+				Gallery:  cmd.attName,
+				Window:   cmd.attWindow,
+				Settings: attSettings,
+			},
+			Events: server.EventsConfig{
+				Disabled:  cmd.noEvents,
+				Thumbnail: cmd.evThumb,
+			},
+			Index: gallery.Options{
+				Index: cmd.index,
+				Keys:  keys,
+				WAL: gallery.WALConfig{
+					Sync:             cmd.walSync,
+					SyncInterval:     cmd.walSyncIv,
+					Snapshot:         cmd.snapshot,
+					SnapshotInterval: cmd.snapIv,
+				},
+				HNSW: hnsw.Config{
+					M:              cmd.hnswM,
+					EfConstruction: cmd.hnswEfc,
+					EfSearch:       cmd.hnswEf,
+					Seed:           hnsw.DefaultConfig.Seed,
+				},
+			},
+		})
+		switch {
+		case len(cmd.gImport) > 0:
+			//离线导入图库
+			err = app.RunTransfer(server.OpImport, cmd.gImport, cmd.gName)
+		case len(cmd.gExport) > 0:
+			err = app.RunTransfer(server.OpExport, cmd.gExport, cmd.gName)
+		case cmd.gReenroll:
+			err = app.RunTransfer(server.OpReenroll, "", cmd.gName)
+		default:
+			//表示是服务器侦听
+			err = app.Run(cmd.listen)
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%+v\n", err)
 		}
@@ -58,3 +231,176 @@ func main() {
 		client.Close()
 	}
 }
+
+//calibrate 子命令：faceserver calibrate -dir <身份目录> [选项]
+func calibrate(args []string) {
+	fs := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	dir := fs.String("dir", "", "labeled identities, one sub directory of images per identity")
+	fars := fs.String("far", "1e-3,1e-4,1e-5", "target false accept rates")
+	out := fs.String("out", "", "write the full result as json to this file")
+	curve := fs.String("curve", "", "write ROC/DET data as csv to this file")
+	name := fs.String("gallery", "", "write the threshold into the config of this gallery")
+	applyFAR := fs.Float64("apply_far", 1e-4, "FAR of the threshold written into the gallery config")
+	force := fs.Bool("force", false, "write the threshold even if there are too few impostor pairs")
+	maxImpostor := fs.Int("max_impostor", 20000000, "sample impostor pairs when there are more")
+	data := fs.String("data", "data", "data directory")
+	keyFile := fs.String("key_file", "", "key file of the encrypted data directory")
+	keyID := fs.String("key_id", "", "id of the key used to encrypt, the last key if empty")
+	keyPlain := fs.Bool("key_migrate", false, "accept plaintext data written before keys were configured")
+	protKeys := fs.String("protect_keys", "", "calibrate protected templates of -gallery with secrets in this file")
+	protBits := fs.Int("protect_bits", protect.DefaultBits, "bits of protected templates")
+	fs.Parse(args)
+	//glog 的参数在默认的 FlagSet 中
+	flag.CommandLine.Parse(nil)
+	defer glog.Flush()
+
+	if len(*dir) == 0 && fs.NArg() > 0 {
+		*dir = fs.Arg(0)
+	}
+	if len(*dir) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	conf := server.CalibrateConfig{
+		Dir:         *dir,
+		Out:         *out,
+		Curve:       *curve,
+		Gallery:     *name,
+		ApplyFAR:    *applyFAR,
+		Force:       *force,
+		MaxImpostor: *maxImpostor,
+	}
+	for _, f := range strings.Split(*fars, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil || v <= 0 || v >= 1 {
+			fmt.Fprintf(os.Stderr, "invalid far: %s\n", f)
+			os.Exit(2)
+		}
+		conf.FARs = append(conf.FARs, v)
+	}
+	keys, err := keyring.Load(*keyFile, *keyID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		os.Exit(1)
+	}
+	if keys != nil {
+		keys.AllowPlaintext(*keyPlain)
+	}
+	protection, err := protect.Load(*protKeys, *protBits)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		os.Exit(1)
+	}
+	app := server.NewApp(server.Config{DataDir: *data, Index: gallery.Options{Keys: keys}, Protect: protection})
+	if err := app.RunCalibrate(conf); err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		os.Exit(1)
+	}
+}
+
+//cluster 子命令：faceserver cluster -dir <照片目录> [选项]
+func clusterImages(args []string) {
+	fs := flag.NewFlagSet("cluster", flag.ExitOnError)
+	dir := fs.String("dir", "", "directory of images to cluster")
+	method := fs.String("method", "chinese_whispers", "dbscan or chinese_whispers")
+	threshold := fs.Float64("threshold", 0.6, "faces with similarity not lower than this are neighbours")
+	minSamples := fs.Int("min_samples", 2, "clusters with fewer faces are reported as noise")
+	maxFaces := fs.Int("max_face_count", 5, "max faces extracted from each image")
+	out := fs.String("out", "", "write the result as json to this file, stdout if empty")
+	fs.Parse(args)
+	flag.CommandLine.Parse(nil)
+	defer glog.Flush()
+
+	if len(*dir) == 0 && fs.NArg() > 0 {
+		*dir = fs.Arg(0)
+	}
+	if len(*dir) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	app := server.NewApp(server.Config{})
+	err := app.RunCluster(server.ClusterConfig{
+		Dir:        *dir,
+		Method:     *method,
+		Threshold:  *threshold,
+		MinSamples: *minSamples,
+		MaxFaces:   *maxFaces,
+		Out:        *out,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		os.Exit(1)
+	}
+}
+
+//keygen 子命令：生成一个随机密钥，输出追加到密钥文件中的一行
+func keygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	id := fs.String("id", "", "key id")
+	fs.Parse(args)
+	if len(*id) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	line, err := keyring.Generate(*id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(line)
+}
+
+//verifyReceipt 验证 purge 返回的删除凭证
+func verifyReceipt(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	pub := fs.String("public_key", "", "public key of the server (shell command receipt_key), the key in the receipt if empty")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: faceserver verify [-public_key <base64>] <receipt.json>")
+		os.Exit(2)
+	}
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	r, err := server.VerifyReceipt(data, *pub)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("receipt %s of person %s is valid, signed by key %s, completed %s, complete:%v\n",
+		r.ReceiptID, r.PersonID, r.KeyID, r.Completed.Format(time.RFC3339), r.Complete)
+	if len(*pub) == 0 {
+		fmt.Println("key_id must match the published key of the server")
+	}
+}
+
+//readAudit 子命令：输出人证核验的审计日志，每行一条 json 记录，加密的日志需要服务器使用的密钥
+func readAudit(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	data := fs.String("data", "data", "data directory, the log is verify_audit.log in it if no file is given")
+	keyFile := fs.String("key_file", "", "key file used by the server")
+	keyPlain := fs.Bool("key_migrate", false, "accept plaintext records written before keys were configured")
+	fs.Parse(args)
+	name := filepath.Join(*data, "verify_audit.log")
+	if fs.NArg() > 0 {
+		name = fs.Arg(0)
+	}
+	keys, err := keyring.Load(*keyFile, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		os.Exit(1)
+	}
+	if keys != nil {
+		keys.AllowPlaintext(*keyPlain)
+	}
+	err = server.ReadAudit(name, keys, func(rec []byte) error {
+		_, err := fmt.Printf("%s\n", rec)
+		return err
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,227 @@
+//Package cluster 人脸特征的聚类，相似度为余弦相似度
+//支持 DBSCAN 和 Chinese whispers 两种不需要预先指定类别数目的算法
+package cluster
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+//聚类算法
+const (
+	DBSCAN          = "dbscan"
+	ChineseWhispers = "chinese_whispers"
+)
+
+//Config 聚类参数
+type Config struct {
+	Method     string  //DBSCAN 或者 ChineseWhispers，缺省为 ChineseWhispers
+	Threshold  float64 //相似度不低于阈值的两个特征是邻居
+	MinSamples int     //DBSCAN 核心点的最少邻居数目（包括自己）；人数少于这个值的类别作为噪声，缺省为2
+	Iterations int     //Chinese whispers 的最多迭代次数，缺省为20
+	Seed       int64   //Chinese whispers 遍历顺序的随机种子
+}
+
+//Cluster 一个类别
+type Cluster struct {
+	Members  []int   //特征在输入中的序号，升序
+	Cohesion float64 //类别内两两相似度的平均值，只有一个成员时为1
+}
+
+//graph 相似度不低于阈值的邻接表
+type graph struct {
+	vectors   [][]float32
+	neighbors [][]int
+	weights   [][]float64
+}
+
+func normalize(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	out := make([]float32, len(v))
+	if sum == 0 {
+		return out
+	}
+	n := math.Sqrt(sum)
+	for i, x := range v {
+		out[i] = float32(float64(x) / n)
+	}
+	return out
+}
+
+func dot(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return -1
+	}
+	var s float32
+	for i := range a {
+		s += a[i] * b[i]
+	}
+	return float64(s)
+}
+
+func newGraph(vectors [][]float32, threshold float64) *graph {
+	g := &graph{
+		vectors:   make([][]float32, len(vectors)),
+		neighbors: make([][]int, len(vectors)),
+		weights:   make([][]float64, len(vectors)),
+	}
+	for i, v := range vectors {
+		g.vectors[i] = normalize(v)
+	}
+	for i := range g.vectors {
+		for j := i + 1; j < len(g.vectors); j++ {
+			if s := dot(g.vectors[i], g.vectors[j]); s >= threshold {
+				g.neighbors[i] = append(g.neighbors[i], j)
+				g.weights[i] = append(g.weights[i], s)
+				g.neighbors[j] = append(g.neighbors[j], i)
+				g.weights[j] = append(g.weights[j], s)
+			}
+		}
+	}
+	return g
+}
+
+//Run 聚类，返回按照人数从多到少排序的类别以及不属于任何类别的噪声
+func Run(vectors [][]float32, conf Config) ([]Cluster, []int, error) {
+	if conf.MinSamples <= 0 {
+		conf.MinSamples = 2
+	}
+	if conf.Iterations <= 0 {
+		conf.Iterations = 20
+	}
+	g := newGraph(vectors, conf.Threshold)
+	var labels []int
+	switch conf.Method {
+	case DBSCAN:
+		labels = g.dbscan(conf.MinSamples)
+	case "", ChineseWhispers:
+		labels = g.chineseWhispers(conf.Iterations, conf.Seed)
+	default:
+		return nil, nil, fmt.Errorf("unknown cluster method: %s", conf.Method)
+	}
+
+	groups := make(map[int][]int)
+	var noise []int
+	for i, l := range labels {
+		if l < 0 {
+			noise = append(noise, i)
+			continue
+		}
+		groups[l] = append(groups[l], i)
+	}
+	clusters := make([]Cluster, 0, len(groups))
+	for _, members := range groups {
+		if len(members) < conf.MinSamples {
+			noise = append(noise, members...)
+			continue
+		}
+		clusters = append(clusters, Cluster{Members: members, Cohesion: g.cohesion(members)})
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i].Members) != len(clusters[j].Members) {
+			return len(clusters[i].Members) > len(clusters[j].Members)
+		}
+		return clusters[i].Members[0] < clusters[j].Members[0]
+	})
+	sort.Ints(noise)
+	return clusters, noise, nil
+}
+
+//dbscan 邻居数目（包括自己）不少于 minSamples 的点是核心点，从核心点出发把可达的点归为一类，
+//不可达的点是噪声，标记为-1
+func (g *graph) dbscan(minSamples int) []int {
+	labels := make([]int, len(g.vectors))
+	for i := range labels {
+		labels[i] = -2 //未访问
+	}
+	next := 0
+	for i := range g.vectors {
+		if labels[i] != -2 {
+			continue
+		}
+		if len(g.neighbors[i])+1 < minSamples {
+			labels[i] = -1
+			continue
+		}
+		labels[i] = next
+		queue := append([]int(nil), g.neighbors[i]...)
+		for len(queue) > 0 {
+			j := queue[0]
+			queue = queue[1:]
+			if labels[j] == -1 {
+				labels[j] = next //边界点
+			}
+			if labels[j] != -2 {
+				continue
+			}
+			labels[j] = next
+			if len(g.neighbors[j])+1 >= minSamples {
+				queue = append(queue, g.neighbors[j]...)
+			}
+		}
+		next++
+	}
+	return labels
+}
+
+//chineseWhispers 每个点开始时自成一类，按照随机顺序让每个点采用邻居中权重之和最大的类别，
+//直到没有变化或者达到迭代次数
+func (g *graph) chineseWhispers(iterations int, seed int64) []int {
+	labels := make([]int, len(g.vectors))
+	for i := range labels {
+		labels[i] = i
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	order := rnd.Perm(len(labels))
+	score := make(map[int]float64)
+	for it := 0; it < iterations; it++ {
+		changed := false
+		rnd.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+		for _, i := range order {
+			if len(g.neighbors[i]) == 0 {
+				continue
+			}
+			for k := range score {
+				delete(score, k)
+			}
+			for k, j := range g.neighbors[i] {
+				score[labels[j]] += g.weights[i][k]
+			}
+			best, bestScore := labels[i], -1.0
+			for l, s := range score {
+				if s > bestScore || (s == bestScore && l < best) {
+					best, bestScore = l, s
+				}
+			}
+			if best != labels[i] {
+				labels[i] = best
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	return labels
+}
+
+//cohesion 类别内两两相似度的平均值
+func (g *graph) cohesion(members []int) float64 {
+	if len(members) < 2 {
+		return 1
+	}
+	var sum float64
+	n := 0
+	for a := 0; a < len(members); a++ {
+		for b := a + 1; b < len(members); b++ {
+			sum += dot(g.vectors[members[a]], g.vectors[members[b]])
+			n++
+		}
+	}
+	return sum / float64(n)
+}
@@ -0,0 +1,73 @@
+package hnsw
+
+import "sort"
+
+type candidate struct {
+	id   uint32
+	dist float32
+}
+
+func sortCandidates(c []candidate) {
+	sort.Slice(c, func(i, j int) bool { return c[i].dist < c[j].dist })
+}
+
+//minHeap 距离最小的在堆顶
+type minHeap []candidate
+
+func (h minHeap) Len() int            { return len(h) }
+func (h minHeap) Less(i, j int) bool  { return h[i].dist < h[j].dist }
+func (h minHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *minHeap) Push(x interface{}) { *h = append(*h, x.(candidate)) }
+func (h *minHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+//maxHeap 距离最大的在堆顶
+type maxHeap []candidate
+
+func (h maxHeap) Len() int            { return len(h) }
+func (h maxHeap) Less(i, j int) bool  { return h[i].dist > h[j].dist }
+func (h maxHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *maxHeap) Push(x interface{}) { *h = append(*h, x.(candidate)) }
+func (h *maxHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+//visitedSet 用代数标记访问过的节点，复用时不需要清零
+type visitedSet struct {
+	gen   uint32
+	marks []uint32
+}
+
+func (v *visitedSet) mark(id uint32) {
+	v.marks[id] = v.gen
+}
+
+func (v *visitedSet) marked(id uint32) bool {
+	return v.marks[id] == v.gen
+}
+
+func (h *Index) getVisited() *visitedSet {
+	v, _ := h.visited.Get().(*visitedSet)
+	if v == nil {
+		v = &visitedSet{}
+	}
+	if len(v.marks) < len(h.nodes) {
+		v.marks = make([]uint32, len(h.nodes)+len(h.nodes)/4+16)
+		v.gen = 0
+	}
+	v.gen++
+	if v.gen == 0 {
+		for i := range v.marks {
+			v.marks[i] = 0
+		}
+		v.gen = 1
+	}
+	return v
+}
@@ -0,0 +1,375 @@
+//Package hnsw 纯go实现的 HNSW(Hierarchical Navigable Small World) 近似最近邻索引
+//向量在插入时做L2归一化，距离为 1-余弦相似度
+//支持增量插入和删除（删除只做标记，节点仍然参与图的遍历），可以保存到磁盘
+package hnsw
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+//Config 索引参数
+type Config struct {
+	M              int //每个节点在每一层的邻居数目，第0层为2*M，越大召回率越高，内存越多
+	EfConstruction int //插入时的候选集大小，越大图的质量越好，插入越慢
+	EfSearch       int //检索时的候选集大小，越大召回率越高，检索越慢
+	Seed           int64
+}
+
+//DefaultConfig 默认参数，适合256维的人脸特征
+var DefaultConfig = Config{M: 16, EfConstruction: 200, EfSearch: 64, Seed: 1}
+
+//Result 检索结果
+type Result struct {
+	Key   string
+	Score float32 //余弦相似度
+}
+
+type node struct {
+	key     string
+	vec     []float32
+	friends [][]uint32 //每一层的邻居
+	deleted bool
+}
+
+//Index HNSW索引，可以被多个协程同时使用
+type Index struct {
+	mu       sync.RWMutex
+	conf     Config
+	nodes    []*node
+	keys     map[string]uint32 //有效节点的键
+	entry    uint32
+	maxLevel int
+	levelMul float64
+	rnd      *rand.Rand
+	visited  sync.Pool
+}
+
+//New 创建一个空的索引
+func New(conf Config) *Index {
+	if conf.M < 2 {
+		conf.M = DefaultConfig.M
+	}
+	if conf.EfConstruction < conf.M {
+		conf.EfConstruction = DefaultConfig.EfConstruction
+	}
+	if conf.EfSearch <= 0 {
+		conf.EfSearch = DefaultConfig.EfSearch
+	}
+	return &Index{
+		conf:     conf,
+		keys:     make(map[string]uint32),
+		maxLevel: -1,
+		levelMul: 1 / math.Log(float64(conf.M)),
+		rnd:      rand.New(rand.NewSource(conf.Seed)),
+	}
+}
+
+//SetEfSearch 调整检索时的候选集大小，在召回率和速度之间取舍
+func (h *Index) SetEfSearch(ef int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ef > 0 {
+		h.conf.EfSearch = ef
+	}
+}
+
+//Len 有效节点的数目
+func (h *Index) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.keys)
+}
+
+//Deleted 已经删除但是仍然占用空间的节点数目
+func (h *Index) Deleted() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.nodes) - len(h.keys)
+}
+
+//Keys 所有有效节点的键
+func (h *Index) Keys() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	keys := make([]string, 0, len(h.keys))
+	for k := range h.keys {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func normalize(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	out := make([]float32, len(v))
+	if sum == 0 {
+		return out
+	}
+	n := float32(math.Sqrt(sum))
+	for i, x := range v {
+		out[i] = x / n
+	}
+	return out
+}
+
+func dot(a, b []float32) float32 {
+	var s0, s1, s2, s3 float32
+	n := len(a)
+	i := 0
+	for ; i+4 <= n; i += 4 {
+		s0 += a[i] * b[i]
+		s1 += a[i+1] * b[i+1]
+		s2 += a[i+2] * b[i+2]
+		s3 += a[i+3] * b[i+3]
+	}
+	for ; i < n; i++ {
+		s0 += a[i] * b[i]
+	}
+	return s0 + s1 + s2 + s3
+}
+
+func (h *Index) distance(q []float32, id uint32) float32 {
+	v := h.nodes[id].vec
+	if len(v) != len(q) {
+		return 2
+	}
+	return 1 - dot(q, v)
+}
+
+func (h *Index) randomLevel() int {
+	return int(math.Floor(-math.Log(1-h.rnd.Float64()) * h.levelMul))
+}
+
+func (h *Index) maxFriends(level int) int {
+	if level == 0 {
+		return 2 * h.conf.M
+	}
+	return h.conf.M
+}
+
+//Insert 插入一个向量，键已经存在时替换原来的向量
+func (h *Index) Insert(key string, vec []float32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if old, ok := h.keys[key]; ok {
+		h.nodes[old].deleted = true
+		delete(h.keys, key)
+	}
+	q := normalize(vec)
+	level := h.randomLevel()
+	id := uint32(len(h.nodes))
+	n := &node{key: key, vec: q, friends: make([][]uint32, level+1)}
+	h.nodes = append(h.nodes, n)
+	h.keys[key] = id
+
+	if h.maxLevel < 0 {
+		h.entry = id
+		h.maxLevel = level
+		return
+	}
+
+	ep := h.entry
+	epDist := h.distance(q, ep)
+	//从顶层贪心下降到新节点所在层的上一层
+	for l := h.maxLevel; l > level; l-- {
+		ep, epDist = h.greedy(q, ep, epDist, l)
+	}
+	for l := min(level, h.maxLevel); l >= 0; l-- {
+		candidates := h.searchLayer(q, ep, epDist, h.conf.EfConstruction, l)
+		friends := h.selectNeighbors(candidates, h.conf.M)
+		n.friends[l] = friends
+		for _, f := range friends {
+			h.connect(f, id, l)
+		}
+		ep, epDist = candidates[0].id, candidates[0].dist
+	}
+	if level > h.maxLevel {
+		h.entry = id
+		h.maxLevel = level
+	}
+}
+
+//Delete 删除一个键，节点仍然保留在图中用于遍历，但不会出现在检索结果中
+func (h *Index) Delete(key string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	id, ok := h.keys[key]
+	if !ok {
+		return false
+	}
+	h.nodes[id].deleted = true
+	delete(h.keys, key)
+	return true
+}
+
+//connect 在第level层添加 from->to 的边，超过邻居上限时重新选择邻居
+func (h *Index) connect(from, to uint32, level int) {
+	n := h.nodes[from]
+	if level >= len(n.friends) {
+		return
+	}
+	n.friends[level] = append(n.friends[level], to)
+	limit := h.maxFriends(level)
+	if len(n.friends[level]) <= limit {
+		return
+	}
+	candidates := make([]candidate, 0, len(n.friends[level]))
+	for _, f := range n.friends[level] {
+		candidates = append(candidates, candidate{id: f, dist: 1 - dot(n.vec, h.nodes[f].vec)})
+	}
+	sortCandidates(candidates)
+	n.friends[level] = h.selectNeighbors(candidates, limit)
+}
+
+//selectNeighbors 启发式选择邻居：只有当候选点离新节点比离所有已选邻居都近时才选择它，
+//这样邻居分布在不同方向上，聚类数据上的召回率更高；不足m个时用剩下的最近点补齐
+//candidates 必须按照距离从小到大排序
+func (h *Index) selectNeighbors(candidates []candidate, m int) []uint32 {
+	if len(candidates) <= m {
+		out := make([]uint32, len(candidates))
+		for i, c := range candidates {
+			out[i] = c.id
+		}
+		return out
+	}
+	selected := make([]uint32, 0, m)
+	var skipped []uint32
+	for _, c := range candidates {
+		if len(selected) >= m {
+			break
+		}
+		good := true
+		for _, s := range selected {
+			if 1-dot(h.nodes[c.id].vec, h.nodes[s].vec) < c.dist {
+				good = false
+				break
+			}
+		}
+		if good {
+			selected = append(selected, c.id)
+		} else {
+			skipped = append(skipped, c.id)
+		}
+	}
+	for _, id := range skipped {
+		if len(selected) >= m {
+			break
+		}
+		selected = append(selected, id)
+	}
+	return selected
+}
+
+//greedy 在第level层从ep出发贪心地寻找最近的节点
+func (h *Index) greedy(q []float32, ep uint32, epDist float32, level int) (uint32, float32) {
+	for changed := true; changed; {
+		changed = false
+		for _, f := range h.nodes[ep].friends[level] {
+			if d := h.distance(q, f); d < epDist {
+				ep, epDist, changed = f, d, true
+			}
+		}
+	}
+	return ep, epDist
+}
+
+//searchLayer 在第level层做ef大小的束搜索，返回按照距离从小到大排序的候选集
+//已经删除的节点也参与遍历，由调用方过滤
+func (h *Index) searchLayer(q []float32, ep uint32, epDist float32, ef int, level int) []candidate {
+	visited := h.getVisited()
+	defer h.visited.Put(visited)
+	visited.mark(ep)
+
+	near := &minHeap{{id: ep, dist: epDist}}
+	far := &maxHeap{{id: ep, dist: epDist}}
+	for near.Len() > 0 {
+		c := heap.Pop(near).(candidate)
+		if c.dist > (*far)[0].dist && far.Len() >= ef {
+			break
+		}
+		n := h.nodes[c.id]
+		if level >= len(n.friends) {
+			continue
+		}
+		for _, f := range n.friends[level] {
+			if visited.marked(f) {
+				continue
+			}
+			visited.mark(f)
+			d := h.distance(q, f)
+			if far.Len() < ef || d < (*far)[0].dist {
+				heap.Push(near, candidate{id: f, dist: d})
+				heap.Push(far, candidate{id: f, dist: d})
+				if far.Len() > ef {
+					heap.Pop(far)
+				}
+			}
+		}
+	}
+	out := make([]candidate, far.Len())
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = heap.Pop(far).(candidate)
+	}
+	return out
+}
+
+//Search 检索和 vec 最相似的k个向量，按照相似度从大到小排序
+func (h *Index) Search(vec []float32, k int) []Result {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.maxLevel < 0 || k <= 0 {
+		return nil
+	}
+	q := normalize(vec)
+	ep := h.entry
+	epDist := h.distance(q, ep)
+	for l := h.maxLevel; l > 0; l-- {
+		ep, epDist = h.greedy(q, ep, epDist, l)
+	}
+	ef := h.conf.EfSearch
+	if ef < k {
+		ef = k
+	}
+	//删除的节点会占用候选集，按照删除比例放大候选集
+	if len(h.keys) > 0 && len(h.nodes) > len(h.keys) {
+		ef = ef * len(h.nodes) / len(h.keys)
+	}
+	candidates := h.searchLayer(q, ep, epDist, ef, 0)
+	results := make([]Result, 0, k)
+	for _, c := range candidates {
+		n := h.nodes[c.id]
+		if n.deleted {
+			continue
+		}
+		results = append(results, Result{Key: n.key, Score: 1 - c.dist})
+		if len(results) >= k {
+			break
+		}
+	}
+	return results
+}
+
+//Compact 重建索引，去掉已经删除的节点
+func (h *Index) Compact() *Index {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	c := New(h.conf)
+	for _, n := range h.nodes {
+		if !n.deleted {
+			c.Insert(n.key, n.vec)
+		}
+	}
+	return c
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
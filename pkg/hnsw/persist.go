@@ -0,0 +1,172 @@
+package hnsw
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+var magic = [4]byte{'H', 'N', 'S', 'W'}
+
+const formatVersion = 1
+
+type writer struct {
+	w   *bufio.Writer
+	err error
+	buf [8]byte
+}
+
+func (w *writer) u32(v uint32) {
+	if w.err != nil {
+		return
+	}
+	binary.LittleEndian.PutUint32(w.buf[:4], v)
+	_, w.err = w.w.Write(w.buf[:4])
+}
+
+func (w *writer) bytes(b []byte) {
+	w.u32(uint32(len(b)))
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.w.Write(b)
+}
+
+type reader struct {
+	r   *bufio.Reader
+	err error
+	buf [8]byte
+}
+
+func (r *reader) u32() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	_, r.err = io.ReadFull(r.r, r.buf[:4])
+	return binary.LittleEndian.Uint32(r.buf[:4])
+}
+
+func (r *reader) bytes(limit uint32) []byte {
+	n := r.u32()
+	if r.err != nil {
+		return nil
+	}
+	if n > limit {
+		r.err = errors.Errorf("length %d exceeds limit %d", n, limit)
+		return nil
+	}
+	b := make([]byte, n)
+	_, r.err = io.ReadFull(r.r, b)
+	return b
+}
+
+//Save 把索引写入w，包括参数、向量和图结构
+func (h *Index) Save(out io.Writer) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	w := &writer{w: bufio.NewWriterSize(out, 1<<20)}
+	if _, err := w.w.Write(magic[:]); err != nil {
+		return errors.Wrap(err, "write hnsw header failed")
+	}
+	w.u32(formatVersion)
+	w.u32(uint32(h.conf.M))
+	w.u32(uint32(h.conf.EfConstruction))
+	w.u32(uint32(h.conf.EfSearch))
+	w.u32(uint32(len(h.nodes)))
+	w.u32(h.entry)
+	w.u32(uint32(h.maxLevel + 1))
+	for _, n := range h.nodes {
+		w.bytes([]byte(n.key))
+		deleted := uint32(0)
+		if n.deleted {
+			deleted = 1
+		}
+		w.u32(deleted)
+		w.u32(uint32(len(n.vec)))
+		for _, x := range n.vec {
+			w.u32(math.Float32bits(x))
+		}
+		w.u32(uint32(len(n.friends)))
+		for _, l := range n.friends {
+			w.u32(uint32(len(l)))
+			for _, f := range l {
+				w.u32(f)
+			}
+		}
+	}
+	if w.err != nil {
+		return errors.Wrap(w.err, "write hnsw index failed")
+	}
+	return errors.Wrap(w.w.Flush(), "flush hnsw index failed")
+}
+
+//Load 从r中读取 Save 保存的索引
+func Load(in io.Reader) (*Index, error) {
+	r := &reader{r: bufio.NewReaderSize(in, 1<<20)}
+	var m [4]byte
+	if _, err := io.ReadFull(r.r, m[:]); err != nil || m != magic {
+		return nil, errors.New("not a hnsw index")
+	}
+	if v := r.u32(); v != formatVersion {
+		return nil, errors.Errorf("unsupported hnsw format version %d", v)
+	}
+	conf := Config{Seed: DefaultConfig.Seed}
+	conf.M = int(r.u32())
+	conf.EfConstruction = int(r.u32())
+	conf.EfSearch = int(r.u32())
+	count := r.u32()
+	entry := r.u32()
+	levels := r.u32()
+	if r.err != nil {
+		return nil, errors.Wrap(r.err, "read hnsw header failed")
+	}
+	h := New(conf)
+	h.nodes = make([]*node, 0, count)
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		n := &node{key: string(r.bytes(1 << 16))}
+		n.deleted = r.u32() == 1
+		dim := r.u32()
+		if dim > 1<<16 {
+			return nil, errors.Errorf("invalid dimension %d", dim)
+		}
+		n.vec = make([]float32, dim)
+		for k := range n.vec {
+			n.vec[k] = math.Float32frombits(r.u32())
+		}
+		nl := r.u32()
+		if nl > levels {
+			return nil, errors.Errorf("invalid level %d of node %d", nl, i)
+		}
+		n.friends = make([][]uint32, nl)
+		for l := range n.friends {
+			fc := r.u32()
+			if fc > uint32(2*conf.M+1) {
+				return nil, errors.Errorf("invalid friend count %d of node %d", fc, i)
+			}
+			n.friends[l] = make([]uint32, fc)
+			for k := range n.friends[l] {
+				f := r.u32()
+				if f >= count {
+					return nil, errors.Errorf("invalid friend %d of node %d", f, i)
+				}
+				n.friends[l][k] = f
+			}
+		}
+		h.nodes = append(h.nodes, n)
+		if !n.deleted {
+			h.keys[n.key] = i
+		}
+	}
+	if r.err != nil {
+		return nil, errors.Wrap(r.err, "read hnsw index failed")
+	}
+	if count > 0 && entry >= count {
+		return nil, errors.Errorf("invalid entry point %d", entry)
+	}
+	h.entry = entry
+	h.maxLevel = int(levels) - 1
+	return h, nil
+}
@@ -0,0 +1,335 @@
+//Package keyring 数据落盘加密，使用 AES-256-GCM
+//密钥来自本地密钥文件或者环境变量，每个密钥有一个标识，加密的数据中记录密钥标识，
+//轮换密钥时旧密钥继续用于解密，新数据用当前密钥加密
+package keyring
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+//EnvKeys 保存密钥的环境变量，内容和密钥文件相同，多个密钥也可以用分号分隔
+const EnvKeys = "FACESERVER_KEYS"
+
+//KeySize 密钥长度，AES-256
+const KeySize = 32
+
+//magic 加密数据的开头，之后是1字节的密钥标识长度、密钥标识、12字节的 nonce 和密文
+var magic = []byte("FSE1")
+
+var (
+	ErrNoKey     = errors.New("data is encrypted but no key is configured")
+	ErrCorrupted = errors.New("encrypted data is corrupted or has been tampered with")
+	ErrPlaintext = errors.New("data is not encrypted but keys are configured")
+)
+
+//UnknownKeyError 数据使用的密钥不在密钥环中
+type UnknownKeyError struct {
+	ID string
+}
+
+func (e *UnknownKeyError) Error() string {
+	return fmt.Sprintf("data is encrypted with unknown key %q", e.ID)
+}
+
+//Keyring 密钥环，nil 表示不加密：写入明文，读到加密的数据时返回 ErrNoKey
+//配置了密钥时读到明文数据返回 ErrPlaintext，除非用 AllowPlaintext 打开了迁移模式
+type Keyring struct {
+	mu     sync.RWMutex
+	keys   map[string]cipher.AEAD
+	active string
+	file   string //密钥文件，Reload 时重新读取
+	plain  bool   //迁移模式，接受明文数据
+}
+
+//Load 读取密钥文件和环境变量 EnvKeys 中的密钥，两者都没有密钥时返回 nil，表示不加密
+//文件每行一个密钥，格式为 <标识>:<base64编码的32字节密钥>，#开头的行是注释
+//active 是加密使用的密钥标识，为空时使用密钥文件中的最后一个密钥（文件为空时使用环境变量中的最后一个）
+func Load(file, active string) (*Keyring, error) {
+	k := &Keyring{file: file}
+	if err := k.load(active); err != nil {
+		return nil, err
+	}
+	if len(k.keys) == 0 {
+		if len(active) > 0 {
+			return nil, errors.Errorf("key %q not found: no key configured", active)
+		}
+		return nil, nil
+	}
+	return k, nil
+}
+
+func (k *Keyring) load(active string) error {
+	keys := make(map[string]cipher.AEAD)
+	last := ""
+	add := func(source string, data string) error {
+		ids, err := parse(source, data, keys)
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 && len(last) == 0 {
+			last = ids[len(ids)-1]
+		}
+		return nil
+	}
+	if len(k.file) > 0 {
+		data, err := ioutil.ReadFile(k.file)
+		if err != nil {
+			return errors.Wrap(err, "read key file failed")
+		}
+		if err = add(k.file, string(data)); err != nil {
+			return err
+		}
+	}
+	if env := os.Getenv(EnvKeys); len(env) > 0 {
+		if err := add(EnvKeys, strings.Replace(env, ";", "\n", -1)); err != nil {
+			return err
+		}
+	}
+	if len(active) == 0 {
+		active = last
+	}
+	if _, ok := keys[active]; !ok && len(keys) > 0 {
+		return errors.Errorf("key %q not found", active)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	k.active = active
+	return nil
+}
+
+//parse 解析密钥，返回按照出现顺序的标识
+func parse(source, data string, keys map[string]cipher.AEAD) ([]string, error) {
+	var ids []string
+	sc := bufio.NewScanner(strings.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 || i > 255 {
+			return nil, errors.Errorf("%s:%d: expect <id>:<base64 key>", source, n)
+		}
+		id := line[:i]
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line[i+1:]))
+		if err != nil || len(raw) != KeySize {
+			return nil, errors.Errorf("%s:%d: key %q must be %d bytes in base64", source, n, id, KeySize)
+		}
+		if _, ok := keys[id]; ok {
+			return nil, errors.Errorf("%s:%d: duplicate key %q", source, n, id)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keys[id] = aead
+		ids = append(ids, id)
+	}
+	return ids, sc.Err()
+}
+
+//Generate 生成一个随机密钥，返回密钥文件中的一行
+func Generate(id string) (string, error) {
+	if len(id) == 0 || len(id) > 255 || strings.ContainsAny(id, ": \t\r\n;#") {
+		return "", errors.Errorf("invalid key id %q", id)
+	}
+	raw := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return "", err
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(raw), nil
+}
+
+//Reload 重新读取密钥并把加密使用的密钥设置为 active，用于不停机轮换密钥
+//新的密钥环必须包含所有旧的密钥，否则已经加密的数据无法读取
+func (k *Keyring) Reload(active string) error {
+	old := k.IDs()
+	n := &Keyring{file: k.file}
+	if err := n.load(active); err != nil {
+		return err
+	}
+	for _, id := range old {
+		if _, ok := n.keys[id]; !ok {
+			return errors.Errorf("key %q is missing, data encrypted with it could not be read", id)
+		}
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = n.keys
+	k.active = n.active
+	return nil
+}
+
+//AllowPlaintext 迁移模式：接受配置密钥以前写入的明文数据，全部重新加密以后应当关闭
+//缺省不接受，否则加密的文件可以被替换为伪造的明文
+func (k *Keyring) AllowPlaintext(allow bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.plain = allow
+}
+
+//Active 加密使用的密钥标识，nil 时为空
+func (k *Keyring) Active() string {
+	if k == nil {
+		return ""
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+//IDs 所有密钥的标识，按照字母排序
+func (k *Keyring) IDs() []string {
+	if k == nil {
+		return nil
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+//Sealed 数据是否是加密的格式
+func Sealed(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+//KeyID 加密数据使用的密钥标识，明文返回空
+func KeyID(data []byte) string {
+	if !Sealed(data) || len(data) < len(magic)+1 {
+		return ""
+	}
+	n := int(data[len(magic)])
+	if len(data) < len(magic)+1+n {
+		return ""
+	}
+	return string(data[len(magic)+1 : len(magic)+1+n])
+}
+
+//LineKeyID SealLine 加密的行使用的密钥标识，明文或者无法解码的行返回空
+func LineKeyID(line []byte) string {
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(data, line)
+	if err != nil {
+		return ""
+	}
+	return KeyID(data[:n])
+}
+
+//Seal 用当前密钥加密，aad 是额外认证的数据（比如文件名），解密时必须相同，nil 时原样返回
+func (k *Keyring) Seal(plain, aad []byte) ([]byte, error) {
+	if k == nil {
+		return plain, nil
+	}
+	k.mu.RLock()
+	id, aead := k.active, k.keys[k.active]
+	k.mu.RUnlock()
+	header := make([]byte, 0, len(magic)+1+len(id)+aead.NonceSize())
+	header = append(header, magic...)
+	header = append(header, byte(len(id)))
+	header = append(header, id...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "generate nonce failed")
+	}
+	out := make([]byte, 0, len(header)+len(nonce)+len(plain)+aead.Overhead())
+	out = append(out, header...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plain, append(header, aad...)), nil
+}
+
+//Open 解密 Seal 的结果，同时返回数据使用的密钥标识（明文为空）
+//明文在 k 为 nil 或者迁移模式时原样返回，否则返回 ErrPlaintext
+//数据使用的密钥不在密钥环中时返回 *UnknownKeyError
+func (k *Keyring) Open(data, aad []byte) ([]byte, string, error) {
+	if !Sealed(data) {
+		if k != nil {
+			k.mu.RLock()
+			plain := k.plain
+			k.mu.RUnlock()
+			if !plain {
+				return nil, "", ErrPlaintext
+			}
+		}
+		return data, "", nil
+	}
+	if k == nil {
+		return nil, KeyID(data), ErrNoKey
+	}
+	if len(data) < len(magic)+1 {
+		return nil, "", ErrCorrupted
+	}
+	n := int(data[len(magic)])
+	if len(data) < len(magic)+1+n {
+		return nil, "", ErrCorrupted
+	}
+	id := string(data[len(magic)+1 : len(magic)+1+n])
+	k.mu.RLock()
+	aead, ok := k.keys[id]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, id, &UnknownKeyError{ID: id}
+	}
+	header := data[:len(magic)+1+n]
+	rest := data[len(header):]
+	if len(rest) < aead.NonceSize()+aead.Overhead() {
+		return nil, id, ErrCorrupted
+	}
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], append(append([]byte(nil), header...), aad...))
+	if err != nil {
+		return nil, id, ErrCorrupted
+	}
+	return plain, id, nil
+}
+
+//SealLine 加密按行追加的日志中的一行：Seal 以后 base64 编码，结果不包含换行；k 为 nil 时原样返回
+func (k *Keyring) SealLine(line, aad []byte) ([]byte, error) {
+	if k == nil {
+		return line, nil
+	}
+	sealed, err := k.Seal(line, aad)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(out, sealed)
+	return out, nil
+}
+
+//OpenLine 解密 SealLine 的结果，json 格式的明文行和 Open 的明文一样处理
+func (k *Keyring) OpenLine(line, aad []byte) ([]byte, error) {
+	if len(line) > 0 && line[0] == '{' {
+		plain, _, err := k.Open(line, aad)
+		return plain, err
+	}
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(data, line)
+	if err != nil || !Sealed(data[:n]) {
+		return nil, ErrCorrupted
+	}
+	plain, _, err := k.Open(data[:n], aad)
+	return plain, err
+}
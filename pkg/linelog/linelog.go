@@ -0,0 +1,145 @@
+//Package linelog 按行追加的 json 日志（识别事件、考勤记录、核验审计日志）的读取和重写
+//配置了密钥时每行用 keyring.SealLine 加密，文件名作为额外认证的数据
+package linelog
+
+import (
+	"bufio"
+	"bytes"
+	"faceserver/pkg/keyring"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+//MaxLine 一行的最大长度，缩略图经过加密和 base64 编码以后一行可能超过64K
+const MaxLine = 1 << 20
+
+//Purged 从一个文件中删除的行
+type Purged struct {
+	File  string
+	Count int
+	Torn  int //同时删除的无法解析的行（进程崩溃时写了一半），无法知道属于哪个人员
+}
+
+//Scan 按顺序读取文件，fn 的 line 是文件中的原始行（不包括换行），data 是解密以后的内容，文件不存在时不调用 fn
+//进程崩溃时最后一行可能不完整，无法解密的行 data 为 nil；密钥不对或者配置了密钥但是行是明文时返回错误
+func Scan(keys *keyring.Keyring, name string, fn func(line, data []byte)) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "open %s failed", filepath.Base(name))
+	}
+	defer f.Close()
+	aad := []byte(filepath.Base(name))
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), MaxLine)
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		data, err := keys.OpenLine(line, aad)
+		if err == keyring.ErrCorrupted {
+			fn(line, nil)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "decrypt %s failed", filepath.Base(name))
+		}
+		fn(line, data)
+	}
+	return errors.Wrapf(sc.Err(), "read %s failed", filepath.Base(name))
+}
+
+//Rewrite 只保留 keep 返回 true 的行，有行被删除时用 Replace 替换文件，返回删除的行数
+//调用方负责关闭追加用的文件，并且在返回以前不能追加
+func Rewrite(keys *keyring.Keyring, name string, keep func(line, data []byte) bool) (int, error) {
+	var kept []byte
+	n := 0
+	err := Scan(keys, name, func(line, data []byte) {
+		if !keep(line, data) {
+			n++
+			return
+		}
+		kept = append(append(kept, line...), '\n')
+	})
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	if err = Replace(name, kept); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+//Reseal 用当前密钥重新加密不是当前密钥加密的行（包括迁移模式下接受的明文行），有这样的行时用 Replace 替换文件；
+//无法解密的行（进程崩溃时写了一半的最后一行）同时删除，否则旧密钥删除以后整个文件无法读取
+//返回是否重写了文件以及删除的行数，调用方负责关闭追加用的文件，并且在返回以前不能追加
+func Reseal(keys *keyring.Keyring, name string) (bool, int, error) {
+	active := keys.Active()
+	aad := []byte(filepath.Base(name))
+	var out []byte
+	var serr error
+	stale, dropped := false, 0
+	err := Scan(keys, name, func(line, data []byte) {
+		if serr != nil {
+			return
+		}
+		if data == nil {
+			stale = true
+			dropped++
+			return
+		}
+		if keyring.LineKeyID(line) != active {
+			stale = true
+			if line, serr = keys.SealLine(data, aad); serr != nil {
+				return
+			}
+		}
+		out = append(append(out, line...), '\n')
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil || !stale {
+		return false, 0, err
+	}
+	if err = Replace(name, out); err != nil {
+		return false, 0, err
+	}
+	return true, dropped, nil
+}
+
+//Replace 把 data 写入临时文件并落盘，改名覆盖 name 以后目录落盘，
+//掉电以后文件要么是原来的内容，要么是新的内容
+func Replace(name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "create %s failed", filepath.Base(tmp))
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "write %s failed", filepath.Base(tmp))
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "replace %s failed", filepath.Base(name))
+	}
+	d, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return errors.Wrapf(err, "sync %s failed", filepath.Dir(name))
+	}
+	defer d.Close()
+	return errors.Wrapf(d.Sync(), "sync %s failed", filepath.Dir(name))
+}
@@ -0,0 +1,217 @@
+//Package matrix 两组人脸特征之间的相似度矩阵，纯go实现
+//特征归一化以后按行连续存放，内积即余弦相似度；按照行和列分块，每次用 B 的一行同时和 A 的四行计算，
+//B 的块留在缓存中被 A 的所有行重复使用，多个协程按照行分工
+package matrix
+
+import (
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+//ErrDim 特征的长度不一致
+var ErrDim = errors.New("vectors have different dimensions")
+
+//分块大小：rowBlock 行 A 和 colBlock 行 B 一起计算，256维时 B 的块为 64KB
+const (
+	rowBlock = 4
+	colBlock = 64
+)
+
+//Matrix 归一化以后的特征，每行一个
+type Matrix struct {
+	Rows int
+	Dim  int
+	data []float32
+}
+
+//New 把特征归一化以后连续存放，所有特征的长度必须相同
+func New(vectors [][]float32) (*Matrix, error) {
+	m := &Matrix{Rows: len(vectors)}
+	if len(vectors) == 0 {
+		return m, nil
+	}
+	m.Dim = len(vectors[0])
+	m.data = make([]float32, len(vectors)*m.Dim)
+	for i, v := range vectors {
+		if len(v) != m.Dim {
+			return nil, ErrDim
+		}
+		var sum float64
+		for _, x := range v {
+			sum += float64(x) * float64(x)
+		}
+		if sum == 0 {
+			continue
+		}
+		n := float32(math.Sqrt(sum))
+		row := m.Row(i)
+		for k, x := range v {
+			row[k] = x / n
+		}
+	}
+	return m, nil
+}
+
+//Row 第i行
+func (m *Matrix) Row(i int) []float32 {
+	return m.data[i*m.Dim : (i+1)*m.Dim : (i+1)*m.Dim]
+}
+
+//Dot 两个等长向量的内积，四路累加
+func Dot(a, b []float32) float32 {
+	b = b[:len(a)]
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		x, y := a[i:i+4:i+4], b[i:i+4:i+4]
+		s0 += x[0] * y[0]
+		s1 += x[1] * y[1]
+		s2 += x[2] * y[2]
+		s3 += x[3] * y[3]
+	}
+	for ; i < len(a); i++ {
+		s0 += a[i] * b[i]
+	}
+	return s0 + s1 + s2 + s3
+}
+
+//dot4 b 和 a0..a3 的内积，b 的每个元素只读取一次
+func dot4(a0, a1, a2, a3, b []float32) (float32, float32, float32, float32) {
+	n := len(b)
+	a0, a1, a2, a3 = a0[:n], a1[:n], a2[:n], a3[:n]
+	var s0, s1, s2, s3 float32
+	for k, v := range b {
+		s0 += a0[k] * v
+		s1 += a1[k] * v
+		s2 += a2[k] * v
+		s3 += a3[k] * v
+	}
+	return s0, s1, s2, s3
+}
+
+//block 计算 A 的 [r0,r1) 行和 B 的所有行的内积，第i行第j列写入 out[(i-r0)*b.Rows+j]
+func block(a, b *Matrix, r0, r1 int, out []float32) {
+	cols := b.Rows
+	for c0 := 0; c0 < cols; c0 += colBlock {
+		c1 := c0 + colBlock
+		if c1 > cols {
+			c1 = cols
+		}
+		i := r0
+		for ; i+rowBlock <= r1; i += rowBlock {
+			a0, a1, a2, a3 := a.Row(i), a.Row(i+1), a.Row(i+2), a.Row(i+3)
+			o := (i - r0) * cols
+			for j := c0; j < c1; j++ {
+				s0, s1, s2, s3 := dot4(a0, a1, a2, a3, b.Row(j))
+				out[o+j] = s0
+				out[o+cols+j] = s1
+				out[o+2*cols+j] = s2
+				out[o+3*cols+j] = s3
+			}
+		}
+		for ; i < r1; i++ {
+			ai := a.Row(i)
+			o := (i - r0) * cols
+			for j := c0; j < c1; j++ {
+				out[o+j] = Dot(ai, b.Row(j))
+			}
+		}
+	}
+}
+
+//parallel 按照 step 行一段把 A 的行分给多个协程，fn 处理 [r0,r1) 行
+func parallel(rows, step int, fn func(r0, r1 int)) {
+	workers := runtime.NumCPU()
+	if n := (rows + step - 1) / step; n < workers {
+		workers = n
+	}
+	var next int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				r0 := next
+				next += step
+				mu.Unlock()
+				if r0 >= rows {
+					return
+				}
+				r1 := r0 + step
+				if r1 > rows {
+					r1 = rows
+				}
+				fn(r0, r1)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+//Scores A 的每一行和 B 的每一行的余弦相似度，按行存放，长度为 a.Rows*b.Rows
+func Scores(a, b *Matrix) ([]float32, error) {
+	if a.Rows > 0 && b.Rows > 0 && a.Dim != b.Dim {
+		return nil, ErrDim
+	}
+	out := make([]float32, a.Rows*b.Rows)
+	if len(out) == 0 {
+		return out, nil
+	}
+	parallel(a.Rows, 4*rowBlock, func(r0, r1 int) {
+		block(a, b, r0, r1, out[r0*b.Rows:r1*b.Rows])
+	})
+	return out, nil
+}
+
+//Match 一行中的一个结果
+type Match struct {
+	Col   int
+	Score float32
+}
+
+//TopK A 的每一行在 B 中最相似的k行，只保留相似度不低于 threshold 的结果，按照相似度从大到小排序
+//不保存完整的矩阵，每个协程只需要 16*b.Rows 的缓冲区
+func TopK(a, b *Matrix, k int, threshold float32) ([][]Match, error) {
+	if a.Rows > 0 && b.Rows > 0 && a.Dim != b.Dim {
+		return nil, ErrDim
+	}
+	result := make([][]Match, a.Rows)
+	if a.Rows == 0 || b.Rows == 0 || k <= 0 {
+		return result, nil
+	}
+	const step = 4 * rowBlock
+	pool := sync.Pool{New: func() interface{} { return make([]float32, step*b.Rows) }}
+	parallel(a.Rows, step, func(r0, r1 int) {
+		buf := pool.Get().([]float32)
+		defer pool.Put(buf)
+		block(a, b, r0, r1, buf)
+		for i := r0; i < r1; i++ {
+			result[i] = selectTop(buf[(i-r0)*b.Rows:(i-r0+1)*b.Rows], k, threshold)
+		}
+	})
+	return result, nil
+}
+
+//selectTop 一行中最大的k个分数，k 通常很小，用有序数组插入
+func selectTop(row []float32, k int, threshold float32) []Match {
+	top := make([]Match, 0, k)
+	for j, s := range row {
+		if s < threshold || (len(top) == k && s <= top[k-1].Score) {
+			continue
+		}
+		n := sort.Search(len(top), func(i int) bool { return top[i].Score < s })
+		if len(top) < k {
+			top = append(top, Match{})
+		}
+		copy(top[n+1:], top[n:])
+		top[n] = Match{Col: j, Score: s}
+	}
+	return top
+}
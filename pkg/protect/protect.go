@@ -0,0 +1,197 @@
+//Package protect 可撤销的人脸模板：用密钥生成随机投影矩阵，特征投影以后只保留符号，
+//得到由 ±1 组成的模板。两个模板的余弦相似度等于 1-2*汉明距离/位数，近似反映原始特征之间的夹角，
+//所以保护以后的模板仍然可以直接比对、检索，但是无法还原原始特征；
+//更换密钥以后新旧模板之间没有相关性，泄露的旧模板随之作废
+package protect
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"faceserver/pkg/matrix"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+//SecretSize 密钥长度，可以用 faceserver keygen 生成
+const SecretSize = 32
+
+//DefaultBits 模板的默认位数，位数越多精度损失越小，模板越大
+const DefaultBits = 1024
+
+//Any 密钥文件中匹配所有其他租户的标识
+const Any = "*"
+
+//DefaultTenant 请求没有指定图库时的租户
+const DefaultTenant = "default"
+
+//Transform 一个密钥的变换
+type Transform struct {
+	ID   string //密钥的指纹，写入模板的模型版本，区分不同密钥生成的模板
+	Bits int
+
+	key   []byte
+	mu    sync.Mutex
+	projs map[int][]float32 //每种特征长度的投影矩阵，Bits 行，第一次使用时生成
+}
+
+//New 用密钥创建变换，密钥本身不会出现在模板和版本中
+func New(secret []byte, bits int) (*Transform, error) {
+	if len(secret) != SecretSize {
+		return nil, errors.Errorf("secret must be %d bytes", SecretSize)
+	}
+	if bits <= 0 || bits%8 != 0 {
+		return nil, errors.Errorf("invalid bits %d: must be a positive multiple of 8", bits)
+	}
+	t := &Transform{Bits: bits, key: derive(secret, "projection"), projs: make(map[int][]float32)}
+	t.ID = hex.EncodeToString(derive(secret, "fingerprint")[:6])
+	return t, nil
+}
+
+func derive(secret []byte, label string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("faceserver/protect/" + label))
+	return h.Sum(nil)
+}
+
+//Version 模板的模型版本：原始模型版本加上位数和密钥指纹，
+//不同密钥、不同位数的模板以及原始特征之间版本不同，不能比较
+func (t *Transform) Version(model string) string {
+	return model + "+bio" + strconv.Itoa(t.Bits) + ":" + t.ID
+}
+
+//projection 特征长度为 dim 时的投影矩阵，元素是密钥流生成的标准正态分布随机数
+func (t *Transform) projection(dim int) []float32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.projs[dim]; ok {
+		return p
+	}
+	block, _ := aes.NewCipher(t.key)
+	iv := make([]byte, aes.BlockSize)
+	binary.LittleEndian.PutUint32(iv, uint32(dim))
+	binary.LittleEndian.PutUint32(iv[4:], uint32(t.Bits))
+	stream := cipher.NewCTR(block, iv)
+	p := make([]float32, t.Bits*dim)
+	buf := make([]byte, 8)
+	for i := 0; i < len(p); i += 2 {
+		for k := range buf {
+			buf[k] = 0
+		}
+		stream.XORKeyStream(buf, buf)
+		//Box-Muller，u1 取 (0,1] 避免 log(0)
+		u1 := (float64(binary.LittleEndian.Uint32(buf)) + 1) / (1 << 32)
+		u2 := float64(binary.LittleEndian.Uint32(buf[4:])) / (1 << 32)
+		r := math.Sqrt(-2 * math.Log(u1))
+		p[i] = float32(r * math.Cos(2*math.Pi*u2))
+		if i+1 < len(p) {
+			p[i+1] = float32(r * math.Sin(2*math.Pi*u2))
+		}
+	}
+	t.projs[dim] = p
+	return p
+}
+
+//Apply 把原始特征变换为 Bits 维的 ±1 模板
+func (t *Transform) Apply(m []float32) []float32 {
+	dim := len(m)
+	p := t.projection(dim)
+	out := make([]float32, t.Bits)
+	for j := range out {
+		if matrix.Dot(p[j*dim:(j+1)*dim], m) >= 0 {
+			out[j] = 1
+		} else {
+			out[j] = -1
+		}
+	}
+	return out
+}
+
+//Valid m 是否可能是 Apply 生成的模板：Bits 维并且每一维都是 ±1
+func (t *Transform) Valid(m []float32) bool {
+	if len(m) != t.Bits {
+		return false
+	}
+	for _, v := range m {
+		if v != 1 && v != -1 {
+			return false
+		}
+	}
+	return true
+}
+
+//Set 每个租户（图库）的变换，nil 表示不保护
+type Set struct {
+	tenants map[string]*Transform
+	any     *Transform
+}
+
+//Load 读取密钥文件，文件为空时返回 nil
+//每行一个租户，格式为 <图库名称>:<base64编码的32字节密钥>，图库名称为 * 时用于没有列出的图库，#开头的行是注释
+//没有指定图库的请求使用 default 图库的密钥
+func Load(file string, bits int) (*Set, error) {
+	if len(file) == 0 {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "read protect key file failed")
+	}
+	s := &Set{tenants: make(map[string]*Transform)}
+	sc := bufio.NewScanner(strings.NewReader(string(data)))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, errors.Errorf("%s:%d: expect <gallery>:<base64 secret>", file, n)
+		}
+		tenant := line[:i]
+		secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, errors.Errorf("%s:%d: invalid base64 secret", file, n)
+		}
+		t, err := New(secret, bits)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", file, n)
+		}
+		if _, ok := s.tenants[tenant]; ok || (tenant == Any && s.any != nil) {
+			return nil, errors.Errorf("%s:%d: duplicate gallery %q", file, n, tenant)
+		}
+		if tenant == Any {
+			s.any = t
+		} else {
+			s.tenants[tenant] = t
+		}
+	}
+	if len(s.tenants) == 0 && s.any == nil {
+		return nil, errors.Errorf("%s: no secret", file)
+	}
+	return s, nil
+}
+
+//For 租户使用的变换，没有配置时返回 nil
+func (s *Set) For(tenant string) *Transform {
+	if s == nil {
+		return nil
+	}
+	if len(tenant) == 0 {
+		tenant = DefaultTenant
+	}
+	if t, ok := s.tenants[tenant]; ok {
+		return t
+	}
+	return s.any
+}
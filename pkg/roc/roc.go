@@ -0,0 +1,177 @@
+//Package roc 由同一人（genuine）和不同人（impostor）的比对分数计算 ROC/DET 曲线、EER
+//以及指定误识率（FAR）下的阈值
+//约定分数越大越相似，分数不低于阈值判定为同一人
+package roc
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+//Histogram 分数的分布
+type Histogram struct {
+	Min    float64 `json:"min"`
+	Width  float64 `json:"width"`
+	Counts []int   `json:"counts"` //第i个区间为 [Min+i*Width, Min+(i+1)*Width)
+}
+
+//Stats 一组分数的统计
+type Stats struct {
+	Count int       `json:"count"`
+	Mean  float64   `json:"mean"`
+	Std   float64   `json:"std"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Hist  Histogram `json:"hist"`
+}
+
+//Point ROC/DET 曲线上的一个点
+type Point struct {
+	Threshold float64 `json:"threshold"`
+	FAR       float64 `json:"far"` //不同人的分数不低于阈值的比例
+	FRR       float64 `json:"frr"` //同一人的分数低于阈值的比例，TAR=1-FRR
+}
+
+//Operating 指定误识率下的工作点
+type Operating struct {
+	TargetFAR float64 `json:"target_far"`
+	Threshold float64 `json:"threshold"`
+	FAR       float64 `json:"far"` //阈值下实际的误识率
+	TAR       float64 `json:"tar"`
+	Reliable  bool    `json:"reliable"` //不同人的比对次数足够多（目标误识率下至少有10次误识），结果才可信
+}
+
+//Report 统计结果
+type Report struct {
+	Genuine      Stats       `json:"genuine"`
+	Impostor     Stats       `json:"impostor"`
+	EER          float64     `json:"eer"`
+	EERThreshold float64     `json:"eer_threshold"`
+	Operating    []Operating `json:"operating"`
+	Curve        []Point     `json:"-"` //数据较多，用 WriteCurve 单独输出
+}
+
+//曲线上的点之间阈值的间隔
+const curveStep = 0.005
+
+//Compute 计算统计结果，fars 为需要计算阈值的目标误识率
+func Compute(genuine, impostor []float64, fars []float64) (*Report, error) {
+	if len(genuine) == 0 || len(impostor) == 0 {
+		return nil, fmt.Errorf("need both genuine and impostor scores, got %d and %d", len(genuine), len(impostor))
+	}
+	g := append([]float64(nil), genuine...)
+	im := append([]float64(nil), impostor...)
+	sort.Float64s(g)
+	sort.Float64s(im)
+
+	r := &Report{Genuine: stats(g), Impostor: stats(im)}
+	r.EER, r.EERThreshold = eer(g, im)
+	for _, far := range fars {
+		r.Operating = append(r.Operating, operating(g, im, far))
+	}
+	lo := math.Floor(math.Min(g[0], im[0])/curveStep) * curveStep
+	hi := math.Max(g[len(g)-1], im[len(im)-1])
+	for t := lo; t <= hi+curveStep; t += curveStep {
+		r.Curve = append(r.Curve, Point{Threshold: t, FAR: far(im, t), FRR: frr(g, t)})
+	}
+	return r, nil
+}
+
+//far 升序排列的不同人分数中不低于阈值的比例
+func far(im []float64, t float64) float64 {
+	i := sort.SearchFloat64s(im, t)
+	return float64(len(im)-i) / float64(len(im))
+}
+
+//frr 升序排列的同一人分数中低于阈值的比例
+func frr(g []float64, t float64) float64 {
+	return float64(sort.SearchFloat64s(g, t)) / float64(len(g))
+}
+
+//eer 在所有分数作为阈值的位置中寻找 FAR 和 FRR 最接近的点
+func eer(g, im []float64) (float64, float64) {
+	best, rate, threshold := math.Inf(1), 0.0, 0.0
+	try := func(t float64) {
+		a, b := far(im, t), frr(g, t)
+		if d := math.Abs(a - b); d < best {
+			best, rate, threshold = d, (a+b)/2, t
+		}
+	}
+	for _, t := range g {
+		try(t)
+	}
+	for _, t := range im {
+		try(math.Nextafter(t, math.Inf(1)))
+	}
+	return rate, threshold
+}
+
+//operating 误识率不超过目标的最小阈值
+func operating(g, im []float64, target float64) Operating {
+	o := Operating{TargetFAR: target}
+	n := len(im)
+	allowed := int(math.Floor(target * float64(n))) //允许分数不低于阈值的不同人比对次数
+	if allowed >= n {
+		o.Threshold = im[0]
+	} else {
+		//阈值比第 allowed+1 大的不同人分数稍大
+		o.Threshold = math.Nextafter(im[n-1-allowed], math.Inf(1))
+	}
+	o.FAR = far(im, o.Threshold)
+	o.TAR = 1 - frr(g, o.Threshold)
+	o.Reliable = target*float64(n) >= 10
+	return o
+}
+
+func stats(sorted []float64) Stats {
+	s := Stats{Count: len(sorted), Min: sorted[0], Max: sorted[len(sorted)-1]}
+	var sum, sq float64
+	for _, v := range sorted {
+		sum += v
+	}
+	s.Mean = sum / float64(len(sorted))
+	for _, v := range sorted {
+		sq += (v - s.Mean) * (v - s.Mean)
+	}
+	s.Std = math.Sqrt(sq / float64(len(sorted)))
+	s.Hist = Histogram{Min: -1, Width: 0.02, Counts: make([]int, 100)}
+	for _, v := range sorted {
+		i := int((v - s.Hist.Min) / s.Hist.Width)
+		if i < 0 {
+			i = 0
+		}
+		if i >= len(s.Hist.Counts) {
+			i = len(s.Hist.Counts) - 1
+		}
+		s.Hist.Counts[i]++
+	}
+	return s
+}
+
+//probit 标准正态分布的分位数，DET 曲线的坐标轴使用这个变换
+func probit(p float64) float64 {
+	return math.Sqrt2 * math.Erfinv(2*p-1)
+}
+
+//WriteCurve 以 CSV 格式输出 ROC/DET 曲线
+//det_far、det_frr 是 FAR、FRR 的正态分位数，比率为0或1时为空
+func (r *Report) WriteCurve(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "threshold,far,frr,tar,det_far,det_frr"); err != nil {
+		return err
+	}
+	det := func(p float64) string {
+		if p <= 0 || p >= 1 {
+			return ""
+		}
+		return fmt.Sprintf("%.4f", probit(p))
+	}
+	for _, p := range r.Curve {
+		_, err := fmt.Fprintf(w, "%.3f,%g,%g,%g,%s,%s\n", p.Threshold, p.FAR, p.FRR, 1-p.FRR, det(p.FAR), det(p.FRR))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
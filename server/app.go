@@ -2,27 +2,80 @@ package server
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"faceserver/attendance"
+	"faceserver/events"
 	"faceserver/face"
+	"faceserver/gallery"
+	"faceserver/pkg/protect"
 	"faceserver/pkg/shell"
 	"fmt"
 	"github.com/golang/glog"
+	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
 )
 
+//Config 应用程序的配置，由命令行参数填充
+type Config struct {
+	Classes    map[string]face.ClassConfig //各优先级类别的调度参数
+	QueueSize  int                         //每个连接的发送队列长度
+	Policy     string                      //发送队列满了以后的策略：drop 或者 disconnect
+	Restart    int                         //cgo回调连续失败多少次以后重启引擎，0表示不重启
+	Threshold  float64                     //比对的默认阈值，相似度不低于阈值认为是同一个人
+	MaxFaces   int                         //比对时每张照片最多提取的人脸数目
+	DataDir    string                      //数据目录，保存图库等数据
+	TopK       int                         //identify 每张人脸默认返回的候选人员数目
+	Index      gallery.Options             //图库的检索索引
+	ReceiptKey string                      //删除凭证的签名密钥文件，为空时使用数据目录中的 receipt.key
+	Protect    *protect.Set                //每个图库的模板保护密钥，nil 表示保存和返回原始特征
+	Verify     VerifyPolicy                //人证核验的活体、质量和阈值要求
+	Attendance AttendanceConfig            //考勤图库、去重窗口和班次
+	Events     EventsConfig                //识别事件日志
+}
+
 //App  应用程序对象
 type App struct {
-	ws     *server
-	cmd    shell.Server
-	ctx    context.Context
-	cancel context.CancelFunc
+	ws        *server
+	cmd       shell.Server
+	galleries *gallery.Store
+	conf      Config
+	engine    bool //引擎是否已经初始化
+	transfers transfers
+	watch     watchlist        //关注名单的订阅
+	audit     *auditLog        //人证核验的审计日志
+	checkins  *attendance.Book //考勤记录，没有配置考勤图库时为nil
+	eventLog  *events.Store    //compare 和 identify 的识别事件，关闭时为nil
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	receipt ed25519.PrivateKey //删除凭证的签名密钥，启动时读取或者生成
 }
 
 //创建应用程序实例
-func NewApp() *App {
-	app := &App{}
+func NewApp(conf Config) *App {
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = 64
+	}
+	if conf.Policy != PolicyDisconnect {
+		conf.Policy = PolicyDrop
+	}
+	if conf.MaxFaces <= 0 {
+		conf.MaxFaces = 5
+	}
+	if conf.TopK <= 0 {
+		conf.TopK = 5
+	}
+	if len(conf.DataDir) == 0 {
+		conf.DataDir = "data"
+	}
+	app := &App{conf: conf}
 	app.ctx, app.cancel = context.WithCancel(context.Background())
+	//离线命令同样提取特征，模板保护在所有入口都要生效
+	face.GetFaceInstance().SetProtection(conf.Protect)
 	return app
 }
 
@@ -33,17 +86,65 @@ func (app *App) Run(addr string) error {
 			app.ws.close()
 		}
 		face.GetFaceInstance().UnInit()
+		if app.galleries != nil {
+			if err := app.galleries.Close(); err != nil {
+				glog.Errorf("close gallery failed: %+v", err)
+			}
+		}
 
 		if app.cmd != nil {
 			app.cmd.Close()
 		}
+		if app.audit != nil {
+			app.audit.close()
+		}
+		if app.checkins != nil {
+			app.checkins.Close()
+		}
+		if app.eventLog != nil {
+			app.eventLog.Close()
+		}
 	}()
 	//设置人脸特征模块的回调
 	face.GetFaceInstance().OnCompleted = app.onCompleted
+	if app.conf.Classes != nil {
+		face.GetFaceInstance().SetClasses(app.conf.Classes)
+	}
+	face.GetFaceInstance().SetRestartPolicy(app.conf.Restart)
 	err := face.GetFaceInstance().Init()
 	if err != nil {
 		return err
 	}
+	app.engine = true
+
+	//打开图库
+	app.galleries, err = gallery.OpenStore(app.dataDir(), app.conf.Index)
+	if err != nil {
+		return err
+	}
+	for _, info := range app.galleries.List() {
+		glog.V(LVERBOSE).Infof("gallery[%s] opened, %d persons", info.Name, info.Persons)
+		//启用或者更换了模板保护的密钥时版本也不一致，旧模板已经作废
+		version := face.GetFaceInstance().TemplateVersion(info.Name)
+		if len(info.ModelVersion) > 0 && len(version) > 0 && info.ModelVersion != version {
+			glog.Warningf("gallery[%s] model version %s, engine %s, identify is refused until gallery_reenroll %s",
+				info.Name, info.ModelVersion, version, info.Name)
+		}
+	}
+
+	if app.receipt, err = app.loadReceiptKey(); err != nil {
+		return err
+	}
+	app.audit, err = openAudit(app.auditFile(), app.conf.Index.Keys)
+	if err != nil {
+		return err
+	}
+	if err = app.openAttendance(); err != nil {
+		return err
+	}
+	if err = app.openEvents(); err != nil {
+		return err
+	}
 
 	//启动shell
 	app.cmd = shell.NewServer(app)
@@ -52,7 +153,27 @@ func (app *App) Run(addr string) error {
 		return err
 	}
 	//启动websocket server
-	app.ws = newServer(addr)
+	app.ws = newServer(addr, connConfig{QueueSize: app.conf.QueueSize, Policy: app.conf.Policy})
+	app.ws.handle(face.CmdCompare, app.compare)
+	app.ws.handle(face.CmdCompareMatrix, app.compareMatrix)
+	app.ws.handle(face.CmdEnroll, app.enroll)
+	app.ws.handle(face.CmdDelete, app.deletePerson)
+	app.ws.handle(face.CmdGet, app.getPerson)
+	app.ws.handle(face.CmdList, app.listPersons)
+	app.ws.handle(face.CmdIdentify, app.identify)
+	app.ws.handle(face.CmdGalleryCreate, app.createGallery)
+	app.ws.handle(face.CmdGalleryDrop, app.dropGallery)
+	app.ws.handle(face.CmdGalleryList, app.listGalleries)
+	app.ws.handle(face.CmdCluster, app.cluster)
+	app.ws.handle(face.CmdConsistency, app.consistency)
+	app.ws.handle(face.CmdPurge, app.purge)
+	app.ws.handle(face.CmdDedupe, app.dedupe)
+	app.ws.handle(face.CmdMerge, app.merge)
+	app.ws.handle(face.CmdVerify, app.verifyIdentity)
+	app.ws.handle(face.CmdEventsQuery, app.eventsQuery)
+	app.ws.handle(face.CmdSubscribe, app.subscribe)
+	app.ws.handle(face.CmdUnsubscribe, app.unsubscribe)
+	app.ws.closed = func(connId uint32) { app.watch.remove(connId, "") }
 	app.ws.start()
 
 	t := time.NewTicker(time.Second * 30)
@@ -65,14 +186,26 @@ Loop:
 			//%v: print value
 			//%+v:print type:value
 			//%#v:print struct{type:value...}
-			glog.V(LVERBOSE).Infof("\n%s\nnumber of goroutine:%d\n",
+			glog.V(LVERBOSE).Infof("\n%s\n%snumber of goroutine:%d\n",
 				app.ws.State(),
+				face.GetFaceInstance().State(),
 				runtime.NumGoroutine())
 		}
 	}
 	return nil
 }
 
+//数据目录，相对路径相对于程序所在的目录
+func (app *App) dataDir() string {
+	dir := app.conf.DataDir
+	if !filepath.IsAbs(dir) {
+		if exe, err := filepath.Abs(filepath.Dir(os.Args[0])); err == nil {
+			dir = filepath.Join(exe, dir)
+		}
+	}
+	return dir
+}
+
 //结束应用程序
 func (app *App) Quit() {
 	app.cancel()
@@ -80,6 +213,9 @@ func (app *App) Quit() {
 
 //某个请求完成，我们要通知网络模块
 func (app *App) onCompleted(connId uint32, resp face.Response) {
+	if resp.Result == 0 {
+		app.publish(resp.Cmd, resp.Source, resp.Content)
+	}
 	app.ws.send(connId, resp)
 }
 
@@ -91,5 +227,110 @@ func (app *App) OnMessage(cid uint32, message string) {
 			fmt.Printf("write shell message to client[%d] failed\n", cid)
 		}
 		app.Quit()
+		return
+	}
+	if strings.EqualFold(message, "state") {
+		//查询服务器状态，包括各优先级队列的统计数据
+		state := fmt.Sprintf("%s\n%s", app.ws.State(), face.GetFaceInstance().State())
+		if err := app.cmd.Write(cid, state); err != nil {
+			fmt.Printf("write shell message to client[%d] failed\n", cid)
+		}
+		return
+	}
+	//导入导出图库在后台运行，用 gallery_progress 查询进度
+	//文件的相对路径相对于服务器的当前目录（程序所在的目录）
+	var reply string
+	name, arg := splitCommand(message)
+	switch name {
+	case "gallery_import", "gallery_export":
+		op := OpImport
+		if name == "gallery_export" {
+			op = OpExport
+		}
+		//最后一个参数可以是 gallery=<图库名称>，缺省为默认图库
+		file, target := arg, ""
+		if i := strings.LastIndexAny(arg, " \t"); i >= 0 && strings.HasPrefix(arg[i+1:], "gallery=") {
+			file, target = strings.TrimSpace(arg[:i]), strings.TrimPrefix(arg[i+1:], "gallery=")
+		}
+		if len(file) == 0 {
+			reply = "usage: " + name + " <file.jsonl|file.csv> [gallery=<name>]"
+			break
+		}
+		t, err := app.startTransfer(op, file, target)
+		if err != nil {
+			reply = fmt.Sprintf("%s failed: %v", name, err)
+			break
+		}
+		reply = fmt.Sprintf("%s %s started", op, t.File)
+	case "gallery_reenroll":
+		//参数是图库名称，缺省为默认图库
+		t, err := app.startReenroll(arg)
+		if err != nil {
+			reply = fmt.Sprintf("%s failed: %v", name, err)
+			break
+		}
+		reply = fmt.Sprintf("reenroll gallery %s started, model version %s", t.Gallery, face.GetFaceInstance().TemplateVersion(t.Gallery))
+	case "key_rotate":
+		//参数是新的密钥标识，缺省为密钥文件中的最后一个密钥
+		t, err := app.startRotate(arg)
+		if err != nil {
+			reply = fmt.Sprintf("%s failed: %v", name, err)
+			break
+		}
+		reply = fmt.Sprintf("re-encrypting with key %s", t.Gallery)
+	case "keys":
+		reply = app.keysState()
+	case "gallery_progress":
+		reply = app.transfers.String()
+	case "gallery_list":
+		b := strings.Builder{}
+		for _, info := range app.galleries.List() {
+			fmt.Fprintf(&b, "%s persons:%d threshold:%g top_k:%d index:%s fusion:%s model_version:%s fields:%d\n",
+				info.Name, info.Persons, info.Threshold, info.TopK, info.Index, info.Fusion, info.ModelVersion, len(info.Schema))
+		}
+		reply = b.String()
+	case "gallery_consistency":
+		//参数是图库名称，缺省为默认图库，只列出有异常模板的人员
+		reply = app.consistencyText(arg)
+	case "gallery_dedupe":
+		//参数是图库名称，缺省为默认图库，列出可能重复登记的人员对
+		reply = app.dedupeText(arg)
+	case "gallery_merge":
+		reply = app.mergeText(arg)
+	case "purge":
+		//参数是人员标识，输出签名的删除凭证
+		if len(arg) == 0 {
+			reply = "usage: purge <person_id>"
+			break
+		}
+		receipt, err := app.purgePerson(arg)
+		if err != nil {
+			reply = fmt.Sprintf("%s failed: %v", name, err)
+			break
+		}
+		data, _ := json.MarshalIndent(receipt, "", "  ")
+		reply = string(data)
+	case "receipt_key":
+		reply = app.receiptKeyText()
+	case "subscriptions":
+		reply = app.watch.String()
+	case "attendance_daily", "attendance_monthly":
+		reply = app.attendanceText(name, arg)
+	case "attendance":
+		reply = app.attendanceState()
+	default:
+		reply = "unknown command: " + message
+	}
+	if err := app.cmd.Write(cid, reply); err != nil {
+		fmt.Printf("write shell message to client[%d] failed\n", cid)
+	}
+}
+
+//把 shell 命令拆分为命令名和参数
+func splitCommand(message string) (string, string) {
+	message = strings.TrimSpace(message)
+	if i := strings.IndexAny(message, " \t"); i >= 0 {
+		return strings.ToLower(message[:i]), strings.TrimSpace(message[i+1:])
 	}
+	return strings.ToLower(message), ""
 }
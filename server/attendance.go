@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"faceserver/attendance"
+	"faceserver/face"
+	"faceserver/gallery"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+//attendanceDir 数据目录中保存考勤记录的子目录
+const attendanceDir = "attendance"
+
+//AttendanceConfig 考勤配置，Gallery 为空表示不记录考勤
+type AttendanceConfig struct {
+	Gallery  string               //考勤图库，identify 在这个图库中识别到的人员记为打卡
+	Window   time.Duration        //去重时间窗口
+	Settings *attendance.Settings //班次和来源的方向，nil 时使用缺省班次
+}
+
+//openAttendance 打开考勤记录，没有配置考勤图库时不做任何事
+func (app *App) openAttendance() error {
+	conf := app.conf.Attendance
+	if len(conf.Gallery) == 0 {
+		return nil
+	}
+	if _, err := app.galleries.Get(conf.Gallery); err != nil {
+		glog.Warningf("attendance gallery %s: %v", conf.Gallery, err)
+	}
+	book, err := attendance.Open(filepath.Join(app.dataDir(), attendanceDir), conf.Window, conf.Settings, app.conf.Index.Keys)
+	if err != nil {
+		return err
+	}
+	app.checkins = book
+	return nil
+}
+
+//checkIn identify 在考勤图库中的结果记为打卡，每张人脸取相似度最高的候选人员
+func (app *App) checkIn(g *gallery.Gallery, source string, faces []face.FaceFeature) {
+	if app.checkins == nil || g.Config().Name != app.conf.Attendance.Gallery {
+		return
+	}
+	now := time.Now()
+	for _, f := range faces {
+		if len(f.Candidates) == 0 {
+			continue
+		}
+		c := f.Candidates[0]
+		e, err := app.checkins.Record(c.PersonID, c.Meta, source, c.Score, now)
+		if err != nil {
+			glog.V(LERROR).Infof("record attendance of %s failed: %+v", c.PersonID, err)
+			continue
+		}
+		if e != nil {
+			glog.V(LVERBOSE).Infof("attendance %s %s %s score:%.4f", e.PersonID, e.Direction, e.Date, e.Score)
+		}
+	}
+}
+
+//attendancePersons 考勤图库中的所有人员，meta 中的 name 作为报表中的姓名
+func (app *App) attendancePersons() []attendance.Person {
+	g, err := app.galleries.Get(app.conf.Attendance.Gallery)
+	if err != nil {
+		return nil
+	}
+	var persons []attendance.Person
+	for _, id := range g.IDs() {
+		if p, err := g.Get(id); err == nil {
+			persons = append(persons, attendance.Person{ID: id, Name: p.Meta["name"], Meta: p.Meta})
+		}
+	}
+	return persons
+}
+
+//attendanceText shell 命令 attendance_daily 和 attendance_monthly 的参数：[日期或者月份] [file.csv]
+//日期缺省为今天，月份缺省为本月；没有指定文件时直接输出 csv
+func (app *App) attendanceText(name, arg string) string {
+	if app.checkins == nil {
+		return name + " failed: attendance is not enabled, see -attendance_gallery"
+	}
+	args := strings.Fields(arg)
+	if len(args) > 2 {
+		return "usage: " + name + " [date|month] [file.csv]"
+	}
+	period, file := "", ""
+	if len(args) > 0 {
+		period = args[0]
+	}
+	if len(args) > 1 {
+		file = args[1]
+	}
+	buf := bytes.Buffer{}
+	persons := app.attendancePersons()
+	if name == "attendance_daily" {
+		if len(period) == 0 {
+			period = time.Now().Format(attendance.DateLayout)
+		}
+		records, err := app.checkins.Daily(period, persons)
+		if err == nil {
+			err = attendance.WriteDaily(&buf, records)
+		}
+		if err != nil {
+			return fmt.Sprintf("%s failed: %v", name, err)
+		}
+	} else {
+		if len(period) == 0 {
+			period = time.Now().Format(attendance.MonthLayout)
+		}
+		records, err := app.checkins.Monthly(period, persons)
+		if err == nil {
+			err = attendance.WriteMonthly(&buf, records)
+		}
+		if err != nil {
+			return fmt.Sprintf("%s failed: %v", name, err)
+		}
+	}
+	if len(file) == 0 {
+		return buf.String()
+	}
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0600); err != nil {
+		return fmt.Sprintf("%s failed: %v", name, err)
+	}
+	return fmt.Sprintf("%s %s written to %s", name, period, file)
+}
+
+//attendanceState shell 命令 attendance：考勤配置
+func (app *App) attendanceState() string {
+	if app.checkins == nil {
+		return "attendance is not enabled"
+	}
+	s := app.checkins.Settings()
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "gallery:%s window:%v default shift:%s meta field:%s\n",
+		app.conf.Attendance.Gallery, app.checkins.Window(), s.Default, s.MetaField)
+	for _, sh := range s.Shifts {
+		fmt.Fprintf(&b, "shift %s %s-%s late_grace:%dm early_grace:%dm\n", sh.Name, sh.Start, sh.End, sh.LateGrace, sh.EarlyGrace)
+	}
+	for src, dir := range s.Sources {
+		fmt.Fprintf(&b, "source %s %s\n", src, dir)
+	}
+	return b.String()
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"faceserver/face"
+	"faceserver/gallery"
+	"faceserver/pkg/roc"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//CalibrateConfig calibrate 命令的参数
+type CalibrateConfig struct {
+	Dir         string    //已标注的身份目录，每个子目录是一个人，其中是这个人的照片
+	FARs        []float64 //需要计算阈值的目标误识率
+	Out         string    //完整结果的 json 文件，为空时不输出
+	Curve       string    //ROC/DET 曲线的 csv 文件，为空时不输出
+	Gallery     string    //把阈值写入这个图库的配置，为空时不写
+	ApplyFAR    float64   //写入图库的阈值对应的误识率
+	Force       bool      //比对次数不足以估计 ApplyFAR 时仍然写入
+	MaxImpostor int       //最多计算的不同人比对次数，超过时随机抽样
+}
+
+//CalibrateReport calibrate 命令的完整结果
+type CalibrateReport struct {
+	Dir        string            `json:"dir"`
+	Identities int               `json:"identities"`
+	Images     int               `json:"images"`
+	Failed     map[string]string `json:"failed,omitempty"` //没有提取到特征的照片以及原因
+	*roc.Report
+}
+
+//labeled 一张照片的特征和身份
+type labeled struct {
+	identity int
+	metric   []float32
+}
+
+//labeledImage 一张照片的路径和身份
+type labeledImage struct {
+	identity int
+	path     string
+}
+
+//RunCalibrate 用已标注身份的照片校准比对阈值：
+//同一身份的照片两两比对得到 genuine 分数，不同身份的照片两两比对得到 impostor 分数，
+//由两组分数计算 EER 以及目标误识率下的阈值，可以把结果写入图库的配置
+func (app *App) RunCalibrate(conf CalibrateConfig) error {
+	dir, err := filepath.Abs(conf.Dir)
+	if err != nil {
+		return err
+	}
+	if conf.ApplyFAR > 0 && !containsFloat(conf.FARs, conf.ApplyFAR) {
+		conf.FARs = append(conf.FARs, conf.ApplyFAR)
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(conf.FARs)))
+	for _, name := range []*string{&conf.Out, &conf.Curve} {
+		if len(*name) > 0 {
+			if *name, err = filepath.Abs(*name); err != nil {
+				return err
+			}
+		}
+	}
+	identities, images, err := listIdentities(dir)
+	if err != nil {
+		return err
+	}
+	if len(identities) < 2 {
+		return errors.Errorf("%s: need at least 2 identities, got %d", dir, len(identities))
+	}
+
+	if err = face.GetFaceInstance().Init(); err != nil {
+		return err
+	}
+	defer face.GetFaceInstance().UnInit()
+	app.engine = true
+
+	report := &CalibrateReport{Dir: dir, Identities: len(identities), Images: len(images), Failed: make(map[string]string)}
+	samples := app.extractLabeled(app.ctx, conf.Gallery, images, report.Failed)
+	if err = app.ctx.Err(); err != nil {
+		return err
+	}
+	genuine, impostor := scorePairs(samples, conf.MaxImpostor)
+	report.Report, err = roc.Compute(genuine, impostor, conf.FARs)
+	if err != nil {
+		return err
+	}
+	printCalibration(report)
+
+	if len(conf.Out) > 0 {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(conf.Out, data, 0644); err != nil {
+			return errors.Wrapf(err, "write %s failed", conf.Out)
+		}
+	}
+	if len(conf.Curve) > 0 {
+		f, err := os.Create(conf.Curve)
+		if err != nil {
+			return err
+		}
+		err = report.WriteCurve(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return errors.Wrapf(err, "write %s failed", conf.Curve)
+		}
+	}
+	if len(conf.Gallery) > 0 {
+		return app.applyCalibration(conf, report)
+	}
+	return nil
+}
+
+//applyCalibration 把 ApplyFAR 下的阈值和校准摘要写入图库的配置
+//服务器运行时读取的是内存中的配置，写入以后需要重启服务器才会生效
+func (app *App) applyCalibration(conf CalibrateConfig, report *CalibrateReport) error {
+	var op *roc.Operating
+	for i := range report.Operating {
+		if report.Operating[i].TargetFAR == conf.ApplyFAR {
+			op = &report.Operating[i]
+		}
+	}
+	if op == nil {
+		return errors.New("apply_far is required to write the gallery config")
+	}
+	if !op.Reliable && !conf.Force {
+		return errors.Errorf("%d impostor pairs are too few to estimate FAR %g, threshold not applied",
+			report.Impostor.Count, conf.ApplyFAR)
+	}
+	store, err := gallery.OpenStore(app.dataDir(), app.conf.Index)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	g, err := store.Get(conf.Gallery)
+	if err != nil {
+		return errors.Wrap(err, conf.Gallery)
+	}
+	c := &gallery.Calibration{
+		Time:         time.Now(),
+		Source:       report.Dir,
+		Genuine:      report.Genuine.Count,
+		Impostor:     report.Impostor.Count,
+		EER:          report.EER,
+		EERThreshold: report.EERThreshold,
+		TargetFAR:    conf.ApplyFAR,
+	}
+	for _, o := range report.Operating {
+		c.Thresholds = append(c.Thresholds, gallery.FARThreshold{FAR: o.TargetFAR, Threshold: o.Threshold, TAR: o.TAR})
+	}
+	if err = g.Calibrate(op.Threshold, c); err != nil {
+		return err
+	}
+	fmt.Printf("gallery %s threshold set to %.4f (FAR %g)\n", g.Config().Name, op.Threshold, conf.ApplyFAR)
+	return nil
+}
+
+//listIdentities 列出每个子目录中的照片，子目录名是身份，以.开头的文件和目录被忽略
+func listIdentities(dir string) ([]string, []labeledImage, error) {
+	dirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "read %s failed", dir)
+	}
+	var identities []string
+	var images []labeledImage
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dir, d.Name()))
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "read %s failed", d.Name())
+		}
+		n := 0
+		for _, f := range files {
+			if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+			images = append(images, labeledImage{identity: len(identities), path: filepath.Join(dir, d.Name(), f.Name())})
+			n++
+		}
+		if n > 0 {
+			identities = append(identities, d.Name())
+		}
+	}
+	return identities, images, nil
+}
+
+//extractLabeled 并发提取所有照片的特征，照片中有多张人脸时使用最大的一张
+//图库启用了模板保护时使用保护以后的模板，阈值和图库中的比对一致
+func (app *App) extractLabeled(ctx context.Context, name string, images []labeledImage, failed map[string]string) []labeled {
+	samples := make([]labeled, len(images))
+	ok := make([]bool, len(images))
+	reasons := make([]string, len(images))
+	var done int64
+	forEach(ctx, len(images), func(i int) {
+		r := &face.Request{ConnId: face.InternalConn, ID: "calibrate", Cmd: face.CmdFeature, Priority: face.PriorityBulk, Gallery: name}
+		m, _, code := app.resolve(ctx, r, face.Input{Type: face.TypeFile, Content: images[i].path})
+		if code != 0 {
+			reasons[i] = fmt.Sprintf("result %d", code)
+		} else {
+			samples[i] = labeled{identity: images[i].identity, metric: face.Normalize(m)}
+			ok[i] = true
+		}
+		if n := atomic.AddInt64(&done, 1); n%500 == 0 {
+			fmt.Printf("extracted %d/%d\n", n, len(images))
+		}
+	})
+	out := samples[:0]
+	for i := range samples {
+		if ok[i] {
+			out = append(out, samples[i])
+		} else if len(reasons[i]) > 0 {
+			failed[images[i].path] = reasons[i]
+		}
+	}
+	return out
+}
+
+//scorePairs 计算所有同一身份的照片对和不同身份的照片对的相似度
+//不同身份的照片对超过 maxImpostor 时随机抽样
+func scorePairs(samples []labeled, maxImpostor int) ([]float64, []float64) {
+	var genuine, impostor []float64
+	total := 0
+	for i := range samples {
+		for j := i + 1; j < len(samples); j++ {
+			if samples[i].identity == samples[j].identity {
+				genuine = append(genuine, cosine(samples[i].metric, samples[j].metric))
+			} else {
+				total++
+			}
+		}
+	}
+	if maxImpostor <= 0 || total <= maxImpostor {
+		impostor = make([]float64, 0, total)
+		for i := range samples {
+			for j := i + 1; j < len(samples); j++ {
+				if samples[i].identity != samples[j].identity {
+					impostor = append(impostor, cosine(samples[i].metric, samples[j].metric))
+				}
+			}
+		}
+		return genuine, impostor
+	}
+	rnd := rand.New(rand.NewSource(1))
+	impostor = make([]float64, 0, maxImpostor)
+	for len(impostor) < maxImpostor {
+		i, j := rnd.Intn(len(samples)), rnd.Intn(len(samples))
+		if samples[i].identity != samples[j].identity {
+			impostor = append(impostor, cosine(samples[i].metric, samples[j].metric))
+		}
+	}
+	return genuine, impostor
+}
+
+//cosine 两个归一化以后的特征的相似度，长度不同时为-1
+func cosine(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return -1
+	}
+	var s float64
+	for i := range a {
+		s += float64(a[i]) * float64(b[i])
+	}
+	return s
+}
+
+func containsFloat(fs []float64, f float64) bool {
+	for _, v := range fs {
+		if v == f {
+			return true
+		}
+	}
+	return false
+}
+
+func printCalibration(r *CalibrateReport) {
+	fmt.Printf("identities:%d images:%d failed:%d\n", r.Identities, r.Images, len(r.Failed))
+	fmt.Printf("genuine  pairs:%d mean:%.4f std:%.4f min:%.4f max:%.4f\n",
+		r.Genuine.Count, r.Genuine.Mean, r.Genuine.Std, r.Genuine.Min, r.Genuine.Max)
+	fmt.Printf("impostor pairs:%d mean:%.4f std:%.4f min:%.4f max:%.4f\n",
+		r.Impostor.Count, r.Impostor.Mean, r.Impostor.Std, r.Impostor.Min, r.Impostor.Max)
+	fmt.Printf("EER:%.4f at threshold %.4f\n", r.EER, r.EERThreshold)
+	for _, o := range r.Operating {
+		note := ""
+		if !o.Reliable {
+			note = " (too few impostor pairs)"
+		}
+		fmt.Printf("FAR %g: threshold %.4f far %.2g tar %.4f%s\n", o.TargetFAR, o.Threshold, o.FAR, o.TAR, note)
+	}
+}
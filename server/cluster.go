@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"faceserver/face"
+	"faceserver/pkg/cluster"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//ClusterMember 类别中的一张人脸
+type ClusterMember struct {
+	Input int    `json:"input"`           //输入序号
+	Image string `json:"image,omitempty"` //离线聚类时照片的路径
+	Face  int    `json:"face"`            //人脸在照片提取结果中的序号，输入是特征时为-1
+}
+
+//ClusterView 一个类别
+type ClusterView struct {
+	ID       int             `json:"id"`
+	Cohesion float64         `json:"cohesion"` //类别内两两相似度的平均值
+	Members  []ClusterMember `json:"members"`
+}
+
+//ClusterFailure 没有提取到人脸的输入
+type ClusterFailure struct {
+	Input  int    `json:"input"`
+	Image  string `json:"image,omitempty"`
+	Result int    `json:"result"`
+}
+
+//ClusterResult cluster 命令的结果
+type ClusterResult struct {
+	Method    string           `json:"method"`
+	Threshold float64          `json:"threshold"`
+	Faces     int              `json:"faces"`
+	Clusters  []ClusterView    `json:"clusters"`
+	Noise     []ClusterMember  `json:"noise"` //不属于任何类别的人脸
+	Failed    []ClusterFailure `json:"failed,omitempty"`
+}
+
+//cluster 命令：提取 inputs 中每张照片的所有人脸（输入也可以是特征），按照相似度聚类
+func (app *App) cluster(ctx context.Context, r *face.Request) face.Response {
+	resp := face.Response{ID: r.ID, Cmd: r.Cmd}
+	if len(r.Inputs) == 0 {
+		resp.Result = face.PErrorParameters
+		return resp
+	}
+	switch r.Method {
+	case "", cluster.DBSCAN, cluster.ChineseWhispers:
+	default:
+		resp.Result = face.PErrorParameters
+		return resp
+	}
+	result, code := app.clusterInputs(ctx, r, r.Inputs)
+	if resp.Result = code; code == 0 {
+		resp.Data = result
+	}
+	return resp
+}
+
+//clusterInputs 并发提取所有输入的人脸并聚类
+func (app *App) clusterInputs(ctx context.Context, r *face.Request, inputs []face.Input) (*ClusterResult, int) {
+	maxFaceCount := r.MaxFaceCount
+	if maxFaceCount <= 0 {
+		maxFaceCount = app.conf.MaxFaces
+	}
+	faces := make([][]ClusterMember, len(inputs))
+	metrics := make([][][]float32, len(inputs))
+	codes := make([]int, len(inputs))
+	forEach(ctx, len(inputs), func(i int) {
+		in := inputs[i]
+		if len(in.Metric) > 0 {
+			m, err := face.ParseMetric(in.Metric)
+			if err != nil {
+				codes[i] = face.PErrorParameters
+				return
+			}
+			faces[i] = []ClusterMember{{Input: i, Face: -1}}
+			metrics[i] = [][]float32{m}
+			return
+		}
+		resp := extract(ctx, r, in, maxFaceCount)
+		if resp.Result != 0 {
+			codes[i] = resp.Result
+			return
+		}
+		for k, f := range resp.Content {
+			m, err := face.ParseMetric(f.Metric)
+			if err != nil {
+				continue
+			}
+			faces[i] = append(faces[i], ClusterMember{Input: i, Face: k})
+			metrics[i] = append(metrics[i], m)
+		}
+	})
+	if ctx.Err() != nil {
+		return nil, face.PErrorInternal
+	}
+
+	result := &ClusterResult{
+		Method:    r.Method,
+		Threshold: app.threshold(r, nil),
+		Clusters:  []ClusterView{},
+		Noise:     []ClusterMember{},
+	}
+	if len(result.Method) == 0 {
+		result.Method = cluster.ChineseWhispers
+	}
+	var members []ClusterMember
+	var vectors [][]float32
+	for i := range inputs {
+		if codes[i] != 0 {
+			result.Failed = append(result.Failed, ClusterFailure{Input: i, Result: codes[i]})
+			continue
+		}
+		members = append(members, faces[i]...)
+		vectors = append(vectors, metrics[i]...)
+	}
+	result.Faces = len(vectors)
+	clusters, noise, err := cluster.Run(vectors, cluster.Config{
+		Method:     result.Method,
+		Threshold:  result.Threshold,
+		MinSamples: r.MinSamples,
+	})
+	if err != nil {
+		return nil, face.PErrorParameters
+	}
+	for id, c := range clusters {
+		v := ClusterView{ID: id, Cohesion: c.Cohesion}
+		for _, m := range c.Members {
+			v.Members = append(v.Members, members[m])
+		}
+		result.Clusters = append(result.Clusters, v)
+	}
+	for _, m := range noise {
+		result.Noise = append(result.Noise, members[m])
+	}
+	return result, 0
+}
+
+//ClusterConfig 离线聚类的参数
+type ClusterConfig struct {
+	Dir        string //照片目录，不包括子目录
+	Method     string
+	Threshold  float64
+	MinSamples int
+	MaxFaces   int    //每张照片最多提取的人脸数目
+	Out        string //结果的 json 文件，为空时输出到标准输出
+}
+
+//RunCluster 离线聚类目录中的所有照片，结果中的成员带有照片路径
+func (app *App) RunCluster(conf ClusterConfig) error {
+	dir, err := filepath.Abs(conf.Dir)
+	if err != nil {
+		return err
+	}
+	if len(conf.Out) > 0 {
+		if conf.Out, err = filepath.Abs(conf.Out); err != nil {
+			return err
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrapf(err, "read %s failed", dir)
+	}
+	var images []string
+	for _, f := range files {
+		if !f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
+			images = append(images, filepath.Join(dir, f.Name()))
+		}
+	}
+	sort.Strings(images)
+	if len(images) == 0 {
+		return errors.Errorf("no image in %s", dir)
+	}
+
+	if err = face.GetFaceInstance().Init(); err != nil {
+		return err
+	}
+	defer face.GetFaceInstance().UnInit()
+	app.engine = true
+
+	r := &face.Request{
+		ConnId:       face.InternalConn,
+		ID:           "cluster",
+		Cmd:          face.CmdCluster,
+		Priority:     face.PriorityBulk,
+		MaxFaceCount: conf.MaxFaces,
+		Threshold:    conf.Threshold,
+		Method:       conf.Method,
+		MinSamples:   conf.MinSamples,
+	}
+	inputs := make([]face.Input, len(images))
+	for i, img := range images {
+		inputs[i] = face.Input{Type: face.TypeFile, Content: img}
+	}
+	result, code := app.clusterInputs(app.ctx, r, inputs)
+	if code != 0 {
+		return errors.Errorf("cluster failed: %d", code)
+	}
+	for i := range result.Clusters {
+		for k := range result.Clusters[i].Members {
+			m := &result.Clusters[i].Members[k]
+			m.Image = images[m.Input]
+		}
+	}
+	for k := range result.Noise {
+		result.Noise[k].Image = images[result.Noise[k].Input]
+	}
+	for k := range result.Failed {
+		result.Failed[k].Image = images[result.Failed[k].Input]
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	if len(conf.Out) == 0 {
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+	fmt.Printf("images:%d faces:%d clusters:%d noise:%d failed:%d\n",
+		len(images), result.Faces, len(result.Clusters), len(result.Noise), len(result.Failed))
+	return errors.Wrapf(ioutil.WriteFile(conf.Out, data, 0644), "write %s failed", conf.Out)
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"faceserver/events"
+	"faceserver/face"
+	"faceserver/gallery"
+)
+
+//CompareFace 比对时每个输入使用的人脸
+type CompareFace struct {
+	Index        int    `json:"index"`                   //使用的人脸在提取结果中的序号，输入是特征时为-1
+	Count        int    `json:"count"`                   //照片中提取到的人脸数目，输入是特征时为0
+	ModelVersion string `json:"model_version,omitempty"` //特征的模型版本，输入是特征时为请求中给出的版本
+
+	rect *events.Rect //使用的人脸框，记录识别事件时使用
+}
+
+//CompareResult compare 命令的结果
+type CompareResult struct {
+	Similarity float64        `json:"similarity"` //余弦相似度
+	Threshold  float64        `json:"threshold"`  //本次比对使用的阈值
+	Match      bool           `json:"match"`      //相似度不低于阈值时认为是同一个人
+	Faces      [2]CompareFace `json:"faces"`
+}
+
+//把一个输入转换为特征，照片中有多张人脸时使用最大的一张
+//返回的 result 不为0时表示失败
+func (app *App) resolve(ctx context.Context, r *face.Request, in face.Input) ([]float32, CompareFace, int) {
+	if len(in.Metric) > 0 {
+		m, err := face.ParseMetric(in.Metric)
+		if err != nil {
+			return nil, CompareFace{}, face.PErrorParameters
+		}
+		if code := face.GetFaceInstance().CheckMetric(r.Gallery, in.ModelVersion, m); code != 0 {
+			return nil, CompareFace{}, code
+		}
+		return m, CompareFace{Index: -1, ModelVersion: in.ModelVersion}, 0
+	}
+	maxFaceCount := r.MaxFaceCount
+	if maxFaceCount <= 0 {
+		maxFaceCount = app.conf.MaxFaces
+	}
+	resp := extract(ctx, r, in, maxFaceCount)
+	if resp.Result != 0 {
+		return nil, CompareFace{}, resp.Result
+	}
+	app.publish(r.Cmd, r.Source, resp.Content)
+	i := face.LargestFace(resp.Content)
+	if i < 0 {
+		return nil, CompareFace{}, face.PErrorNOFeature
+	}
+	m, err := face.ParseMetric(resp.Content[i].Metric)
+	if err != nil {
+		return nil, CompareFace{}, face.PErrorNOFeature
+	}
+	return m, CompareFace{Index: i, Count: len(resp.Content), ModelVersion: resp.Content[i].ModelVersion,
+		rect: rectOf(&resp.Content[i])}, 0
+}
+
+//compare 命令：两张照片、照片和特征或者两个特征之间的1:1比对
+func (app *App) compare(ctx context.Context, r *face.Request) face.Response {
+	resp := face.Response{ID: r.ID, Cmd: r.Cmd}
+	if len(r.Inputs) != 2 {
+		resp.Result = face.PErrorParameters
+		return resp
+	}
+	g, code := app.galleryOf(r)
+	if code != 0 {
+		resp.Result = code
+		return resp
+	}
+	var metrics [2][]float32
+	result := CompareResult{Threshold: app.threshold(r, g)}
+	for i, in := range r.Inputs {
+		m, f, code := app.resolve(ctx, r, in)
+		if code != 0 {
+			resp.Result = code
+			return resp
+		}
+		metrics[i] = m
+		result.Faces[i] = f
+	}
+	//不同模型版本的特征不能比较，版本为空表示不知道版本
+	v0, v1 := result.Faces[0].ModelVersion, result.Faces[1].ModelVersion
+	if len(v0) > 0 && len(v1) > 0 && v0 != v1 {
+		resp.Result = face.PErrorModelVersion
+		return resp
+	}
+	sim, err := face.Cosine(metrics[0], metrics[1])
+	if err != nil {
+		resp.Result = face.PErrorParameters
+		return resp
+	}
+	result.Similarity = sim
+	result.Match = sim >= result.Threshold
+	app.recordCompare(r, &result)
+	resp.Data = result
+	return resp
+}
+
+//请求指定的阈值优先，其次是图库的配置，最后使用服务器配置，g 可以为nil
+func (app *App) threshold(r *face.Request, g *gallery.Gallery) float64 {
+	if r.Threshold > 0 {
+		return r.Threshold
+	}
+	if g == nil {
+		return app.conf.Threshold
+	}
+	if t := g.Config().Threshold; t > 0 {
+		return t
+	}
+	return app.conf.Threshold
+}
+
+//请求指定的候选数目优先，其次是图库的配置，最后使用服务器配置
+func (app *App) topK(r *face.Request, g *gallery.Gallery) int {
+	if r.TopK > 0 {
+		return r.TopK
+	}
+	if k := g.Config().TopK; k > 0 {
+		return k
+	}
+	return app.conf.TopK
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/golang/glog"
 	"github.com/gorilla/websocket"
 	"log"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,12 +15,20 @@ const (
 	pingPeriod = (pongWait * 9) / 10 //ping发送周期
 )
 
+//发送队列满了以后的处理策略
+const (
+	PolicyDrop       = "drop"       //丢弃这个应答
+	PolicyDisconnect = "disconnect" //断开这个慢的连接
+)
+
 //wsConn 连接对象
 type wsConn struct {
 	conn        *websocket.Conn
 	server      *server
 	isClosed    bool
-	writeCh     chan face.Response
+	writeCh     chan face.Response //有界的发送队列
+	kick        chan struct{}      //发送队列满了并且策略是断开时，通知写协程关闭连接
+	dropped     uint64             //因为发送队列满了而丢弃的应答数
 	messageType int
 	addr        string
 	seq         uint32
@@ -35,7 +44,8 @@ func newConn(conn *websocket.Conn, seq uint32, server *server) *wsConn {
 		isClosed:    false,
 		messageType: websocket.TextMessage,
 		addr:        conn.RemoteAddr().String(),
-		writeCh:     make(chan face.Response),
+		writeCh:     make(chan face.Response, server.conf.QueueSize),
+		kick:        make(chan struct{}, 1),
 	}
 	return s
 }
@@ -45,6 +55,8 @@ func (w *wsConn) close() {
 	if w.isClosed {
 		return
 	}
+	//连接上还没有完成的请求已经没有意义了
+	w.server.cancelRequest(w.seq, "")
 	err := w.conn.Close()
 	if err != nil {
 		glog.V(LERROR).Infof("ws conn[%s] close failed: %+v", w.addr, err)
@@ -81,12 +93,21 @@ func (w *wsConn) start() {
 				//读取协程退出了，我们可以真正退出
 				w.close()
 				return
+			case <-w.kick:
+				//客户端太慢，发送队列满了，关闭连接以后读协程会退出
+				glog.V(LWARNING).Infof("ws conn[%s] outbound queue full, disconnect", w.addr)
+				w.close()
 			case <-ticker.C:
 				//发送ping包
 				_ = w.conn.WriteMessage(websocket.PingMessage, []byte{})
 				glog.V(LVERBOSE).Infof("ws conn[%s] send ping message", w.addr)
 			case data := <-w.writeCh:
 				buf, err := json.Marshal(data)
+				if err != nil {
+					//结果中有无法编码的值（比如 NaN），只返回错误码，客户端不会一直等待应答
+					glog.V(LERROR).Infof("request[%s] ws conn[%s] marshal response failed:%v", data.ID, w.addr, err)
+					buf, err = json.Marshal(face.Response{ID: data.ID, Cmd: data.Cmd, Result: face.PErrorInternal, Source: data.Source})
+				}
 				if err == nil {
 					err = w.conn.WriteMessage(w.messageType, buf)
 					if err != nil {
@@ -131,14 +152,44 @@ func (w *wsConn) handleRead(done chan<- struct{}) {
 			return
 		}
 		msg.ConnId = w.seq
+		if msg.Cmd == face.CmdCancel {
+			w.cancel(msg.ID)
+			continue
+		}
 		//我们生成一个唯一的请求id
 		msg.ReqId = GetIdInstance().Get()
-		//提交给人脸特征提取模块处理
-		face.GetFaceInstance().DoFeature(msg)
+		w.server.onRequest(msg)
 		glog.V(LVERBOSE).Infof("new request[%s] from:%s", msg.ID, w.addr)
 	}
 }
 
+//取消本连接上标识为id的请求，并告知客户端结果
+func (w *wsConn) cancel(id string) {
+	resp := face.Response{
+		ID:  id,
+		Cmd: face.CmdCancel,
+	}
+	if !w.server.cancelRequest(w.seq, id) {
+		resp.Result = face.PErrorNotFound
+	}
+	glog.V(LVERBOSE).Infof("cancel request[%s] from:%s result:%d", id, w.addr, resp.Result)
+	w.send(resp)
+}
+
+//把应答放入发送队列，不会阻塞调用方
+//队列满了以后按照服务器配置的策略丢弃应答或者断开连接
 func (w *wsConn) send(resp face.Response) {
-	w.writeCh <- resp
+	select {
+	case w.writeCh <- resp:
+		return
+	default:
+	}
+	atomic.AddUint64(&w.dropped, 1)
+	glog.V(LWARNING).Infof("ws conn[%s] outbound queue full, drop response of request[%s]", w.addr, resp.ID)
+	if w.server.conf.Policy == PolicyDisconnect {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
 }
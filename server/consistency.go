@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"faceserver/face"
+	"faceserver/gallery"
+	"fmt"
+	"strings"
+)
+
+//ConsistencyResult 不指定人员时 gallery_consistency 命令的结果
+type ConsistencyResult struct {
+	Total     int                   `json:"total"`     //图库的人员数目
+	Checked   int                   `json:"checked"`   //本页中有两个以上模板可以检查的人员数目
+	Flagged   int                   `json:"flagged"`   //本页中有异常模板的人员数目
+	Threshold float64               `json:"threshold"` //低于这个相似度的模板标记为异常
+	Persons   []gallery.Consistency `json:"persons"`   //本页中可以检查的人员
+}
+
+//consistency 命令：检查人员的模板是否像同一个人
+//指定 person_id 时只检查这个人，否则按照 offset/limit 分页检查图库中的人员
+func (app *App) consistency(ctx context.Context, r *face.Request) face.Response {
+	resp := face.Response{ID: r.ID, Cmd: r.Cmd}
+	g, code := app.galleryOf(r)
+	if code != 0 {
+		resp.Result = code
+		return resp
+	}
+	threshold := app.threshold(r, g)
+	if len(r.PersonID) > 0 {
+		c, err := g.Consistency(r.PersonID, threshold)
+		if resp.Result = galleryResult(err); resp.Result == 0 {
+			resp.Data = c
+		}
+		return resp
+	}
+	persons, total := g.List(r.Offset, r.Limit)
+	result := ConsistencyResult{Total: total, Threshold: threshold, Persons: []gallery.Consistency{}}
+	for _, p := range persons {
+		c, err := g.Consistency(p.ID, threshold)
+		if err != nil || len(c.Templates) == 0 {
+			//已经被删除或者不能比较
+			continue
+		}
+		result.Checked++
+		if c.Outliers > 0 {
+			result.Flagged++
+		}
+		result.Persons = append(result.Persons, *c)
+	}
+	resp.Data = result
+	return resp
+}
+
+//consistencyText shell 命令 gallery_consistency 的文本报告，只列出有异常模板的人员
+func (app *App) consistencyText(name string) string {
+	g, err := app.galleries.Get(name)
+	if err != nil {
+		return fmt.Sprintf("gallery_consistency failed: %v", err)
+	}
+	threshold := app.threshold(&face.Request{}, g)
+	b := strings.Builder{}
+	checked, flagged := 0, 0
+	g.Export(func(p *gallery.Person) error {
+		c, err := g.Consistency(p.ID, threshold)
+		if err != nil || len(c.Templates) == 0 {
+			return nil
+		}
+		checked++
+		if c.Outliers == 0 {
+			return nil
+		}
+		flagged++
+		fmt.Fprintf(&b, "%s templates:%d mean:%.4f\n", c.PersonID, len(c.Templates), c.Mean)
+		for _, t := range c.Templates {
+			if t.Outlier {
+				fmt.Fprintf(&b, "  #%d score:%.4f %s\n", t.Index, t.Score, t.Source)
+			}
+		}
+		return nil
+	})
+	fmt.Fprintf(&b, "checked:%d flagged:%d threshold:%.4f\n", checked, flagged, threshold)
+	return b.String()
+}
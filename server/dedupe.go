@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"faceserver/face"
+	"faceserver/gallery"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//DuplicatePair 可能是同一个人的两个人员，A 的标识小于 B
+type DuplicatePair struct {
+	A     string            `json:"a"`
+	B     string            `json:"b"`
+	Score float64           `json:"score"`
+	MetaA map[string]string `json:"meta_a,omitempty"`
+	MetaB map[string]string `json:"meta_b,omitempty"`
+}
+
+//DedupeResult gallery_dedupe 命令的结果
+type DedupeResult struct {
+	Total     int             `json:"total"`     //图库的人员数目
+	Threshold float64         `json:"threshold"` //不低于这个相似度的两个人员报告为重复
+	Pairs     []DuplicatePair `json:"pairs"`     //按照相似度从大到小排序，limit 大于0时只返回前 limit 对
+	Groups    [][]string      `json:"groups"`    //通过重复关系连在一起的人员，一个人重复登记两次以上时在同一组中
+}
+
+//MergeResult gallery_merge 命令的结果
+type MergeResult struct {
+	Person PersonView `json:"person"`
+	Moved  int        `json:"moved"` //移动的模板数目，不包括和已有模板相同的模板
+}
+
+//dedupe 命令：找出图库中可能是同一个人的重复登记
+//每个人员在索引中检索 top_k 个最相似的其他人员，不需要两两比较，HNSW 索引时结果是近似的
+func (app *App) dedupe(ctx context.Context, r *face.Request) face.Response {
+	resp := face.Response{ID: r.ID, Cmd: r.Cmd}
+	g, code := app.galleryOf(r)
+	if code != 0 {
+		resp.Result = code
+		return resp
+	}
+	result, err := app.duplicates(ctx, g, app.threshold(r, g), app.topK(r, g))
+	if err != nil {
+		resp.Result = face.PErrorInternal
+		return resp
+	}
+	if r.Limit > 0 && len(result.Pairs) > r.Limit {
+		result.Pairs = result.Pairs[:r.Limit]
+	}
+	resp.Data = result
+	return resp
+}
+
+//duplicates 并发检索每个人员的近邻，收集相似度不低于 threshold 的人员对
+//近似索引中 A 找到 B 时 B 不一定找到 A，所以两个方向的结果合并在一起
+func (app *App) duplicates(ctx context.Context, g *gallery.Gallery, threshold float64, k int) (*DedupeResult, error) {
+	ids := g.IDs()
+	var mu sync.Mutex
+	best := make(map[[2]string]float64)
+	forEach(ctx, len(ids), func(i int) {
+		matches, err := g.Neighbors(ids[i], k, threshold)
+		if err != nil {
+			//已经被删除
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, m := range matches {
+			key := [2]string{ids[i], m.ID}
+			if key[0] > key[1] {
+				key[0], key[1] = key[1], key[0]
+			}
+			if s, ok := best[key]; !ok || m.Score > s {
+				best[key] = m.Score
+			}
+		}
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &DedupeResult{Total: len(ids), Threshold: threshold, Pairs: []DuplicatePair{}, Groups: [][]string{}}
+	meta := make(map[string]map[string]string)
+	metaOf := func(id string) map[string]string {
+		if m, ok := meta[id]; ok {
+			return m
+		}
+		if p, err := g.Get(id); err == nil {
+			meta[id] = p.Meta
+		}
+		return meta[id]
+	}
+	//并查集，按照重复关系分组
+	parent := make(map[string]string)
+	var find func(id string) string
+	find = func(id string) string {
+		if p, ok := parent[id]; ok && p != id {
+			parent[id] = find(p)
+			return parent[id]
+		}
+		parent[id] = id
+		return id
+	}
+	for key, score := range best {
+		result.Pairs = append(result.Pairs, DuplicatePair{A: key[0], B: key[1], Score: score,
+			MetaA: metaOf(key[0]), MetaB: metaOf(key[1])})
+		if a, b := find(key[0]), find(key[1]); a != b {
+			parent[b] = a
+		}
+	}
+	sort.Slice(result.Pairs, func(i, j int) bool {
+		a, b := result.Pairs[i], result.Pairs[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.A != b.A {
+			return a.A < b.A
+		}
+		return a.B < b.B
+	})
+	groups := make(map[string][]string)
+	for id := range parent {
+		root := find(id)
+		groups[root] = append(groups[root], id)
+	}
+	for _, members := range groups {
+		sort.Strings(members)
+		result.Groups = append(result.Groups, members)
+	}
+	sort.Slice(result.Groups, func(i, j int) bool { return result.Groups[i][0] < result.Groups[j][0] })
+	return result, nil
+}
+
+//merge 命令：把 merge_ids 中人员的模板合并到 person_id 下并删除这些人员
+func (app *App) merge(ctx context.Context, r *face.Request) face.Response {
+	resp := face.Response{ID: r.ID, Cmd: r.Cmd}
+	if len(r.PersonID) == 0 || len(r.MergeIDs) == 0 {
+		resp.Result = face.PErrorParameters
+		return resp
+	}
+	g, code := app.galleryOf(r)
+	if code != 0 {
+		resp.Result = code
+		return resp
+	}
+	p, moved, err := g.Merge(r.PersonID, r.MergeIDs)
+	if resp.Result = galleryResult(err); resp.Result == 0 {
+		resp.Data = MergeResult{Person: newPersonView(p, false), Moved: moved}
+	}
+	return resp
+}
+
+//dedupeText shell 命令 gallery_dedupe 的文本报告
+func (app *App) dedupeText(name string) string {
+	g, err := app.galleries.Get(name)
+	if err != nil {
+		return fmt.Sprintf("gallery_dedupe failed: %v", err)
+	}
+	r := &face.Request{}
+	result, err := app.duplicates(app.ctx, g, app.threshold(r, g), app.topK(r, g))
+	if err != nil {
+		return fmt.Sprintf("gallery_dedupe failed: %v", err)
+	}
+	b := strings.Builder{}
+	for _, p := range result.Pairs {
+		fmt.Fprintf(&b, "%s %s score:%.4f\n", p.A, p.B, p.Score)
+	}
+	for _, members := range result.Groups {
+		if len(members) > 2 {
+			fmt.Fprintf(&b, "group: %s\n", strings.Join(members, " "))
+		}
+	}
+	fmt.Fprintf(&b, "persons:%d pairs:%d groups:%d threshold:%.4f\n",
+		result.Total, len(result.Pairs), len(result.Groups), result.Threshold)
+	return b.String()
+}
+
+//mergeText shell 命令 gallery_merge 的参数：<person_id> <merge_id>... [gallery=<name>]
+func (app *App) mergeText(arg string) string {
+	fields := strings.Fields(arg)
+	target := ""
+	if n := len(fields); n > 0 && strings.HasPrefix(fields[n-1], "gallery=") {
+		target = strings.TrimPrefix(fields[n-1], "gallery=")
+		fields = fields[:n-1]
+	}
+	if len(fields) < 2 {
+		return "usage: gallery_merge <person_id> <merge_id>... [gallery=<name>]"
+	}
+	g, err := app.galleries.Get(target)
+	if err != nil {
+		return fmt.Sprintf("gallery_merge failed: %v", err)
+	}
+	p, moved, err := g.Merge(fields[0], fields[1:])
+	if err != nil {
+		return fmt.Sprintf("gallery_merge failed: %v", err)
+	}
+	return fmt.Sprintf("%s templates:%d moved:%d merged:%s", p.ID, len(p.Templates), moved, strings.Join(fields[1:], " "))
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"faceserver/events"
+	"faceserver/face"
+	"faceserver/gallery"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+//eventsDir 数据目录中保存识别事件的子目录
+const eventsDir = "events"
+
+//EventsConfig 识别事件日志的配置
+type EventsConfig struct {
+	Disabled  bool //不记录识别事件
+	Thumbnail bool //事件中保存人脸缩略图，只支持 jpeg 和 png 照片
+}
+
+//openEvents 打开识别事件日志
+func (app *App) openEvents() error {
+	if app.conf.Events.Disabled {
+		return nil
+	}
+	store, err := events.Open(filepath.Join(app.dataDir(), eventsDir), app.conf.Index.Keys)
+	if err != nil {
+		return err
+	}
+	app.eventLog = store
+	return nil
+}
+
+func rectOf(f *face.FaceFeature) *events.Rect {
+	return &events.Rect{X1: f.Rect.X1, Y1: f.Rect.Y1, X2: f.Rect.X2, Y2: f.Rect.Y2}
+}
+
+//imageOf 输入的照片内容，生成缩略图使用
+func imageOf(in face.Input) ([]byte, error) {
+	if in.Type == face.TypeBase64 {
+		return base64.StdEncoding.DecodeString(in.Content)
+	}
+	return ioutil.ReadFile(in.Content)
+}
+
+//record 在后台生成缩略图并追加事件，不影响请求的应答时间
+//应答以前开始后台写入，同时进行的 purge 等待写入完成以后再删除事件，被删除人员的事件不会在凭证以后落盘
+//in 是事件中的人脸所在的照片，没有照片时不生成缩略图
+func (app *App) record(in *face.Input, list []events.Event) {
+	if app.eventLog == nil || len(list) == 0 {
+		return
+	}
+	commit := app.eventLog.Begin()
+	go func() {
+		if app.conf.Events.Thumbnail && in != nil {
+			if img, err := imageOf(*in); err == nil {
+				for i := range list {
+					if list[i].Rect == nil {
+						continue
+					}
+					if t, err := events.Thumbnail(img, *list[i].Rect); err == nil {
+						list[i].Thumbnail = t
+					}
+				}
+			}
+		}
+		//服务器退出时日志已经关闭，还在后台的事件丢弃
+		if err := commit(list...); err != nil && err != events.ErrClosed {
+			glog.V(LERROR).Infof("record events failed: %+v", err)
+		}
+	}()
+}
+
+//recordIdentify identify 的每张人脸一条事件，人员为第一个候选人员，没有候选人员时为空
+func (app *App) recordIdentify(r *face.Request, g *gallery.Gallery, faces []face.FaceFeature) {
+	if app.eventLog == nil {
+		return
+	}
+	now := time.Now()
+	name := g.Config().Name
+	list := make([]events.Event, 0, len(faces))
+	for i := range faces {
+		e := events.Event{Time: now, Cmd: r.Cmd, Source: r.Source, Gallery: name, Rect: rectOf(&faces[i])}
+		if len(faces[i].Candidates) > 0 {
+			e.PersonID, e.Score = faces[i].Candidates[0].PersonID, faces[i].Candidates[0].Score
+		}
+		list = append(list, e)
+	}
+	app.record(&face.Input{Type: r.Type, Content: r.Content}, list)
+}
+
+//recordCompare compare 的一条事件，人脸框和缩略图取第一个照片输入中使用的人脸
+func (app *App) recordCompare(r *face.Request, result *CompareResult) {
+	if app.eventLog == nil {
+		return
+	}
+	e := events.Event{Time: time.Now(), Cmd: r.Cmd, Source: r.Source, Score: result.Similarity}
+	var in *face.Input
+	for i, f := range result.Faces {
+		if f.rect != nil {
+			e.Rect, in = f.rect, &r.Inputs[i]
+			break
+		}
+	}
+	app.record(in, []events.Event{e})
+}
+
+//parseTime 查询条件中的时间，RFC3339 格式，为空表示不限制
+func parseTime(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+//eventsQuery 命令：按照人员、时间范围、来源、图库和最低分数查询识别事件，用 offset/limit 分页
+func (app *App) eventsQuery(ctx context.Context, r *face.Request) face.Response {
+	resp := face.Response{ID: r.ID, Cmd: r.Cmd}
+	if app.eventLog == nil {
+		resp.Result = face.PErrorNotFound
+		return resp
+	}
+	from, err1 := parseTime(r.From)
+	to, err2 := parseTime(r.To)
+	if err1 != nil || err2 != nil {
+		resp.Result = face.PErrorParameters
+		return resp
+	}
+	page, err := app.eventLog.Query(events.Query{
+		PersonID: r.PersonID,
+		Source:   r.Source,
+		Gallery:  r.Gallery,
+		From:     from,
+		To:       to,
+		MinScore: r.MinScore,
+		Offset:   r.Offset,
+		Limit:    r.Limit,
+	})
+	if err != nil {
+		resp.Result = face.PErrorParameters
+		if err != events.ErrQuery {
+			glog.V(LERROR).Infof("events_query %s: %+v", r.ID, err)
+			resp.Result = face.PErrorStorage
+		}
+		return resp
+	}
+	resp.Data = page
+	return resp
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"faceserver/face"
+	"faceserver/gallery"
+)
+
+//gallery_create 命令：创建图库，threshold、top_k、index、fusion 和 schema 都是可选的
+func (app *App) createGallery(ctx context.Context, r *face.Request) face.Response {
+	resp := face.Response{ID: r.ID, Cmd: r.Cmd}
+	conf := gallery.Config{Name: r.Gallery, Threshold: r.Threshold, TopK: r.TopK, Index: r.Index, Fusion: r.Fusion}
+	if len(r.Schema) > 0 {
+		if err := json.Unmarshal(r.Schema, &conf.Schema); err != nil {
+			resp.Result = face.PErrorParameters
+			return resp
+		}
+	}
+	g, err := app.galleries.Create(conf)
+	if resp.Result = galleryResult(err); resp.Result == 0 {
+		resp.Data = gallery.Info{Config: g.Config()}
+	} else if e, ok := err.(*gallery.SchemaError); ok {
+		resp.Data = map[string]string{"field": e.Field, "error": e.Reason}
+	}
+	return resp
+}
+
+//gallery_drop 命令：删除图库，默认图库不能删除
+func (app *App) dropGallery(ctx context.Context, r *face.Request) face.Response {
+	resp := face.Response{ID: r.ID, Cmd: r.Cmd}
+	if len(r.Gallery) == 0 {
+		resp.Result = face.PErrorParameters
+		return resp
+	}
+	resp.Result = galleryResult(app.galleries.Drop(r.Gallery))
+	return resp
+}
+
+//gallery_list 命令：列出所有图库的配置和人员数目
+func (app *App) listGalleries(ctx context.Context, r *face.Request) face.Response {
+	return face.Response{ID: r.ID, Cmd: r.Cmd, Data: app.galleries.List()}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"faceserver/face"
+	"faceserver/gallery"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+//TemplateView 应答中的特征模板，特征使用 FaceFeature.Metric 的格式
+type TemplateView struct {
+	Metric       string    `json:"metric"`
+	MetricLen    int       `json:"metric_len"`
+	ModelVersion string    `json:"model_version,omitempty"`
+	Quality      float64   `json:"quality"`
+	Source       string    `json:"source,omitempty"`
+	Created      time.Time `json:"created"`
+}
+
+//PersonView 应答中的人员信息，列表中不包含模板内容
+type PersonView struct {
+	ID            string            `json:"id"`
+	Meta          map[string]string `json:"meta"`
+	TemplateCount int               `json:"template_count"`
+	Templates     []TemplateView    `json:"templates,omitempty"`
+	Fusion        string            `json:"fusion,omitempty"`
+	Created       time.Time         `json:"created"`
+	Updated       time.Time         `json:"updated"`
+}
+
+//ListResult list 命令的结果
+type ListResult struct {
+	Total   int          `json:"total"`
+	Persons []PersonView `json:"persons"`
+}
+
+func newPersonView(p *gallery.Person, templates bool) PersonView {
+	v := PersonView{
+		ID:            p.ID,
+		Meta:          p.Meta,
+		TemplateCount: len(p.Templates),
+		Fusion:        p.Fusion,
+		Created:       p.Created,
+		Updated:       p.Updated,
+	}
+	if templates {
+		for _, t := range p.Templates {
+			v.Templates = append(v.Templates, TemplateView{
+				Metric:       face.FormatMetric(t.Metric),
+				MetricLen:    len(t.Metric),
+				ModelVersion: t.ModelVersion,
+				Quality:      t.Quality,
+				Source:       t.Source,
+				Created:      t.Created,
+			})
+		}
+	}
+	return v
+}
+
+//图库错误转换为应答的错误代码
+func galleryResult(err error) int {
+	switch err {
+	case nil:
+		return 0
+	case gallery.ErrNotFound:
+		return face.PErrorNotFound
+	case gallery.ErrInvalidID, gallery.ErrNoMetric, gallery.ErrInvalidName, gallery.ErrMergeSelf:
+		return face.PErrorParameters
+	case gallery.ErrNoGallery:
+		return face.PErrorNoGallery
+	case gallery.ErrExists:
+		return face.PErrorExists
+	case gallery.ErrModelVersion:
+		return face.PErrorModelVersion
+	}
+	if _, ok := err.(*gallery.SchemaError); ok {
+		return face.PErrorParameters
+	}
+	glog.V(LERROR).Infof("gallery error: %+v", err)
+	return face.PErrorStorage
+}
+
+//请求操作的图库，没有指定时为默认图库
+func (app *App) galleryOf(r *face.Request) (*gallery.Gallery, int) {
+	g, err := app.galleries.Get(r.Gallery)
+	if err != nil {
+		return nil, galleryResult(err)
+	}
+	return g, 0
+}
+
+//把登记用的输入转换为模板，照片中必须正好有一张人脸
+//失败时返回出错的输入序号
+func (app *App) templates(ctx context.Context, r *face.Request) ([]gallery.Template, int, int) {
+	templates := make([]gallery.Template, 0, len(r.Inputs))
+	for i, in := range r.Inputs {
+		if len(in.Metric) > 0 {
+			m, err := face.ParseMetric(in.Metric)
+			if err != nil {
+				return nil, i, face.PErrorParameters
+			}
+			if code := face.GetFaceInstance().CheckMetric(r.Gallery, in.ModelVersion, m); code != 0 {
+				return nil, i, code
+			}
+			templates = append(templates, gallery.Template{Metric: m, ModelVersion: in.ModelVersion})
+			continue
+		}
+		//登记照片的副本保存在图库中，模型升级以后用来重新提取特征，不依赖客户端的文件；
+		//照片文件只读取一次，提取特征用的就是保存的内容
+		photo, err := imageOf(in)
+		if err != nil {
+			if in.Type == face.TypeFile {
+				return nil, i, face.PErrorFileNotFound
+			}
+			return nil, i, face.PErrorParameters
+		}
+		source := in
+		if in.Type == face.TypeFile {
+			source = face.Input{Type: face.TypeBase64, Content: base64.StdEncoding.EncodeToString(photo)}
+		}
+		//多提取一张人脸，用来判断照片中是否有多个人
+		resp := extract(ctx, r, source, 2)
+		if resp.Result != 0 {
+			return nil, i, resp.Result
+		}
+		switch len(resp.Content) {
+		case 0:
+			return nil, i, face.PErrorNOFeature
+		case 1:
+		default:
+			return nil, i, face.PErrorMultipleFaces
+		}
+		m, err := face.ParseMetric(resp.Content[0].Metric)
+		if err != nil {
+			return nil, i, face.PErrorNOFeature
+		}
+		t := gallery.Template{Metric: m, Quality: resp.Content[0].QualityScore, ModelVersion: resp.Content[0].ModelVersion, Photo: photo}
+		if in.Type == face.TypeFile {
+			t.Source = in.Content
+		}
+		templates = append(templates, t)
+	}
+	return templates, -1, 0
+}
+
+//enroll 命令：登记人员，inputs 为照片或者特征，任何一个输入失败整个登记都失败
+func (app *App) enroll(ctx context.Context, r *face.Request) face.Response {
+	resp := face.Response{ID: r.ID, Cmd: r.Cmd}
+	if len(r.Inputs) == 0 && len(r.Meta) == 0 && len(r.Fusion) == 0 {
+		resp.Result = face.PErrorParameters
+		return resp
+	}
+	g, code := app.galleryOf(r)
+	if code != 0 {
+		resp.Result = code
+		return resp
+	}
+	templates, index, code := app.templates(ctx, r)
+	if code != 0 {
+		resp.Result = code
+		resp.Data = map[string]int{"input": index}
+		return resp
+	}
+	p, err := g.Enroll(r.PersonID, r.Meta, templates, r.Fusion)
+	if resp.Result = galleryResult(err); resp.Result == 0 {
+		resp.Data = newPersonView(p, false)
+	} else if e, ok := err.(*gallery.SchemaError); ok {
+		//meta 不符合图库的格式时告诉客户端是哪个字段
+		resp.Data = map[string]string{"field": e.Field, "error": e.Reason}
+	}
+	return resp
+}
+
+//delete 命令：删除人员
+func (app *App) deletePerson(ctx context.Context, r *face.Request) face.Response {
+	resp := face.Response{ID: r.ID, Cmd: r.Cmd}
+	g, code := app.galleryOf(r)
+	if code != 0 {
+		resp.Result = code
+		return resp
+	}
+	resp.Result = galleryResult(g.Delete(r.PersonID))
+	return resp
+}
+
+//get 命令：查询人员以及他的模板
+func (app *App) getPerson(ctx context.Context, r *face.Request) face.Response {
+	resp := face.Response{ID: r.ID, Cmd: r.Cmd}
+	g, code := app.galleryOf(r)
+	if code != 0 {
+		resp.Result = code
+		return resp
+	}
+	p, err := g.Get(r.PersonID)
+	if resp.Result = galleryResult(err); resp.Result == 0 {
+		resp.Data = newPersonView(p, true)
+	}
+	return resp
+}
+
+//list 命令：分页列出人员
+func (app *App) listPersons(ctx context.Context, r *face.Request) face.Response {
+	resp := face.Response{ID: r.ID, Cmd: r.Cmd}
+	g, code := app.galleryOf(r)
+	if code != 0 {
+		resp.Result = code
+		return resp
+	}
+	persons, total := g.List(r.Offset, r.Limit)
+	result := ListResult{Total: total, Persons: make([]PersonView, 0, len(persons))}
+	for _, p := range persons {
+		result.Persons = append(result.Persons, newPersonView(p, false))
+	}
+	resp.Data = result
+	return resp
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"faceserver/face"
+)
+
+//identify 命令：提取照片中的每一张人脸，在请求指定的图库中检索，
+//候选人员附加在应答 content 中对应的人脸上
+func (app *App) identify(ctx context.Context, r *face.Request) face.Response {
+	g, code := app.galleryOf(r)
+	if code != 0 {
+		return face.Response{ID: r.ID, Cmd: r.Cmd, Result: code}
+	}
+	maxFaceCount := r.MaxFaceCount
+	if maxFaceCount <= 0 {
+		maxFaceCount = app.conf.MaxFaces
+	}
+	resp := extract(ctx, r, face.Input{Type: r.Type, Content: r.Content}, maxFaceCount)
+	resp.ID = r.ID
+	resp.Cmd = r.Cmd
+	if resp.Result != 0 {
+		return resp
+	}
+	//图库中的模板是其他模型版本提取的，需要先重新登记
+	if len(resp.Content) > 0 && !g.Compatible(resp.Content[0].ModelVersion) {
+		return face.Response{ID: r.ID, Cmd: r.Cmd, Result: face.PErrorModelVersion,
+			Data: map[string]string{"model_version": resp.Content[0].ModelVersion, "gallery_model_version": g.ModelVersion()}}
+	}
+	app.publish(r.Cmd, r.Source, resp.Content)
+	topK := app.topK(r, g)
+	threshold := app.threshold(r, g)
+	for i := range resp.Content {
+		f := &resp.Content[i]
+		m, err := face.ParseMetric(f.Metric)
+		if err != nil {
+			continue
+		}
+		f.Candidates = []face.Candidate{}
+		matches, err := g.Search(m, f.ModelVersion, topK, threshold)
+		if err != nil {
+			continue
+		}
+		for _, match := range matches {
+			c := face.Candidate{PersonID: match.ID, Score: match.Score}
+			if p, err := g.Get(match.ID); err == nil {
+				c.Meta = p.Meta
+			}
+			f.Candidates = append(f.Candidates, c)
+		}
+	}
+	app.checkIn(g, r.Source, resp.Content)
+	app.recordIdentify(r, g, resp.Content)
+	return resp
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"faceserver/face"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+//handler 处理一个需要服务器编排的命令（比如需要多次提取特征），在独立的协程中运行
+//返回的应答会发送给客户端，ctx 在请求被取消或者连接关闭时结束
+type handler func(ctx context.Context, r *face.Request) face.Response
+
+//job 一个正在运行的命令
+type job struct {
+	connId uint32
+	id     string
+	cancel context.CancelFunc
+}
+
+//jobs 正在运行的命令，用于取消
+type jobs struct {
+	mu      sync.Mutex
+	seq     int64
+	running map[int64]job
+}
+
+func newJobs() *jobs {
+	return &jobs{running: make(map[int64]job)}
+}
+
+func (j *jobs) add(connId uint32, id string, cancel context.CancelFunc) int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seq++
+	j.running[j.seq] = job{connId: connId, id: id, cancel: cancel}
+	return j.seq
+}
+
+func (j *jobs) remove(seq int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.running, seq)
+}
+
+//cancel 取消connId连接上标识为id的命令，id为空时取消该连接上所有的命令
+func (j *jobs) cancel(connId uint32, id string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	found := false
+	for seq, c := range j.running {
+		if c.connId != connId || (len(id) > 0 && c.id != id) {
+			continue
+		}
+		c.cancel()
+		delete(j.running, seq)
+		found = true
+	}
+	return found
+}
+
+//在独立的协程中运行命令，发生panic时应答内部错误，命令被取消时不再应答
+func (s *server) runJob(h handler, r *face.Request) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	seq := s.jobs.add(r.ConnId, r.ID, cancel)
+	go func() {
+		var resp face.Response
+		defer func() {
+			if v := recover(); v != nil {
+				glog.V(LERROR).Infof("capture a panic in cmd[%s] request[%s]: %v\n%s", r.Cmd, r.ID, v, debug.Stack())
+				resp = face.Response{ID: r.ID, Cmd: r.Cmd, Result: face.PErrorInternal}
+			}
+			cancelled := ctx.Err() != nil
+			s.jobs.remove(seq)
+			cancel()
+			if !cancelled {
+				s.send(r.ConnId, resp)
+			}
+		}()
+		resp = h(ctx, r)
+	}()
+}
+
+//为命令提取一张照片的特征，请求继承命令的连接、标识和优先级
+func extract(ctx context.Context, r *face.Request, in face.Input, maxFaceCount int) face.Response {
+	sub := &face.Request{
+		ConnId:       r.ConnId,
+		ReqId:        GetIdInstance().Get(),
+		ID:           r.ID,
+		Cmd:          face.CmdFeature,
+		PredictMode:  r.PredictMode,
+		MaxFaceCount: maxFaceCount,
+		Type:         in.Type,
+		Content:      in.Content,
+		Priority:     r.Priority,
+		Gallery:      r.Gallery, //图库决定模板保护使用的密钥
+	}
+	return face.GetFaceInstance().Extract(ctx, sub)
+}
+
+//同时提交给引擎的最多照片数，服务器内部批量提取特征时使用
+const extractWorkers = 8
+
+//forEach 用 extractWorkers 个协程对 0..n-1 调用 fn，ctx 结束以后不再处理新的序号
+func forEach(ctx context.Context, n int, fn func(i int)) {
+	var next int64 = -1
+	wg := sync.WaitGroup{}
+	for w := 0; w < extractWorkers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n || ctx.Err() != nil {
+					return
+				}
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
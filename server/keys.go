@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+//OpRotate 轮换密钥以后用新密钥重新加密所有图库
+const OpRotate = "rotate"
+
+//rotateName 密钥轮换任务在 transfers 中的名称，同时只能有一个轮换任务
+const rotateName = "keys"
+
+//startRotate 重新读取密钥，把加密使用的密钥改为 active（为空时使用密钥文件中的最后一个），
+//然后在后台用新密钥重新加密所有图库的文件，用 gallery_progress 查询进度
+//旧密钥必须仍然在密钥文件或者环境变量中，否则拒绝轮换
+func (app *App) startRotate(active string) (*Transfer, error) {
+	keys := app.conf.Index.Keys
+	if keys == nil {
+		return nil, errors.New("encryption is not configured")
+	}
+	if app.transfers.running(rotateName) {
+		return nil, errors.New("key rotation is already in progress")
+	}
+	if err := keys.Reload(active); err != nil {
+		return nil, err
+	}
+	//轮换任务不属于某个图库，Gallery 记录新的密钥标识
+	t := &Transfer{Op: OpRotate, File: rotateName, Gallery: keys.Active(), Started: time.Now()}
+	app.transfers.add(t)
+	go func() {
+		err := app.rotate(t)
+		if err != nil {
+			glog.V(LERROR).Infof("rotate keys failed: %+v", err)
+		}
+		t.finish(err)
+	}()
+	return t, nil
+}
+
+//rotate 依次重新加密每个图库，然后是识别事件、考勤记录和核验审计日志，
+//rows 为处理的文件数目，templates 为重新加密的文件数目
+func (app *App) rotate(t *Transfer) error {
+	for _, info := range app.galleries.List() {
+		if err := app.ctx.Err(); err != nil {
+			return err
+		}
+		g, err := app.galleries.Get(info.Name)
+		if err != nil {
+			//已经被删除
+			continue
+		}
+		n, err := g.Reseal(func() { atomic.AddInt64(&t.rows, 1) })
+		atomic.AddInt64(&t.templates, int64(n))
+		if err != nil {
+			return errors.Wrap(err, info.Name)
+		}
+	}
+	//按行追加的日志每行用写入时的密钥加密，也要重新加密，否则旧密钥无法删除
+	done := func() { atomic.AddInt64(&t.rows, 1) }
+	if app.eventLog != nil {
+		n, err := app.eventLog.Reseal(done)
+		atomic.AddInt64(&t.templates, int64(n))
+		if err != nil {
+			return errors.Wrap(err, "events")
+		}
+	}
+	if app.checkins != nil {
+		n, err := app.checkins.Reseal(done)
+		atomic.AddInt64(&t.templates, int64(n))
+		if err != nil {
+			return errors.Wrap(err, "attendance")
+		}
+	}
+	if app.audit != nil {
+		ok, err := app.audit.reseal()
+		done()
+		if ok {
+			atomic.AddInt64(&t.templates, 1)
+		}
+		if err != nil {
+			return errors.Wrap(err, "audit log")
+		}
+	}
+	glog.V(LVERBOSE).Infof("%d files re-encrypted with key %s", atomic.LoadInt64(&t.templates), t.Gallery)
+	return nil
+}
+
+//keysState 加密的状态，shell 命令 keys 使用
+func (app *App) keysState() string {
+	keys := app.conf.Index.Keys
+	if keys == nil {
+		return "encryption is not configured"
+	}
+	return fmt.Sprintf("active:%s keys:%v", keys.Active(), keys.IDs())
+}
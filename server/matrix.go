@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"faceserver/face"
+	"faceserver/pkg/matrix"
+)
+
+//maxMatrixCells 返回完整矩阵时的最大元素数目，更大的矩阵需要指定 top_k
+const maxMatrixCells = 1 << 24
+
+//MatrixMatch top_k 结果中的一项
+type MatrixMatch struct {
+	Target int     `json:"target"` //targets 中的序号
+	Score  float32 `json:"score"`
+}
+
+//MatrixFailure 没有得到特征的输入
+type MatrixFailure struct {
+	Set    string `json:"set"` //inputs 或者 targets
+	Input  int    `json:"input"`
+	Result int    `json:"result"`
+}
+
+//MatrixResult compare_matrix 命令的结果，失败的输入不在矩阵中
+type MatrixResult struct {
+	Rows   []int           `json:"rows"`             //每一行对应的 inputs 序号
+	Cols   []int           `json:"cols"`             //每一列对应的 targets 序号
+	Scores [][]float32     `json:"scores,omitempty"` //完整的相似度矩阵，没有指定 top_k 时返回
+	TopK   [][]MatrixMatch `json:"top_k,omitempty"`  //每一行最相似的 top_k 个 targets，指定 top_k 时返回
+	Failed []MatrixFailure `json:"failed,omitempty"`
+}
+
+//compareMatrix 命令：inputs 中的每张人脸和 targets 中的每张人脸比对，输入可以是照片或者特征，照片使用最大的人脸
+//top_k 大于0时只返回每一行最相似的 top_k 个结果（可以用 threshold 过滤），否则返回完整的矩阵
+func (app *App) compareMatrix(ctx context.Context, r *face.Request) face.Response {
+	resp := face.Response{ID: r.ID, Cmd: r.Cmd}
+	if len(r.Inputs) == 0 || len(r.Targets) == 0 || r.TopK < 0 ||
+		(r.TopK == 0 && len(r.Inputs)*len(r.Targets) > maxMatrixCells) {
+		resp.Result = face.PErrorParameters
+		return resp
+	}
+	inputs := append(append([]face.Input(nil), r.Inputs...), r.Targets...)
+	metrics := make([][]float32, len(inputs))
+	faces := make([]CompareFace, len(inputs))
+	codes := make([]int, len(inputs))
+	forEach(ctx, len(inputs), func(i int) {
+		metrics[i], faces[i], codes[i] = app.resolve(ctx, r, inputs[i])
+	})
+	if ctx.Err() != nil {
+		return resp
+	}
+
+	result := MatrixResult{Rows: []int{}, Cols: []int{}}
+	var rows, cols [][]float32
+	version := ""
+	for i := range inputs {
+		set, n := "inputs", i
+		if i >= len(r.Inputs) {
+			set, n = "targets", i-len(r.Inputs)
+		}
+		if codes[i] != 0 {
+			result.Failed = append(result.Failed, MatrixFailure{Set: set, Input: n, Result: codes[i]})
+			continue
+		}
+		//不同模型版本的特征不能比较，版本为空表示不知道版本
+		if v := faces[i].ModelVersion; len(v) > 0 {
+			if len(version) > 0 && v != version {
+				resp.Result = face.PErrorModelVersion
+				return resp
+			}
+			version = v
+		}
+		if set == "inputs" {
+			result.Rows = append(result.Rows, n)
+			rows = append(rows, metrics[i])
+		} else {
+			result.Cols = append(result.Cols, n)
+			cols = append(cols, metrics[i])
+		}
+	}
+	a, err := matrix.New(rows)
+	if err != nil {
+		resp.Result = face.PErrorParameters
+		return resp
+	}
+	b, err := matrix.New(cols)
+	if err != nil {
+		resp.Result = face.PErrorParameters
+		return resp
+	}
+
+	if r.TopK > 0 {
+		threshold := float32(-1)
+		if r.Threshold > 0 {
+			threshold = float32(r.Threshold)
+		}
+		top, err := matrix.TopK(a, b, r.TopK, threshold)
+		if err != nil {
+			resp.Result = face.PErrorParameters
+			return resp
+		}
+		result.TopK = make([][]MatrixMatch, len(top))
+		for i, row := range top {
+			result.TopK[i] = make([]MatrixMatch, len(row))
+			for k, m := range row {
+				result.TopK[i][k] = MatrixMatch{Target: result.Cols[m.Col], Score: m.Score}
+			}
+		}
+	} else {
+		scores, err := matrix.Scores(a, b)
+		if err != nil {
+			resp.Result = face.PErrorParameters
+			return resp
+		}
+		result.Scores = make([][]float32, a.Rows)
+		for i := range result.Scores {
+			result.Scores[i] = scores[i*b.Rows : (i+1)*b.Rows]
+		}
+	}
+	resp.Data = result
+	return resp
+}
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"faceserver/face"
+	"faceserver/gallery"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+//receiptKeyName 删除凭证的签名密钥，没有用 -receipt_key 指定时在数据目录中生成
+const receiptKeyName = "receipt.key"
+
+//删除凭证中数据所在的位置
+const (
+	StorePerson     = "person"     //人员文件以及其中的模板
+	StoreWAL        = "wal"        //包含人员修改记录的预写日志
+	StoreIndex      = "index"      //HNSW 索引中已经删除但是仍然保存着特征的节点，以及保存的索引文件
+	StoreSource     = "source"     //登记时客户端提供的照片路径，文件属于客户端，不删除
+	StoreImage      = "image"      //登记照片在图库中保存的副本
+	StoreEvents     = "events"     //识别事件日志中的事件，包括缩略图
+	StoreAttendance = "attendance" //考勤记录中的打卡
+)
+
+//删除的结果
+const (
+	ErasedDeleted  = "deleted"
+	ErasedAbsent   = "absent" //已经不存在
+	ErasedFailed   = "failed"
+	ErasedNotFound = "not_found" //所有数据中都没有这个人员
+	ErasedNotOwned = "not_owned" //不是服务器保存的数据，没有删除，由数据的所有者处理
+)
+
+//Erased 删除凭证中的一项
+type Erased struct {
+	Store   string    `json:"store,omitempty"` //为空表示所有位置
+	Gallery string    `json:"gallery,omitempty"`
+	Item    string    `json:"item,omitempty"`  //文件名或者照片路径
+	Count   int       `json:"count,omitempty"` //模板或者索引节点的数目
+	Torn    int       `json:"torn,omitempty"`  //事件和考勤日志中同时删除的无法解析的行（进程崩溃时写了一半），可能属于这个人员
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+//Receipt 删除凭证，列出删除的数据和时间，用服务器的 ed25519 密钥签名
+//签名的内容是 Signature 为空时的 json，用 VerifyReceipt 验证
+type Receipt struct {
+	ReceiptID string    `json:"receipt_id"`
+	PersonID  string    `json:"person_id"`
+	Requested time.Time `json:"requested"`
+	Completed time.Time `json:"completed"`
+	Complete  bool      `json:"complete"` //没有删除失败的项
+	Erased    []Erased  `json:"erased"`
+	KeyID     string    `json:"key_id"`
+	PublicKey string    `json:"public_key"`
+	Signature string    `json:"signature,omitempty"`
+}
+
+//purge 命令：从所有图库中彻底删除人员，应答的 data 为签名的删除凭证
+//没有找到人员时结果为 PErrorNotFound，凭证中说明没有这个人员的数据
+func (app *App) purge(ctx context.Context, r *face.Request) face.Response {
+	resp := face.Response{ID: r.ID, Cmd: r.Cmd}
+	if len(r.PersonID) == 0 {
+		resp.Result = face.PErrorParameters
+		return resp
+	}
+	receipt, err := app.purgePerson(r.PersonID)
+	if err != nil {
+		glog.V(LERROR).Infof("purge %s failed: %+v", r.PersonID, err)
+		resp.Result = face.PErrorStorage
+		return resp
+	}
+	resp.Data = receipt
+	switch {
+	case !receipt.Complete:
+		resp.Result = face.PErrorStorage
+	case len(receipt.Erased) == 1 && receipt.Erased[0].Status == ErasedNotFound:
+		resp.Result = face.PErrorNotFound
+	}
+	return resp
+}
+
+//purgePerson 删除人员在所有图库中的数据以及登记照片的副本，返回签名的凭证
+//客户端提供的照片路径只列在凭证中，不删除：这些文件属于客户端，路径也可能已经指向别的文件
+//只有签名失败时返回错误，删除失败的项记录在凭证中
+func (app *App) purgePerson(id string) (*Receipt, error) {
+	priv := app.receipt
+	receipt := &Receipt{PersonID: id, Requested: time.Now(), Complete: true}
+	fail := func(e Erased, err error) {
+		e.Status, e.Error, e.Time = ErasedFailed, err.Error(), time.Now()
+		receipt.Erased = append(receipt.Erased, e)
+		receipt.Complete = false
+	}
+	var sources []string
+	for _, info := range app.galleries.List() {
+		g, err := app.galleries.Get(info.Name)
+		if err != nil {
+			continue
+		}
+		p, err := g.Purge(id)
+		if err == gallery.ErrNotFound {
+			continue
+		}
+		now := time.Now()
+		if p != nil {
+			if len(p.File) > 0 {
+				receipt.Erased = append(receipt.Erased, Erased{Store: StorePerson, Gallery: info.Name, Item: p.File,
+					Count: p.Templates, Status: ErasedDeleted, Time: now})
+			}
+			for _, name := range p.Logs {
+				receipt.Erased = append(receipt.Erased, Erased{Store: StoreWAL, Gallery: info.Name, Item: name,
+					Status: ErasedDeleted, Time: now})
+			}
+			if p.Nodes > 0 || p.Index {
+				e := Erased{Store: StoreIndex, Gallery: info.Name, Count: p.Nodes, Status: ErasedDeleted, Time: now}
+				if p.Index {
+					e.Item = "index.hnsw"
+				}
+				receipt.Erased = append(receipt.Erased, e)
+			}
+			sources = append(sources, p.Sources...)
+			for _, name := range p.Images {
+				e := Erased{Store: StoreImage, Gallery: info.Name, Item: name}
+				err := g.RemoveImage(name)
+				switch {
+				case err == nil:
+					e.Status, e.Time = ErasedDeleted, time.Now()
+					receipt.Erased = append(receipt.Erased, e)
+				case os.IsNotExist(err):
+					e.Status, e.Time = ErasedAbsent, time.Now()
+					receipt.Erased = append(receipt.Erased, e)
+				default:
+					fail(e, err)
+				}
+			}
+		}
+		if err != nil {
+			fail(Erased{Store: StorePerson, Gallery: info.Name}, err)
+		}
+	}
+	//同一张照片可能登记到多个图库
+	seen := make(map[string]bool)
+	for _, name := range sources {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		receipt.Erased = append(receipt.Erased, Erased{Store: StoreSource, Item: name, Status: ErasedNotOwned, Time: time.Now()})
+	}
+	if app.eventLog != nil {
+		purged, err := app.eventLog.Purge(id)
+		for _, p := range purged {
+			receipt.Erased = append(receipt.Erased, Erased{Store: StoreEvents, Item: p.File, Count: p.Count, Torn: p.Torn,
+				Status: ErasedDeleted, Time: time.Now()})
+		}
+		if err != nil {
+			fail(Erased{Store: StoreEvents}, err)
+		}
+	}
+	if app.checkins != nil {
+		purged, err := app.checkins.Purge(id)
+		for _, p := range purged {
+			receipt.Erased = append(receipt.Erased, Erased{Store: StoreAttendance, Item: p.File, Count: p.Count, Torn: p.Torn,
+				Status: ErasedDeleted, Time: time.Now()})
+		}
+		if err != nil {
+			fail(Erased{Store: StoreAttendance}, err)
+		}
+	}
+	if len(receipt.Erased) == 0 {
+		receipt.Erased = append(receipt.Erased, Erased{Status: ErasedNotFound, Time: time.Now()})
+	}
+	receipt.Completed = time.Now()
+	if err := signReceipt(receipt, priv); err != nil {
+		return nil, err
+	}
+	glog.V(LVERBOSE).Infof("person %s purged, receipt %s, complete:%v", id, receipt.ReceiptID, receipt.Complete)
+	return receipt, nil
+}
+
+//loadReceiptKey 读取签名密钥，启动时调用一次，文件内容是 base64 编码的 32 字节 ed25519 种子
+//没有指定密钥文件时使用数据目录中的 receipt.key，不存在时生成
+func (app *App) loadReceiptKey() (ed25519.PrivateKey, error) {
+	name := app.conf.ReceiptKey
+	if len(name) == 0 {
+		name = filepath.Join(app.dataDir(), receiptKeyName)
+		if err := createReceiptKey(name); err != nil {
+			return nil, err
+		}
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "read receipt key failed")
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.Errorf("%s: receipt key must be %d bytes in base64", name, ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+//createReceiptKey name 不存在时生成签名密钥：先写入 O_EXCL 创建的临时文件并落盘，再用硬链接发布，
+//已经存在时链接失败，不会覆盖别的进程同时生成的密钥，也不会读到写了一半的文件
+func createReceiptKey(name string) error {
+	if _, err := os.Stat(name); err == nil {
+		return nil
+	}
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return errors.Wrap(err, "generate receipt key failed")
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+receiptKeyName+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "create receipt key failed")
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	_, err = f.WriteString(base64.StdEncoding.EncodeToString(seed) + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "write %s failed", tmp)
+	}
+	if err = os.Link(tmp, name); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "create %s failed", name)
+	}
+	if d, err := os.Open(filepath.Dir(name)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	glog.V(LVERBOSE).Infof("receipt signing key generated: %s", name)
+	return nil
+}
+
+//receiptKeyText 签名密钥的公钥，shell 命令 receipt_key 使用，公开以后第三方可以验证凭证
+func (app *App) receiptKeyText() string {
+	pub := app.receipt.Public().(ed25519.PublicKey)
+	return "key_id:" + keyID(pub) + " public_key:" + base64.StdEncoding.EncodeToString(pub)
+}
+
+//keyID 公钥的指纹，sha256 的前8字节
+func keyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+func signReceipt(r *Receipt, priv ed25519.PrivateKey) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return errors.Wrap(err, "generate receipt id failed")
+	}
+	pub := priv.Public().(ed25519.PublicKey)
+	r.ReceiptID = hex.EncodeToString(id)
+	r.KeyID = keyID(pub)
+	r.PublicKey = base64.StdEncoding.EncodeToString(pub)
+	r.Signature = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "marshal receipt failed")
+	}
+	r.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data))
+	return nil
+}
+
+//VerifyReceipt 验证删除凭证的签名，publicKey 为空时使用凭证中的公钥，这时只能证明凭证没有被修改，
+//还需要确认 key_id 是服务器公开的密钥
+func VerifyReceipt(data []byte, publicKey string) (*Receipt, error) {
+	r := &Receipt{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, errors.Wrap(err, "parse receipt failed")
+	}
+	if len(publicKey) == 0 {
+		publicKey = r.PublicKey
+	}
+	pub, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil {
+		return nil, errors.New("invalid signature")
+	}
+	unsigned := *r
+	unsigned.Signature = ""
+	signed, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(pub, signed, sig) {
+		return nil, errors.New("signature mismatch: the receipt was modified or signed by another key")
+	}
+	return r, nil
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"faceserver/face"
+	"faceserver/gallery"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+//人员在重新登记期间被修改时最多重试的次数
+const reenrollRetries = 3
+
+//startReenroll 在后台重新登记图库，shell 命令使用，用 gallery_progress 查询进度
+func (app *App) startReenroll(target string) (*Transfer, error) {
+	g, err := app.galleries.Get(target)
+	if err != nil {
+		return nil, errors.Wrap(err, target)
+	}
+	if app.transfers.running(reenrollName(g)) {
+		return nil, errors.Errorf("gallery %s is already being re-enrolled", g.Config().Name)
+	}
+	t := newTransfer(OpReenroll, reenrollName(g), target)
+	app.transfers.add(t)
+	go func() {
+		if err := app.transfer(app.ctx, t); err != nil {
+			glog.V(LERROR).Infof("reenroll %s failed: %+v", t.Gallery, err)
+		}
+	}()
+	return t, nil
+}
+
+//reenrollName 重新登记任务在 transfers 中的名称，同一个图库同时只能有一个重新登记任务
+func reenrollName(g *gallery.Gallery) string {
+	return "gallery:" + g.Config().Name
+}
+
+//reenrollGallery 模型升级以后，用登记时保存的照片副本重新提取特征：
+//先把图库的模型版本改为引擎的版本，索引中只剩下新版本的模板，随着重新登记逐步恢复，
+//没有照片副本或者重新提取失败的模板保留为旧版本，不参与检索，需要重新登记这个人员
+func (app *App) reenrollGallery(ctx context.Context, g *gallery.Gallery, t *Transfer) error {
+	if !app.engine {
+		return errors.New("engine is not available")
+	}
+	version := face.GetFaceInstance().TemplateVersion(g.Config().Name)
+	if len(version) == 0 {
+		return errors.New("engine model version is unknown")
+	}
+	if err := g.Upgrade(version); err != nil {
+		return err
+	}
+	var ids []string
+	g.Export(func(p *gallery.Person) error {
+		for _, tpl := range p.Templates {
+			if reextract(tpl, version) {
+				ids = append(ids, p.ID)
+				break
+			}
+		}
+		return nil
+	})
+	forEach(ctx, len(ids), func(i int) {
+		err := gallery.ErrModified
+		for retry := 0; retry < reenrollRetries && err == gallery.ErrModified; retry++ {
+			err = app.reenrollPerson(ctx, g, t, ids[i])
+		}
+		if err != nil && err != gallery.ErrNotFound {
+			//重试以后仍然被修改，或者保存失败，人员的旧版本模板都没有更新
+			if err == gallery.ErrModified {
+				err = errors.Errorf("modified during %d retries", reenrollRetries)
+			}
+			glog.V(LERROR).Infof("reenroll %s/%s failed: %+v", t.Gallery, ids[i], err)
+			atomic.AddInt64(&t.failed, staleTemplates(g, ids[i]))
+		}
+		atomic.AddInt64(&t.persons, 1)
+	})
+	return ctx.Err()
+}
+
+//staleTemplates 人员中不是图库版本的模板数目，重新登记失败时计入 failed；人员已经删除时为0，读取失败时按一个计算
+func staleTemplates(g *gallery.Gallery, id string) int64 {
+	p, err := g.Get(id)
+	if err == gallery.ErrNotFound {
+		return 0
+	}
+	if err != nil {
+		return 1
+	}
+	version := g.ModelVersion()
+	n := int64(0)
+	for _, tpl := range p.Templates {
+		if tpl.ModelVersion != version {
+			n++
+		}
+	}
+	return n
+}
+
+//reextract 模板是否需要用照片重新提取，没有版本的旧模板有照片副本时也重新提取
+//只使用登记时保存在图库中的副本，客户端的照片路径可能已经不是原来的照片
+func reextract(tpl gallery.Template, version string) bool {
+	return tpl.ModelVersion != version && len(tpl.Image) > 0
+}
+
+//reenrollPerson 重新提取一个人员的旧版本模板，人员在提取期间被修改时返回 gallery.ErrModified
+func (app *App) reenrollPerson(ctx context.Context, g *gallery.Gallery, t *Transfer, id string) error {
+	p, err := g.Get(id)
+	if err != nil {
+		return err
+	}
+	version := g.ModelVersion()
+	templates := make([]gallery.Template, 0, len(p.Templates))
+	var added, failed int64
+	for _, tpl := range p.Templates {
+		if !reextract(tpl, version) {
+			//其他版本（包括没有版本）的模板没有照片副本，只能保留为旧版本
+			if tpl.ModelVersion != version {
+				failed++
+			}
+			templates = append(templates, tpl)
+			continue
+		}
+		photo, err := g.LoadImage(tpl.Image)
+		if err != nil {
+			glog.V(LERROR).Infof("reenroll %s/%s: load %s failed: %v", t.Gallery, id, tpl.Image, err)
+			failed++
+			templates = append(templates, tpl)
+			continue
+		}
+		r := &face.Request{
+			ConnId:   face.InternalConn,
+			ID:       OpReenroll,
+			Cmd:      face.CmdEnroll,
+			Priority: face.PriorityBulk,
+			Inputs:   []face.Input{{Type: face.TypeBase64, Content: base64.StdEncoding.EncodeToString(photo)}},
+			Gallery:  g.Config().Name,
+		}
+		extracted, _, code := app.templates(ctx, r)
+		if code != 0 {
+			glog.V(LERROR).Infof("reenroll %s/%s: %s result %d", t.Gallery, id, tpl.Image, code)
+			failed++
+			templates = append(templates, tpl)
+			continue
+		}
+		//保留原来的登记时间、照片路径和副本
+		extracted[0].Created, extracted[0].Source, extracted[0].Image = tpl.Created, tpl.Source, tpl.Image
+		extracted[0].Photo = nil
+		templates = append(templates, extracted[0])
+		added++
+	}
+	if added == 0 {
+		atomic.AddInt64(&t.failed, failed)
+		return nil
+	}
+	if _, err = g.ReplaceTemplates(p, templates); err != nil {
+		return err
+	}
+	atomic.AddInt64(&t.templates, added)
+	atomic.AddInt64(&t.failed, failed)
+	return nil
+}
@@ -9,9 +9,16 @@ import (
 	"github.com/pkg/errors"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+//connConfig 每个连接的发送队列配置
+type connConfig struct {
+	QueueSize int    //发送队列长度
+	Policy    string //发送队列满了以后的策略，PolicyDrop 或者 PolicyDisconnect
+}
+
 //server websocket服务器
 type server struct {
 	upgrader websocket.Upgrader
@@ -23,11 +30,15 @@ type server struct {
 	addr     string
 	conns    map[uint32]*wsConn //所有的连接
 	seq      uint32
+	conf     connConfig
+	handlers map[string]handler //需要服务器编排的命令，其他命令直接交给人脸特征提取模块
+	jobs     *jobs
+	closed   func(connId uint32) //连接关闭以后调用，清理连接上的订阅
 	mu       sync.Mutex
 }
 
 //创建服务器对象
-func newServer(addr string) *server {
+func newServer(addr string, conf connConfig) *server {
 	s := &server{
 		upgrader: websocket.Upgrader{
 			HandshakeTimeout: 30 * time.Second,
@@ -41,8 +52,11 @@ func newServer(addr string) *server {
 		cancel: nil,
 		quit:   make(chan struct{}),
 		addr:   addr,
-		seq:    0,
-		conns:  make(map[uint32]*wsConn),
+		seq:    1, //0 保留给服务器内部发起的请求
+		conf:     conf,
+		conns:    make(map[uint32]*wsConn),
+		handlers: make(map[string]handler),
+		jobs:     newJobs(),
 	}
 	s.ctx, s.cancel = context.WithCancel(context.Background())
 	return s
@@ -74,6 +88,34 @@ func (s *server) close() error {
 	return nil
 }
 
+//注册一个命令的处理方法，必须在 start 之前调用
+func (s *server) handle(cmd string, h handler) {
+	s.handlers[cmd] = h
+}
+
+//分发一个客户端请求
+func (s *server) onRequest(r *face.Request) {
+	if h, ok := s.handlers[r.Cmd]; ok {
+		s.runJob(h, r)
+		return
+	}
+	//提交给人脸特征提取模块处理
+	face.GetFaceInstance().DoFeature(r)
+}
+
+//取消connId连接上标识为id的请求，id为空时取消该连接上所有的请求
+func (s *server) cancelRequest(connId uint32, id string) bool {
+	found := s.jobs.cancel(connId, id)
+	if len(id) == 0 {
+		face.GetFaceInstance().CancelConn(connId)
+		return found
+	}
+	if face.GetFaceInstance().Cancel(connId, id) {
+		found = true
+	}
+	return found
+}
+
 //处理新的连接
 func (s *server) handleConn(w http.ResponseWriter, r *http.Request) {
 	ws, err := s.upgrader.Upgrade(w, r, nil)
@@ -81,12 +123,19 @@ func (s *server) handleConn(w http.ResponseWriter, r *http.Request) {
 		glog.V(1).Infof("Upgrade failed : %+v\n", err)
 		return
 	}
-	conn := newConn(ws, s.seq, s)
+	//多个连接可能同时建立，连接标识在锁内分配，跳过内部请求保留的标识
+	s.mu.Lock()
+	seq := s.seq
+	s.seq++
+	if s.seq == face.InternalConn {
+		s.seq++
+	}
+	s.mu.Unlock()
+	conn := newConn(ws, seq, s)
 	conn.onClosed = s.onClosed
-	s.onOpen(s.seq, conn)
+	s.onOpen(seq, conn)
 	s.wg.Add(1)
 	conn.start()
-	s.seq++
 }
 
 func (s *server) onOpen(seq uint32, conn *wsConn) {
@@ -97,22 +146,57 @@ func (s *server) onOpen(seq uint32, conn *wsConn) {
 
 func (s *server) onClosed(seq uint32) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	delete(s.conns, seq)
+	s.mu.Unlock()
+	if s.closed != nil {
+		s.closed(seq)
+	}
 }
 
 //从connId找到对应的连接，并将response发送过去
+//只在查找连接时持有锁，发送本身不会阻塞
 func (s *server) send(connId uint32, resp face.Response) {
+	s.mu.Lock()
+	c, ok := s.conns[connId]
+	s.mu.Unlock()
+	if ok {
+		c.send(resp)
+	}
+}
+
+//connected 连接是否还没有关闭，连接关闭时先从 conns 中删除，再调用 closed
+func (s *server) connected(connId uint32) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if c, ok := s.conns[connId]; ok {
-		c.writeCh <- resp
+	_, ok := s.conns[connId]
+	return ok
+}
+
+//push 和 send 相同，但是发送队列满了时等待，直到放入队列、ctx 结束或者服务器退出
+//连接不存在或者没有放入队列时返回 false，用于推送订阅的事件，积压在订阅自己的缓冲区中
+func (s *server) push(ctx context.Context, connId uint32, resp face.Response) bool {
+	s.mu.Lock()
+	c, ok := s.conns[connId]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case c.writeCh <- resp:
+		return true
+	case <-ctx.Done():
+	case <-s.ctx.Done():
 	}
+	return false
 }
 
 func (s *server) State() string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	n := len(s.conns)
-	return fmt.Sprintf("connection count: %d", n)
+	var dropped uint64
+	for _, c := range s.conns {
+		dropped += atomic.LoadUint64(&c.dropped)
+	}
+	return fmt.Sprintf("connection count: %d, dropped responses: %d", n, dropped)
 }
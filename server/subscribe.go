@@ -0,0 +1,277 @@
+package server
+
+import (
+	"context"
+	"faceserver/face"
+	"faceserver/gallery"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+//订阅的事件缓冲区长度
+const (
+	defaultSubscribeBuffer = 256
+	maxSubscribeBuffer     = 4096
+)
+
+//推送事件的类型
+const (
+	EventMatch   = "match"   //请求中的人脸命中了名单中的人员
+	EventDropped = "dropped" //客户端太慢，缓冲区满了，丢弃了 Dropped 个事件
+)
+
+//AlertEvent 推送给订阅者的事件，应答的 id 为订阅请求的标识，cmd 为 subscribe
+type AlertEvent struct {
+	Type     string            `json:"type"`
+	Time     time.Time         `json:"time"`
+	Gallery  string            `json:"gallery,omitempty"`
+	PersonID string            `json:"person_id,omitempty"`
+	Score    float64           `json:"score,omitempty"`
+	Meta     map[string]string `json:"meta,omitempty"`
+	Source   string            `json:"source,omitempty"` //出现人脸的请求的来源标签
+	Cmd      string            `json:"cmd,omitempty"`    //出现人脸的请求的命令
+	Face     *face.FaceFeature `json:"face,omitempty"`   //出现的人脸，不包含特征
+	Dropped  uint64            `json:"dropped,omitempty"`
+}
+
+//SubscribeResult subscribe 的应答，之后的事件使用相同的 id
+type SubscribeResult struct {
+	Gallery  string  `json:"gallery"`
+	MinScore float64 `json:"min_score"`
+	Source   string  `json:"source,omitempty"`
+	Buffer   int     `json:"buffer"`
+}
+
+//subscription 一个订阅，事件先放入有界的缓冲区，由转发协程按照连接发送队列的速度发送
+type subscription struct {
+	id       string
+	connID   uint32
+	gallery  string
+	minScore float64
+	source   string
+	events   chan face.Response
+	dropped  uint64 //缓冲区满了丢弃的事件数，下一次发送事件以前通知客户端
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+//offer 放入缓冲区，不会阻塞发布方
+func (s *subscription) offer(resp face.Response) {
+	select {
+	case s.events <- resp:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+//watchlist 所有连接的订阅
+type watchlist struct {
+	mu    sync.RWMutex
+	subs  map[uint32]map[string]*subscription
+	count int32
+}
+
+//add 登记订阅，返回请求的结果：标识已经存在时为 PErrorExists，连接已经关闭时为 PErrorNotFound
+//connected 在持有锁时检查连接：连接关闭时先注销连接再取消订阅，检查通过的订阅一定会被取消，不会遗留
+func (w *watchlist) add(s *subscription, connected func(connID uint32) bool) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !connected(s.connID) {
+		return face.PErrorNotFound
+	}
+	if w.subs == nil {
+		w.subs = make(map[uint32]map[string]*subscription)
+	}
+	m, ok := w.subs[s.connID]
+	if !ok {
+		m = make(map[string]*subscription)
+		w.subs[s.connID] = m
+	}
+	if _, ok := m[s.id]; ok {
+		return face.PErrorExists
+	}
+	m[s.id] = s
+	atomic.AddInt32(&w.count, 1)
+	return 0
+}
+
+//remove 取消连接上标识为 id 的订阅，id 为空时取消连接上的所有订阅
+func (w *watchlist) remove(connID uint32, id string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	found := false
+	for sid, s := range w.subs[connID] {
+		if len(id) == 0 || sid == id {
+			s.cancel()
+			delete(w.subs[connID], sid)
+			atomic.AddInt32(&w.count, -1)
+			found = true
+		}
+	}
+	if len(w.subs[connID]) == 0 {
+		delete(w.subs, connID)
+	}
+	return found
+}
+
+//String 列出所有订阅，shell 命令 subscriptions 使用
+func (w *watchlist) String() string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	b := strings.Builder{}
+	for conn, m := range w.subs {
+		for _, s := range m {
+			fmt.Fprintf(&b, "conn:%d id:%s gallery:%s min_score:%g source:%s buffered:%d/%d dropped:%d\n",
+				conn, s.id, s.gallery, s.minScore, s.source, len(s.events), cap(s.events), atomic.LoadUint64(&s.dropped))
+		}
+	}
+	if b.Len() == 0 {
+		return "no subscription"
+	}
+	return b.String()
+}
+
+//match 来源为 source 的请求需要检查的订阅，按照图库分组
+func (w *watchlist) match(source string) map[string][]*subscription {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	groups := make(map[string][]*subscription)
+	for _, m := range w.subs {
+		for _, s := range m {
+			if len(s.source) == 0 || s.source == source {
+				groups[s.gallery] = append(groups[s.gallery], s)
+			}
+		}
+	}
+	return groups
+}
+
+//subscribe 命令：订阅 gallery 的命中事件，可以按照最低相似度和来源过滤
+func (app *App) subscribe(ctx context.Context, r *face.Request) face.Response {
+	resp := face.Response{ID: r.ID, Cmd: r.Cmd}
+	g, code := app.galleryOf(r)
+	if code != 0 {
+		resp.Result = code
+		return resp
+	}
+	if len(r.ID) == 0 || r.Buffer < 0 || r.MinScore < 0 || r.MinScore > 1 {
+		resp.Result = face.PErrorParameters
+		return resp
+	}
+	buffer := r.Buffer
+	if buffer == 0 {
+		buffer = defaultSubscribeBuffer
+	}
+	if buffer > maxSubscribeBuffer {
+		buffer = maxSubscribeBuffer
+	}
+	minScore := r.MinScore
+	if minScore == 0 {
+		minScore = app.threshold(r, g)
+	}
+	s := &subscription{
+		id:       r.ID,
+		connID:   r.ConnId,
+		gallery:  g.Config().Name,
+		minScore: minScore,
+		source:   r.Source,
+		events:   make(chan face.Response, buffer),
+	}
+	//订阅的生命周期和连接相同，不受请求的 ctx 影响
+	s.ctx, s.cancel = context.WithCancel(app.ctx)
+	if resp.Result = app.watch.add(s, app.ws.connected); resp.Result != 0 {
+		s.cancel()
+		return resp
+	}
+	go app.forward(s)
+	glog.V(LVERBOSE).Infof("conn[%d] subscribed %s to gallery %s, min score %g", s.connID, s.id, s.gallery, s.minScore)
+	resp.Data = SubscribeResult{Gallery: s.gallery, MinScore: s.minScore, Source: s.source, Buffer: buffer}
+	return resp
+}
+
+//unsubscribe 命令：取消标识为 id 的订阅
+func (app *App) unsubscribe(ctx context.Context, r *face.Request) face.Response {
+	resp := face.Response{ID: r.ID, Cmd: r.Cmd}
+	if !app.watch.remove(r.ConnId, r.ID) {
+		resp.Result = face.PErrorNotFound
+	}
+	return resp
+}
+
+//forward 把缓冲区中的事件交给连接的发送队列，队列满了时等待，事件积压在订阅的缓冲区中
+//连接已经关闭时（订阅和关闭同时发生）取消订阅
+func (app *App) forward(s *subscription) {
+	defer app.watch.remove(s.connID, s.id)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case resp := <-s.events:
+			if n := atomic.SwapUint64(&s.dropped, 0); n > 0 {
+				notice := face.Response{ID: s.id, Cmd: face.CmdSubscribe,
+					Data: AlertEvent{Type: EventDropped, Time: time.Now(), Gallery: s.gallery, Dropped: n}}
+				if !app.ws.push(s.ctx, s.connID, notice) {
+					return
+				}
+			}
+			if !app.ws.push(s.ctx, s.connID, resp) {
+				return
+			}
+		}
+	}
+}
+
+//publish 在订阅的图库中检索请求中出现的人脸，命中时推送给订阅者
+//没有订阅时直接返回，否则在后台检索，不延迟请求的应答
+func (app *App) publish(cmd, source string, faces []face.FaceFeature) {
+	if atomic.LoadInt32(&app.watch.count) == 0 || len(faces) == 0 {
+		return
+	}
+	go func() {
+		for name, subs := range app.watch.match(source) {
+			g, err := app.galleries.Get(name)
+			if err != nil {
+				continue
+			}
+			app.alert(g, subs, cmd, source, faces)
+		}
+	}()
+}
+
+//alert 每张人脸只检索最相似的人员，得分不低于订阅的最低相似度时推送
+func (app *App) alert(g *gallery.Gallery, subs []*subscription, cmd, source string, faces []face.FaceFeature) {
+	min := subs[0].minScore
+	for _, s := range subs {
+		if s.minScore < min {
+			min = s.minScore
+		}
+	}
+	for i := range faces {
+		m, err := face.ParseMetric(faces[i].Metric)
+		if err != nil {
+			continue
+		}
+		matches, err := g.Search(m, faces[i].ModelVersion, 1, min)
+		if err != nil || len(matches) == 0 {
+			continue
+		}
+		f := faces[i]
+		f.Metric = ""
+		f.Candidates = nil
+		ev := AlertEvent{Type: EventMatch, Time: time.Now(), Gallery: g.Config().Name, PersonID: matches[0].ID,
+			Score: matches[0].Score, Source: source, Cmd: cmd, Face: &f}
+		if p, err := g.Get(matches[0].ID); err == nil {
+			ev.Meta = p.Meta
+		}
+		for _, s := range subs {
+			if ev.Score >= s.minScore {
+				s.offer(face.Response{ID: s.id, Cmd: face.CmdSubscribe, Data: ev})
+			}
+		}
+	}
+}
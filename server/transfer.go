@@ -0,0 +1,484 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"faceserver/face"
+	"faceserver/gallery"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+//导入导出的操作
+const (
+	OpImport   = "import"
+	OpExport   = "export"
+	OpReenroll = "reenroll" //模型升级以后重新提取图库的模板
+)
+
+//导入时并发处理的行数，照片需要提取特征，并发可以让引擎保持忙碌
+const importWorkers = 4
+
+//每处理多少行保存一次导入进度
+const checkpointRows = 200
+
+//Transfer 一次导入或者导出的进度
+type Transfer struct {
+	Op      string
+	File    string
+	Gallery string
+	Started time.Time
+
+	rows       int64 //已经处理的行数，不包括上次已经导入的行
+	resumed    int64 //从上次保存的进度继续时跳过的行数
+	persons    int64 //导出或者重新登记的人员数目
+	templates  int64 //追加或者重新提取的模板数目
+	duplicates int64 //和已有模板重复而跳过的模板数目
+	failed     int64 //出错的行数，重新登记时为不能重新提取的模板数目
+
+	mu       sync.Mutex
+	finished time.Time
+	err      error
+}
+
+func newTransfer(op, file, name string) *Transfer {
+	if len(name) == 0 {
+		name = gallery.DefaultName
+	}
+	return &Transfer{Op: op, File: file, Gallery: name, Started: time.Now()}
+}
+
+func (t *Transfer) finish(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finished = time.Now()
+	t.err = err
+}
+
+//Done 是否已经结束以及结束的原因
+func (t *Transfer) Done() (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.finished.IsZero(), t.err
+}
+
+func (t *Transfer) String() string {
+	t.mu.Lock()
+	state := "running"
+	elapsed := time.Since(t.Started)
+	if !t.finished.IsZero() {
+		state = "done"
+		if t.err != nil {
+			state = "failed: " + t.err.Error()
+		}
+		elapsed = t.finished.Sub(t.Started)
+	}
+	t.mu.Unlock()
+	if t.Op == OpRotate {
+		return fmt.Sprintf("rotate key:%s files:%d encrypted:%d elapsed:%v state:%s",
+			t.Gallery, atomic.LoadInt64(&t.rows), atomic.LoadInt64(&t.templates), elapsed.Truncate(time.Millisecond), state)
+	}
+	if t.Op == OpReenroll {
+		return fmt.Sprintf("reenroll gallery:%s persons:%d templates:%d failed:%d elapsed:%v state:%s",
+			t.Gallery, atomic.LoadInt64(&t.persons), atomic.LoadInt64(&t.templates), atomic.LoadInt64(&t.failed),
+			elapsed.Truncate(time.Millisecond), state)
+	}
+	if t.Op == OpExport {
+		return fmt.Sprintf("export %s gallery:%s persons:%d elapsed:%v state:%s",
+			t.File, t.Gallery, atomic.LoadInt64(&t.persons), elapsed.Truncate(time.Millisecond), state)
+	}
+	return fmt.Sprintf("import %s gallery:%s rows:%d resumed:%d templates:%d duplicates:%d failed:%d elapsed:%v state:%s",
+		t.File, t.Gallery, atomic.LoadInt64(&t.rows), atomic.LoadInt64(&t.resumed), atomic.LoadInt64(&t.templates),
+		atomic.LoadInt64(&t.duplicates), atomic.LoadInt64(&t.failed), elapsed.Truncate(time.Millisecond), state)
+}
+
+//transfers 最近的导入导出任务，用于查询进度
+type transfers struct {
+	mu   sync.Mutex
+	list []*Transfer
+}
+
+//最多保留的任务数目
+const maxTransfers = 16
+
+func (ts *transfers) add(t *Transfer) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.list = append(ts.list, t)
+	if len(ts.list) > maxTransfers {
+		ts.list = ts.list[len(ts.list)-maxTransfers:]
+	}
+}
+
+//running 文件是否正在被导入或者导出
+func (ts *transfers) running(file string) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, t := range ts.list {
+		if done, _ := t.Done(); !done && t.File == file {
+			return true
+		}
+	}
+	return false
+}
+
+func (ts *transfers) String() string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if len(ts.list) == 0 {
+		return "no transfer"
+	}
+	b := strings.Builder{}
+	for _, t := range ts.list {
+		b.WriteString(t.String())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+//startTransfer 在后台导入或者导出图库，shell 命令使用
+func (app *App) startTransfer(op, name, target string) (*Transfer, error) {
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	if app.transfers.running(name) {
+		return nil, errors.Errorf("%s is already in progress", name)
+	}
+	if _, err = app.galleries.Get(target); err != nil {
+		return nil, errors.Wrap(err, target)
+	}
+	t := newTransfer(op, name, target)
+	app.transfers.add(t)
+	go func() {
+		err := app.transfer(app.ctx, t)
+		if err != nil {
+			glog.V(LERROR).Infof("%s %s failed: %+v", op, name, err)
+		}
+	}()
+	return t, nil
+}
+
+//transfer 执行导入或者导出，结束时记录结果
+func (app *App) transfer(ctx context.Context, t *Transfer) error {
+	g, err := app.galleries.Get(t.Gallery)
+	if err == nil {
+		switch t.Op {
+		case OpExport:
+			err = app.exportGallery(g, t)
+		case OpReenroll:
+			err = app.reenrollGallery(ctx, g, t)
+		default:
+			err = app.importGallery(ctx, g, t)
+		}
+	}
+	t.finish(err)
+	return err
+}
+
+//exportGallery 把图库导出到文件，先写临时文件再改名
+func (app *App) exportGallery(g *gallery.Gallery, t *Transfer) error {
+	f, err := ioutil.TempFile(filepath.Dir(t.File), "."+filepath.Base(t.File)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "create temp file failed")
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	buf := bufio.NewWriterSize(f, 1<<16)
+	w, err := gallery.NewRecordWriter(buf, gallery.FormatOf(t.File))
+	if err != nil {
+		return err
+	}
+	err = g.Export(func(p *gallery.Person) error {
+		rec := &gallery.Record{PersonID: p.ID, Meta: p.Meta}
+		versions := false
+		for _, tpl := range p.Templates {
+			rec.Metrics = append(rec.Metrics, face.FormatMetric(tpl.Metric))
+			rec.Qualities = append(rec.Qualities, tpl.Quality)
+			rec.ModelVersions = append(rec.ModelVersions, tpl.ModelVersion)
+			versions = versions || len(tpl.ModelVersion) > 0
+		}
+		if !versions {
+			rec.ModelVersions = nil
+		}
+		atomic.AddInt64(&t.persons, 1)
+		return w.Write(rec)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "write %s failed", tmp)
+	}
+	if err = w.Flush(); err != nil {
+		return errors.Wrapf(err, "write %s failed", tmp)
+	}
+	if err = buf.Flush(); err != nil {
+		return errors.Wrapf(err, "write %s failed", tmp)
+	}
+	if err = f.Sync(); err != nil {
+		return errors.Wrapf(err, "sync %s failed", tmp)
+	}
+	if err = f.Close(); err != nil {
+		return errors.Wrapf(err, "close %s failed", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, t.File), "rename %s failed", tmp)
+}
+
+//importProgress 导入进度，保存在 <文件名>.progress 中，文件的大小和修改时间变化以后进度作废
+type importProgress struct {
+	Rows    int       `json:"rows"` //这一行以及之前的行都已经导入
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+//importError 出错的行，追加到 <文件名>.errors 中
+type importError struct {
+	Row      int    `json:"row"`
+	PersonID string `json:"person_id,omitempty"`
+	Error    string `json:"error"`
+}
+
+//importRow 一行导入的数据，seq 是分发的顺序，用于计算连续完成的行
+type importRow struct {
+	seq int
+	row int
+	rec *gallery.Record
+	err error
+}
+
+//importGallery 从文件导入人员，出错的行记录到 .errors 文件以后继续
+//进度定期保存到 .progress 文件，中断以后再次导入同一个文件会从保存的进度继续，
+//进度之后已经导入的模板因为和已有模板重复会被跳过，导入完成以后删除进度文件
+func (app *App) importGallery(ctx context.Context, g *gallery.Gallery, t *Transfer) error {
+	f, err := os.Open(t.File)
+	if err != nil {
+		return errors.Wrapf(err, "open %s failed", t.File)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	progressName := t.File + ".progress"
+	progress := importProgress{Size: fi.Size(), ModTime: fi.ModTime()}
+	if data, err := ioutil.ReadFile(progressName); err == nil {
+		var saved importProgress
+		if json.Unmarshal(data, &saved) == nil && saved.Size == progress.Size && saved.ModTime.Equal(progress.ModTime) {
+			progress.Rows = saved.Rows
+		}
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if progress.Rows == 0 {
+		flags |= os.O_TRUNC
+	}
+	errFile, err := os.OpenFile(t.File+".errors", flags, 0600)
+	if err != nil {
+		return errors.Wrap(err, "open error file failed")
+	}
+	defer errFile.Close()
+	errLog := json.NewEncoder(errFile)
+
+	rows := make(chan importRow)
+	results := make(chan importRow)
+	wg := sync.WaitGroup{}
+	for i := 0; i < importWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range rows {
+				if r.err == nil {
+					r.err = app.importRecord(ctx, g, t, r.rec)
+				}
+				results <- r
+			}
+		}()
+	}
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(rows)
+		reader := gallery.NewRecordReader(bufio.NewReaderSize(f, 1<<16), gallery.FormatOf(t.File))
+		for seq := 0; ; seq++ {
+			rec, err := reader.Next()
+			if err == io.EOF {
+				readErr <- nil
+				return
+			}
+			if _, ok := err.(*gallery.RecordError); !ok && err != nil {
+				readErr <- err
+				return
+			}
+			if reader.Row() <= progress.Rows {
+				atomic.AddInt64(&t.resumed, 1)
+				seq--
+				continue
+			}
+			select {
+			case rows <- importRow{seq: seq, row: reader.Row(), rec: rec, err: err}:
+			case <-ctx.Done():
+				readErr <- ctx.Err()
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	//只有之前的行全部完成以后，进度才能前进到这一行
+	completed := make(map[int]int)
+	next := 0
+	lastSaved := progress.Rows
+	for r := range results {
+		atomic.AddInt64(&t.rows, 1)
+		if r.err != nil {
+			atomic.AddInt64(&t.failed, 1)
+			e := importError{Row: r.row, Error: r.err.Error()}
+			if re, ok := r.err.(*gallery.RecordError); ok {
+				e.Error = re.Err.Error()
+			}
+			if r.rec != nil {
+				e.PersonID = r.rec.PersonID
+			}
+			errLog.Encode(e)
+		}
+		completed[r.seq] = r.row
+		for {
+			row, ok := completed[next]
+			if !ok {
+				break
+			}
+			delete(completed, next)
+			next++
+			progress.Rows = row
+		}
+		if progress.Rows-lastSaved >= checkpointRows {
+			app.saveProgress(progressName, progress)
+			lastSaved = progress.Rows
+		}
+	}
+	if err = <-readErr; err != nil {
+		app.saveProgress(progressName, progress)
+		return err
+	}
+	os.Remove(progressName)
+	if atomic.LoadInt64(&t.failed) == 0 {
+		errFile.Close()
+		os.Remove(t.File + ".errors")
+	}
+	return nil
+}
+
+func (app *App) saveProgress(name string, p importProgress) {
+	data, _ := json.Marshal(p)
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		glog.V(LERROR).Infof("save import progress %s failed: %+v", name, err)
+	}
+}
+
+//importRecord 导入一行，照片路径是相对路径时相对于导入文件所在的目录
+func (app *App) importRecord(ctx context.Context, g *gallery.Gallery, t *Transfer, rec *gallery.Record) error {
+	if len(rec.PersonID) == 0 {
+		return errors.New("missing person_id")
+	}
+	if len(rec.Images) > 0 && !app.engine {
+		return errors.New("engine is not available, images can not be imported")
+	}
+	r := &face.Request{ConnId: face.InternalConn, ID: OpImport, Cmd: face.CmdEnroll, Priority: face.PriorityBulk, Gallery: g.Config().Name}
+	for i, m := range rec.Metrics {
+		in := face.Input{Metric: m}
+		if i < len(rec.ModelVersions) {
+			in.ModelVersion = rec.ModelVersions[i]
+		}
+		r.Inputs = append(r.Inputs, in)
+	}
+	for _, img := range rec.Images {
+		if !filepath.IsAbs(img) {
+			img = filepath.Join(filepath.Dir(t.File), img)
+		}
+		r.Inputs = append(r.Inputs, face.Input{Type: face.TypeFile, Content: img})
+	}
+	templates, index, result := app.templates(ctx, r)
+	if result != 0 {
+		in := r.Inputs[index]
+		if len(in.Metric) > 0 {
+			return errors.Errorf("metric %d: result %d", index, result)
+		}
+		return errors.Errorf("image %s: result %d", in.Content, result)
+	}
+	//特征在照片之前，质量分数按照顺序对应
+	for i := range rec.Metrics {
+		if i < len(rec.Qualities) {
+			templates[i].Quality = rec.Qualities[i]
+		}
+	}
+	added, err := g.Import(rec.PersonID, rec.Meta, templates)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&t.templates, int64(added))
+	atomic.AddInt64(&t.duplicates, int64(len(templates)-added))
+	return nil
+}
+
+//RunTransfer 不启动服务器，直接导入、导出或者重新登记 target 图库，定期在标准输出打印进度
+//导入的照片需要引擎，引擎初始化失败时只能导入特征；重新登记必须有引擎
+func (app *App) RunTransfer(op, name, target string) error {
+	var err error
+	if op != OpReenroll {
+		if name, err = filepath.Abs(name); err != nil {
+			return err
+		}
+	}
+	if op != OpExport {
+		if err = face.GetFaceInstance().Init(); err != nil {
+			if op == OpReenroll {
+				return err
+			}
+			glog.V(LERROR).Infof("init engine failed, only metrics can be imported: %+v", err)
+		} else {
+			app.engine = true
+			defer face.GetFaceInstance().UnInit()
+		}
+	}
+	app.galleries, err = gallery.OpenStore(app.dataDir(), app.conf.Index)
+	if err != nil {
+		return err
+	}
+	defer app.galleries.Close()
+
+	t := newTransfer(op, name, target)
+	if op == OpReenroll {
+		g, err := app.galleries.Get(target)
+		if err != nil {
+			return errors.Wrap(err, target)
+		}
+		t.File = reenrollName(g)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- app.transfer(app.ctx, t)
+	}()
+	tick := time.NewTicker(2 * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case err = <-done:
+			fmt.Println(t.String())
+			return err
+		case <-tick.C:
+			fmt.Println(t.String())
+		}
+	}
+}
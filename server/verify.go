@@ -0,0 +1,369 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"faceserver/face"
+	"faceserver/pkg/keyring"
+	"faceserver/pkg/linelog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+//auditName 核验审计日志的默认文件名，在数据目录中
+const auditName = "verify_audit.log"
+
+//verify_identity 的结论
+const (
+	DecisionAccept = "accept" //同一个人，可以通过
+	DecisionRetry  = "retry"  //现场照片不合格，重新拍摄以后再核验
+	DecisionReject = "reject" //不是同一个人，或者不满足活体、证件照的要求
+)
+
+//verify_identity 结论的原因
+const (
+	ReasonDocumentNoFace   = "document_no_face"        //证件照中没有人脸
+	ReasonDocumentMultiple = "document_multiple_faces" //证件照中有多张人脸，不能确定持证人
+	ReasonLiveNoFace       = "live_no_face"            //现场照片中没有人脸
+	ReasonLiveQuality      = "live_quality_low"        //现场照片的质量分数低于要求
+	ReasonLiveness         = "liveness_low"            //现场照片的活体分数低于要求，可能是翻拍或者面具
+	ReasonBelowThreshold   = "similarity_below_threshold"
+	ReasonModelVersion     = "model_version_mismatch"
+)
+
+//VerifyPolicy 人证核验的策略，由服务器配置，客户端不能放宽
+type VerifyPolicy struct {
+	MinLiveness float64 //现场照片的最低活体分数
+	MinQuality  float64 //现场照片的最低质量分数
+	Threshold   float64 //证件照和现场照片的比对阈值，0 表示使用比对的默认阈值（启用模板保护时为图库校准的阈值）
+	AuditLog    string  //审计日志文件，为空时使用数据目录中的 verify_audit.log，配置了密钥时每条记录加密
+}
+
+//VerifyFace 核验时一张照片的人脸
+type VerifyFace struct {
+	Count    int     `json:"count"` //提取到的人脸数目
+	Index    int     `json:"index"` //使用的人脸序号，没有使用时为-1
+	Liveness float64 `json:"liveness"`
+	Quality  float64 `json:"quality"`
+}
+
+//VerifyResult verify_identity 命令的结果
+type VerifyResult struct {
+	Decision   string     `json:"decision"`
+	Reasons    []string   `json:"reasons"`    //结论为 accept 时为空
+	Similarity float64    `json:"similarity"` //两张人脸都可用时才比对，否则为0
+	Threshold  float64    `json:"threshold"`
+	Document   VerifyFace `json:"document"`
+	Live       VerifyFace `json:"live"`
+	Time       time.Time  `json:"time"`
+}
+
+//AuditRecord 审计日志中的一条记录，每次核验一条，json 格式每行一条
+type AuditRecord struct {
+	Time          time.Time  `json:"time"`    //收到请求的时间
+	Elapsed       float64    `json:"elapsed"` //处理时间，毫秒
+	ID            string     `json:"id"`
+	Conn          uint32     `json:"conn"`
+	Source        string     `json:"source,omitempty"`
+	Result        int        `json:"result"`              //不为0时没有结论，比如照片读取失败
+	Cancelled     bool       `json:"cancelled,omitempty"` //客户端断开或者服务器退出，核验没有完成
+	Decision      string     `json:"decision,omitempty"`
+	Reasons       []string   `json:"reasons,omitempty"`
+	Similarity    float64    `json:"similarity"`
+	Threshold     float64    `json:"threshold"`
+	MinLiveness   float64    `json:"min_liveness"`
+	MinQuality    float64    `json:"min_quality"`
+	Document      VerifyFace `json:"document"`
+	Live          VerifyFace `json:"live"`
+	DocumentImage string     `json:"document_image,omitempty"` //照片路径，照片内容不写入日志
+	LiveImage     string     `json:"live_image,omitempty"`
+	ModelVersion  string     `json:"model_version,omitempty"`
+}
+
+//auditLog 只追加的审计日志，每条记录落盘以后才返回结论
+//配置了密钥时每行是一条加密的记录，文件名作为额外认证的数据
+type auditLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	name string
+	keys *keyring.Keyring
+	aad  []byte
+}
+
+func openAudit(name string, keys *keyring.Keyring) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return nil, errors.Wrap(err, "create audit log directory failed")
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "open audit log failed")
+	}
+	return &auditLog{f: f, name: name, keys: keys, aad: []byte(filepath.Base(name))}, nil
+}
+
+func (a *auditLog) write(rec *AuditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if data, err = a.keys.SealLine(data, a.aad); err != nil {
+		return errors.Wrap(err, "encrypt audit record failed")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return errors.New("audit log closed")
+	}
+	if _, err := a.f.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "write audit log failed")
+	}
+	return errors.Wrap(a.f.Sync(), "sync audit log failed")
+}
+
+func (a *auditLog) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+//reseal 用当前密钥重新加密不是当前密钥加密的记录，返回是否重写了日志，密钥轮换使用
+//重写期间的核验等待；日志已经关闭时不处理
+func (a *auditLog) reseal() (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return false, nil
+	}
+	a.f.Close()
+	ok, dropped, err := linelog.Reseal(a.keys, a.name)
+	if dropped > 0 {
+		glog.Warningf("%d unreadable records dropped from %s", dropped, a.name)
+	}
+	f, oerr := os.OpenFile(a.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if oerr != nil {
+		a.f = nil
+		return ok, errors.Wrap(oerr, "open audit log failed")
+	}
+	a.f = f
+	return ok, err
+}
+
+//ReadAudit 按顺序读取审计日志中的记录，配置了密钥时解密，audit 子命令使用
+//fn 返回错误时停止读取；记录无法解密时返回错误，说明日志被修改过或者密钥不对
+func ReadAudit(name string, keys *keyring.Keyring, fn func(rec []byte) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return errors.Wrap(err, "open audit log failed")
+	}
+	defer f.Close()
+	aad := []byte(filepath.Base(name))
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		rec, err := keys.OpenLine(sc.Bytes(), aad)
+		if err != nil {
+			return errors.Wrapf(err, "%s line %d", name, n)
+		}
+		if err = fn(rec); err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(sc.Err(), "read audit log failed")
+}
+
+//审计日志的路径，相对路径相对于数据目录
+func (app *App) auditFile() string {
+	name := app.conf.Verify.AuditLog
+	if len(name) == 0 {
+		name = auditName
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(app.dataDir(), name)
+	}
+	return name
+}
+
+//verifyThreshold 核验的阈值，请求中的阈值只能比服务器配置的更严格
+//启用了模板保护时分数的尺度和原始特征不同，没有配置核验阈值时使用图库校准的阈值，
+//图库没有校准过时返回 false，不能用原始特征的阈值核验
+func (app *App) verifyThreshold(r *face.Request) (float64, bool) {
+	t := app.conf.Verify.Threshold
+	if t <= 0 {
+		t = app.conf.Threshold
+		if face.GetFaceInstance().Protected(r.Gallery) {
+			t = 0
+			if g, err := app.galleries.Get(r.Gallery); err == nil && g.Config().Calibration != nil {
+				t = g.Config().Threshold
+			}
+			if t <= 0 {
+				return 0, false
+			}
+		}
+	}
+	if r.Threshold > t {
+		t = r.Threshold
+	}
+	return t, true
+}
+
+//verifyIdentity 命令：证件照和现场照片的人证核验
+//证件照中必须只有一张人脸；现场照片使用最大的人脸，活体和质量分数必须满足服务器的策略，
+//两张人脸的相似度不低于阈值时通过。每次核验的结论都写入审计日志，写入失败时不返回结论
+func (app *App) verifyIdentity(ctx context.Context, r *face.Request) face.Response {
+	resp := face.Response{ID: r.ID, Cmd: r.Cmd, Source: r.Source}
+	if len(r.Document.Content) == 0 || len(r.Live.Content) == 0 {
+		resp.Result = face.PErrorParameters
+		return resp
+	}
+	start := time.Now()
+	policy := app.conf.Verify
+	threshold, ok := app.verifyThreshold(r)
+	result := VerifyResult{
+		Threshold: threshold,
+		Document:  VerifyFace{Index: -1},
+		Live:      VerifyFace{Index: -1},
+		Time:      start,
+	}
+	rec := AuditRecord{
+		Time:        start,
+		ID:          r.ID,
+		Conn:        r.ConnId,
+		Source:      r.Source,
+		Threshold:   result.Threshold,
+		MinLiveness: policy.MinLiveness,
+		MinQuality:  policy.MinQuality,
+	}
+	if r.Document.Type == face.TypeFile {
+		rec.DocumentImage = r.Document.Content
+	}
+	if r.Live.Type == face.TypeFile {
+		rec.LiveImage = r.Live.Content
+	}
+	if !ok {
+		glog.Warningf("verify_identity %s: templates of gallery %q are protected, set -verify_threshold or calibrate the gallery", r.ID, r.Gallery)
+		resp.Result, rec.Result = face.PErrorParameters, face.PErrorParameters
+		return app.writeAudit(r, &rec, start, resp)
+	}
+
+	//证件照需要找出所有人脸才能确定只有一张
+	inputs := [2]face.Input{r.Document, r.Live}
+	var extracted [2]face.Response
+	forEach(ctx, len(inputs), func(i int) {
+		extracted[i] = extract(ctx, r, inputs[i], app.conf.MaxFaces)
+	})
+	if ctx.Err() != nil {
+		//没有结论的核验同样留下记录，客户端已经断开，应答不会送达
+		resp.Result, rec.Result, rec.Cancelled = face.PErrorInternal, face.PErrorInternal, true
+		return app.writeAudit(r, &rec, start, resp)
+	}
+	for i := range extracted {
+		//没有人脸不是错误，作为核验的原因
+		code := extracted[i].Result
+		if code != 0 && code != face.PErrorNOFeature && code != face.ErrorNoRect {
+			resp.Result = code
+			rec.Result = code
+			break
+		}
+		app.publish(r.Cmd, r.Source, extracted[i].Content)
+	}
+
+	if resp.Result == 0 {
+		var metrics [2][]float32
+		var versions [2]string
+		var reject, retry []string
+		doc, live := extracted[0].Content, extracted[1].Content
+		result.Document.Count, result.Live.Count = len(doc), len(live)
+		switch len(doc) {
+		case 0:
+			reject = append(reject, ReasonDocumentNoFace)
+		case 1:
+			result.Document.Index = 0
+			result.Document.Liveness, result.Document.Quality = doc[0].LivenessScore, doc[0].QualityScore
+		default:
+			reject = append(reject, ReasonDocumentMultiple)
+		}
+		if i := face.LargestFace(live); i < 0 {
+			retry = append(retry, ReasonLiveNoFace)
+		} else {
+			result.Live.Index = i
+			result.Live.Liveness, result.Live.Quality = live[i].LivenessScore, live[i].QualityScore
+			if result.Live.Liveness < policy.MinLiveness {
+				reject = append(reject, ReasonLiveness)
+			}
+			if result.Live.Quality < policy.MinQuality {
+				retry = append(retry, ReasonLiveQuality)
+			}
+		}
+		for k, f := range [2]VerifyFace{result.Document, result.Live} {
+			if f.Index < 0 {
+				continue
+			}
+			ff := extracted[k].Content[f.Index]
+			m, err := face.ParseMetric(ff.Metric)
+			if err != nil {
+				resp.Result = face.PErrorNOFeature
+				break
+			}
+			metrics[k], versions[k] = m, ff.ModelVersion
+		}
+		if metrics[0] != nil && metrics[1] != nil {
+			if len(versions[0]) > 0 && len(versions[1]) > 0 && versions[0] != versions[1] {
+				reject = append(reject, ReasonModelVersion)
+			} else if sim, err := face.Cosine(metrics[0], metrics[1]); err == nil {
+				result.Similarity = sim
+				if sim < result.Threshold {
+					reject = append(reject, ReasonBelowThreshold)
+				}
+			} else {
+				resp.Result = face.PErrorParameters
+			}
+			rec.ModelVersion = versions[1]
+		}
+
+		//拒绝的原因优先：现场照片重拍也不能改变结论时不提示重试
+		result.Reasons = append(reject, retry...)
+		switch {
+		case len(reject) > 0:
+			result.Decision = DecisionReject
+		case len(retry) > 0:
+			result.Decision = DecisionRetry
+		default:
+			result.Decision = DecisionAccept
+			result.Reasons = []string{}
+		}
+		rec.Result = resp.Result
+		if resp.Result == 0 {
+			rec.Decision, rec.Reasons = result.Decision, result.Reasons
+			rec.Similarity = result.Similarity
+		}
+	}
+	rec.Document, rec.Live = result.Document, result.Live
+	if resp.Result == 0 {
+		resp.Data = result
+	}
+	return app.writeAudit(r, &rec, start, resp)
+}
+
+//writeAudit 写入审计记录以后返回应答，写入失败时不返回结论
+func (app *App) writeAudit(r *face.Request, rec *AuditRecord, start time.Time, resp face.Response) face.Response {
+	rec.Elapsed = float64(time.Since(start).Microseconds()) / 1000
+	if err := app.audit.write(rec); err != nil {
+		glog.V(LERROR).Infof("verify_identity %s: %+v", r.ID, err)
+		resp.Result, resp.Data = face.PErrorStorage, nil
+	}
+	return resp
+}
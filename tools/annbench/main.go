@@ -0,0 +1,197 @@
+//annbench 用合成向量比较 HNSW 索引和精确检索，输出 recall@k 和检索速度
+//
+//  go run ./tools/annbench -n 100000 -q 1000 -k 10 -ef 16,32,64,128,256
+package main
+
+import (
+	"bytes"
+	"faceserver/pkg/hnsw"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	count   = flag.Int("n", 50000, "number of vectors in index")
+	queries = flag.Int("q", 500, "number of queries")
+	dim     = flag.Int("dim", 256, "vector dimension")
+	topK    = flag.Int("k", 10, "k of recall@k")
+	noise   = flag.Float64("noise", 0.5, "noise of query relative to its identity")
+	efList  = flag.String("ef", "16,32,64,128,256", "ef search values to test")
+	m       = flag.Int("m", hnsw.DefaultConfig.M, "hnsw M")
+	efc     = flag.Int("efc", hnsw.DefaultConfig.EfConstruction, "hnsw ef construction")
+	deleted = flag.Float64("delete", 0, "fraction of vectors deleted before searching")
+	latent  = flag.Int("latent", 32, "intrinsic dimension of vectors, 0: uniform random vectors")
+)
+
+//人脸特征分布在低维流形上，用随机投影把低维向量映射到高维，再加上少量噪声
+type generator struct {
+	r    *rand.Rand
+	proj [][]float32
+}
+
+func (g *generator) vector() []float32 {
+	if len(g.proj) == 0 {
+		return randomVector(g.r, *dim)
+	}
+	z := randomVector(g.r, len(g.proj[0]))
+	v := make([]float32, *dim)
+	for i := range v {
+		v[i] = dot(g.proj[i], z) + 0.05*float32(g.r.NormFloat64())
+	}
+	return normalize(v)
+}
+
+func randomVector(r *rand.Rand, n int) []float32 {
+	v := make([]float32, n)
+	for i := range v {
+		v[i] = float32(r.NormFloat64())
+	}
+	return normalize(v)
+}
+
+func normalize(v []float32) []float32 {
+	var s float64
+	for _, x := range v {
+		s += float64(x) * float64(x)
+	}
+	n := float32(math.Sqrt(s))
+	for i := range v {
+		v[i] /= n
+	}
+	return v
+}
+
+func dot(a, b []float32) float32 {
+	var s float32
+	for i := range a {
+		s += a[i] * b[i]
+	}
+	return s
+}
+
+//exact 暴力检索的前k个结果
+func exact(base [][]float32, alive []bool, q []float32, k int) []int {
+	type hit struct {
+		id    int
+		score float32
+	}
+	hits := make([]hit, 0, len(base))
+	for i, v := range base {
+		if alive[i] {
+			hits = append(hits, hit{i, dot(q, v)})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].score > hits[j].score })
+	out := make([]int, 0, k)
+	for i := 0; i < k && i < len(hits); i++ {
+		out = append(out, hits[i].id)
+	}
+	return out
+}
+
+func main() {
+	flag.Parse()
+	r := rand.New(rand.NewSource(7))
+
+	g := &generator{r: r}
+	for i := 0; *latent > 0 && i < *dim; i++ {
+		g.proj = append(g.proj, randomVector(r, *latent))
+	}
+	//每个向量是一个身份，查询是某个身份加上噪声，模拟同一个人的另一张照片
+	base := make([][]float32, *count)
+	for i := range base {
+		base[i] = g.vector()
+	}
+	qs := make([][]float32, *queries)
+	for i := range qs {
+		id := base[r.Intn(len(base))]
+		n := randomVector(r, *dim)
+		q := make([]float32, *dim)
+		for k := range q {
+			q[k] = id[k] + float32(*noise)*n[k]
+		}
+		qs[i] = normalize(q)
+	}
+
+	conf := hnsw.DefaultConfig
+	conf.M = *m
+	conf.EfConstruction = *efc
+	index := hnsw.New(conf)
+	start := time.Now()
+	for i, v := range base {
+		index.Insert(strconv.Itoa(i), v)
+	}
+	fmt.Printf("build: %d vectors, dim %d, M %d, efc %d, %v\n", *count, *dim, *m, *efc, time.Since(start))
+
+	alive := make([]bool, len(base))
+	for i := range alive {
+		alive[i] = true
+	}
+	if *deleted > 0 {
+		for i := range base {
+			if r.Float64() < *deleted {
+				alive[i] = false
+				index.Delete(strconv.Itoa(i))
+			}
+		}
+		fmt.Printf("deleted: %d\n", index.Deleted())
+	}
+
+	buf := bytes.Buffer{}
+	start = time.Now()
+	if err := index.Save(&buf); err != nil {
+		fmt.Fprintf(os.Stderr, "save failed: %v\n", err)
+		os.Exit(1)
+	}
+	saved := time.Since(start)
+	start = time.Now()
+	index, err := hnsw.Load(&buf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("persist: %d bytes, save %v, load %v\n", buf.Cap(), saved, time.Since(start))
+
+	start = time.Now()
+	truth := make([][]int, len(qs))
+	for i, q := range qs {
+		truth[i] = exact(base, alive, q, *topK)
+	}
+	elapsed := time.Since(start)
+	fmt.Printf("exact: %.0f qps\n", float64(len(qs))/elapsed.Seconds())
+
+	for _, s := range strings.Split(*efList, ",") {
+		ef, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			continue
+		}
+		index.SetEfSearch(ef)
+		hits, first := 0, 0
+		start = time.Now()
+		for i, q := range qs {
+			want := make(map[string]bool, len(truth[i]))
+			for _, id := range truth[i] {
+				want[strconv.Itoa(id)] = true
+			}
+			results := index.Search(q, *topK)
+			for _, res := range results {
+				if want[res.Key] {
+					hits++
+				}
+			}
+			if len(results) > 0 && len(truth[i]) > 0 && results[0].Key == strconv.Itoa(truth[i][0]) {
+				first++
+			}
+		}
+		elapsed = time.Since(start)
+		fmt.Printf("hnsw ef=%-4d recall@1: %.4f  recall@%d: %.4f  %.0f qps\n", ef,
+			float64(first)/float64(len(qs)), *topK, float64(hits)/float64(len(qs)**topK), float64(len(qs))/elapsed.Seconds())
+	}
+}
@@ -0,0 +1,311 @@
+//crashtest 反复在随机时刻杀死正在登记和删除人员的服务器，检查重启以后图库没有损坏，
+//所有返回成功的修改都没有丢失，进行中的修改要么完整生效要么没有生效
+//服务器需要用假引擎编译，xface.json 不存在时在服务器所在目录创建一个空的配置
+//
+//  go build -tags fakeengine -o faceserver .
+//  go run ./tools/crashtest -server ./faceserver -rounds 50
+//
+//-wal_sync=none 只能保证进程崩溃不丢数据，SIGKILL 不影响内核中的数据，测试结果相同
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	server   = flag.String("server", "./faceserver", "faceserver built with -tags fakeengine")
+	data     = flag.String("data", "", "data directory, a temp directory if empty")
+	rounds   = flag.Int("rounds", 20, "number of kill and restart rounds")
+	workers  = flag.Int("c", 8, "number of connections sending requests")
+	ids      = flag.Int("ids", 20, "number of persons of each connection")
+	minRun   = flag.Duration("min", 200*time.Millisecond, "min run time before kill")
+	maxRun   = flag.Duration("max", 2*time.Second, "max run time before kill")
+	walSync  = flag.String("wal_sync", "always", "-wal_sync of the server")
+	snapshot = flag.Int("snapshot_records", 50, "-snapshot_records of the server, small to kill during snapshots")
+	port     = flag.Int("port", 19979, "listen port of the server")
+)
+
+//state 客户端知道的人员状态，同一个人员同时只有一个请求
+type state struct {
+	exists    bool
+	templates int
+	inflight  string //被杀死时没有收到应答的命令
+}
+
+type request struct {
+	ID       string  `json:"id"`
+	Cmd      string  `json:"cmd"`
+	PersonID string  `json:"person_id"`
+	Inputs   []input `json:"inputs,omitempty"`
+	Limit    int     `json:"limit,omitempty"`
+}
+
+type input struct {
+	Type    int    `json:"type"`
+	Content string `json:"content"`
+}
+
+type response struct {
+	ID     string `json:"id"`
+	Result int    `json:"result"`
+	Data   struct {
+		Total         int `json:"total"`
+		TemplateCount int `json:"template_count"`
+	} `json:"data"`
+}
+
+//和 face.PErrorNotFound 相同
+const errNotFound = -5
+
+func main() {
+	flag.Parse()
+	bin, err := filepath.Abs(*server)
+	if err != nil {
+		fail("%v", err)
+	}
+	conf := filepath.Join(filepath.Dir(bin), "xface.json")
+	if _, err := os.Stat(conf); err != nil {
+		if err := ioutil.WriteFile(conf, []byte("{}"), 0644); err != nil {
+			fail("write %s failed: %v", conf, err)
+		}
+	}
+	dir := *data
+	if len(dir) == 0 {
+		if dir, err = ioutil.TempDir("", "crashtest"); err != nil {
+			fail("%v", err)
+		}
+		defer os.RemoveAll(dir)
+	} else if err = os.MkdirAll(dir, 0700); err != nil {
+		fail("%v", err)
+	}
+
+	persons := make([]map[string]*state, *workers)
+	for w := range persons {
+		persons[w] = make(map[string]*state)
+		for i := 0; i < *ids; i++ {
+			persons[w][fmt.Sprintf("w%d-p%d", w, i)] = &state{}
+		}
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var acked int64
+	for round := 1; round <= *rounds; round++ {
+		p := start(bin, dir, round)
+		if errs := verify(persons); len(errs) > 0 {
+			p.kill()
+			for _, e := range errs {
+				fmt.Fprintln(os.Stderr, e)
+			}
+			fail("round %d: %d errors after restart, server log: %s", round, len(errs), p.log)
+		}
+		var wg sync.WaitGroup
+		counts := make([]int64, *workers)
+		for w := range persons {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				counts[w] = work(w, persons[w], rand.New(rand.NewSource(r.Int63())))
+			}(w)
+		}
+		run := *minRun + time.Duration(r.Int63n(int64(*maxRun-*minRun)+1))
+		time.Sleep(run)
+		p.kill()
+		wg.Wait()
+		n := int64(0)
+		for _, c := range counts {
+			n += c
+		}
+		acked += n
+		fmt.Printf("round %d: killed after %v, %d requests acknowledged\n", round, run, n)
+	}
+	//最后一次重启只检查
+	p := start(bin, dir, *rounds+1)
+	errs := verify(persons)
+	p.kill()
+	if len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		fail("%d errors after the last restart, server log: %s", len(errs), p.log)
+	}
+	fmt.Printf("ok: %d rounds, %d requests acknowledged, no change lost\n", *rounds, acked)
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+func url() string {
+	return "ws://127.0.0.1:" + strconv.Itoa(*port) + "/"
+}
+
+//proc 运行中的服务器
+type proc struct {
+	cmd    *exec.Cmd
+	exited chan struct{}
+	log    string
+}
+
+//kill 用 SIGKILL 杀死服务器，等待进程退出
+func (p *proc) kill() {
+	p.cmd.Process.Kill()
+	<-p.exited
+}
+
+//start 启动服务器，等到可以连接为止
+func start(bin, dir string, round int) *proc {
+	p := &proc{exited: make(chan struct{}), log: filepath.Join(dir, fmt.Sprintf("server.%d.log", round))}
+	out, err := os.Create(p.log)
+	if err != nil {
+		fail("%v", err)
+	}
+	defer out.Close()
+	p.cmd = exec.Command(bin, "-listen=127.0.0.1:"+strconv.Itoa(*port), "-data="+filepath.Join(dir, "data"),
+		"-wal_sync="+*walSync, "-snapshot_records="+strconv.Itoa(*snapshot), "-logtostderr")
+	p.cmd.Dir = filepath.Dir(bin)
+	p.cmd.Stdout = out
+	p.cmd.Stderr = out
+	if err = p.cmd.Start(); err != nil {
+		fail("start %s failed: %v", bin, err)
+	}
+	go func() {
+		p.cmd.Wait()
+		close(p.exited)
+	}()
+	for deadline := time.Now().Add(20 * time.Second); time.Now().Before(deadline); {
+		select {
+		case <-p.exited:
+			fail("round %d: server exited on start, log: %s", round, p.log)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if c, _, err := websocket.DefaultDialer.Dial(url(), nil); err == nil {
+			c.Close()
+			return p
+		}
+	}
+	p.kill()
+	fail("round %d: server not listening after 20s, log: %s", round, p.log)
+	return nil
+}
+
+func call(c *websocket.Conn, r *request) (*response, error) {
+	if err := c.WriteJSON(r); err != nil {
+		return nil, err
+	}
+	resp := &response{}
+	if err := c.ReadJSON(resp); err != nil {
+		return nil, err
+	}
+	if resp.ID != r.ID {
+		return nil, fmt.Errorf("response %s to request %s", resp.ID, r.ID)
+	}
+	return resp, nil
+}
+
+//image 假引擎的照片，同一个人员的照片特征相近，每张照片都不同
+func image(id string, r *rand.Rand) input {
+	b := make([]byte, 64)
+	r.Read(b)
+	return input{Type: 1, Content: base64.StdEncoding.EncodeToString(append([]byte("FAKE:person="+id+"\n"), b...))}
+}
+
+//work 不停地登记和删除自己的人员，直到连接断开，返回收到成功应答的请求数目
+func work(w int, persons map[string]*state, r *rand.Rand) int64 {
+	c, _, err := websocket.DefaultDialer.Dial(url(), nil)
+	if err != nil {
+		return 0
+	}
+	defer c.Close()
+	keys := make([]string, 0, len(persons))
+	for id := range persons {
+		keys = append(keys, id)
+	}
+	n := int64(0)
+	for seq := 0; ; seq++ {
+		id := keys[r.Intn(len(keys))]
+		s := persons[id]
+		req := &request{ID: fmt.Sprintf("w%d-%d", w, seq), PersonID: id}
+		if s.exists && r.Intn(5) == 0 {
+			req.Cmd = "delete"
+		} else {
+			req.Cmd = "enroll"
+			req.Inputs = []input{image(id, r)}
+		}
+		s.inflight = req.Cmd
+		resp, err := call(c, req)
+		if err != nil {
+			return n
+		}
+		s.inflight = ""
+		if resp.Result != 0 {
+			fmt.Fprintf(os.Stderr, "%s %s failed: %d\n", req.Cmd, id, resp.Result)
+			continue
+		}
+		if req.Cmd == "delete" {
+			s.exists, s.templates = false, 0
+		} else {
+			s.exists, s.templates = true, resp.Data.TemplateCount
+		}
+		n++
+	}
+}
+
+//verify 检查重启以后的图库和客户端知道的状态一致，进行中的请求按照实际结果更新状态
+func verify(persons []map[string]*state) []string {
+	c, _, err := websocket.DefaultDialer.Dial(url(), nil)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	defer c.Close()
+	var errs []string
+	total := 0
+	for _, m := range persons {
+		for id, s := range m {
+			resp, err := call(c, &request{ID: "get-" + id, Cmd: "get", PersonID: id})
+			if err != nil {
+				return append(errs, err.Error())
+			}
+			if resp.Result != 0 && resp.Result != errNotFound {
+				errs = append(errs, fmt.Sprintf("get %s failed: %d", id, resp.Result))
+				continue
+			}
+			exists, templates := resp.Result == 0, resp.Data.TemplateCount
+			ok := exists == s.exists && templates == s.templates
+			switch s.inflight {
+			case "enroll":
+				//登记追加一个模板，可能生效也可能没有生效
+				ok = ok || (exists && templates == s.templates+1)
+			case "delete":
+				ok = ok || !exists
+			}
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%s: expect exists=%v templates=%d (inflight %q), got exists=%v templates=%d",
+					id, s.exists, s.templates, s.inflight, exists, templates))
+			}
+			s.exists, s.templates, s.inflight = exists, templates, ""
+			if exists {
+				total++
+			}
+		}
+	}
+	resp, err := call(c, &request{ID: "list", Cmd: "list", Limit: 1})
+	if err != nil {
+		return append(errs, err.Error())
+	}
+	if resp.Result != 0 || resp.Data.Total != total {
+		errs = append(errs, fmt.Sprintf("list: result %d, %d persons, expect %d", resp.Result, resp.Data.Total, total))
+	}
+	return errs
+}
@@ -0,0 +1,98 @@
+//matbench 用随机向量测试相似度矩阵的速度，和逐对计算的结果比较
+//
+//  go run ./tools/matbench -a 3000 -b 3000 -k 5
+package main
+
+import (
+	"faceserver/pkg/matrix"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+)
+
+var (
+	rowsA = flag.Int("a", 2000, "number of vectors in set A")
+	rowsB = flag.Int("b", 2000, "number of vectors in set B")
+	dim   = flag.Int("dim", 256, "vector dimension")
+	topK  = flag.Int("k", 5, "k of top-k per row")
+)
+
+func random(r *rand.Rand, n int) [][]float32 {
+	vs := make([][]float32, n)
+	for i := range vs {
+		vs[i] = make([]float32, *dim)
+		for k := range vs[i] {
+			vs[i][k] = float32(r.NormFloat64())
+		}
+	}
+	return vs
+}
+
+//naive 最简单的逐对计算，作为速度和结果的参照
+func naive(a, b *matrix.Matrix) []float32 {
+	out := make([]float32, a.Rows*b.Rows)
+	for i := 0; i < a.Rows; i++ {
+		for j := 0; j < b.Rows; j++ {
+			var s float32
+			x, y := a.Row(i), b.Row(j)
+			for k := range x {
+				s += x[k] * y[k]
+			}
+			out[i*b.Rows+j] = s
+		}
+	}
+	return out
+}
+
+func report(name string, elapsed time.Duration) {
+	pairs := float64(*rowsA) * float64(*rowsB)
+	fmt.Printf("%-8s %10v %8.1f Mpairs/s %6.2f GFLOPS\n", name, elapsed.Truncate(time.Millisecond),
+		pairs/elapsed.Seconds()/1e6, 2*pairs*float64(*dim)/elapsed.Seconds()/1e9)
+}
+
+func main() {
+	flag.Parse()
+	r := rand.New(rand.NewSource(1))
+	a, err := matrix.New(random(r, *rowsA))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	b, _ := matrix.New(random(r, *rowsB))
+
+	start := time.Now()
+	want := naive(a, b)
+	report("naive", time.Since(start))
+
+	start = time.Now()
+	got, _ := matrix.Scores(a, b)
+	report("scores", time.Since(start))
+
+	start = time.Now()
+	top, _ := matrix.TopK(a, b, *topK, -1)
+	report("top_k", time.Since(start))
+
+	var maxErr float64
+	for i := range want {
+		maxErr = math.Max(maxErr, math.Abs(float64(want[i]-got[i])))
+	}
+	wrong := 0
+	for i, row := range top {
+		best := 0
+		for j := 1; j < b.Rows; j++ {
+			if want[i*b.Rows+j] > want[i*b.Rows+best] {
+				best = j
+			}
+		}
+		if len(row) == 0 || math.Abs(float64(want[i*b.Rows+best]-row[0].Score)) > 1e-5 {
+			wrong++
+		}
+	}
+	fmt.Printf("max error:%g wrong top1:%d\n", maxErr, wrong)
+	if maxErr > 1e-4 || wrong > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,262 @@
+//protectbench 测量模板保护的精度损失：同一组样本分别用原始特征和保护以后的模板两两比对，
+//输出 EER 和目标误识率下的通过率；另外用两个不同的密钥生成同一个人的模板，验证更换密钥以后旧模板作废
+//
+//  go run ./tools/protectbench -identities 500 -samples 4 -bits 256,512,1024,2048
+//  go run ./tools/protectbench -gallery export.jsonl   #图库导出的原始特征，同一个人至少两个模板
+package main
+
+import (
+	"crypto/rand"
+	"faceserver/gallery"
+	"faceserver/pkg/matrix"
+	"faceserver/pkg/protect"
+	"faceserver/pkg/roc"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	mrand "math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	identities  = flag.Int("identities", 500, "number of synthetic identities")
+	samples     = flag.Int("samples", 4, "samples per synthetic identity")
+	dim         = flag.Int("dim", 256, "dimension of synthetic metrics")
+	latent      = flag.Int("latent", 32, "intrinsic dimension of synthetic identities")
+	noise       = flag.Float64("noise", 0.6, "noise of a sample relative to its identity")
+	bitsList    = flag.String("bits", "256,512,1024,2048", "template bits to test")
+	fars        = flag.String("far", "1e-3,1e-4", "target false accept rates")
+	maxImpostor = flag.Int("max_impostor", 2000000, "sample impostor pairs when there are more")
+	galleryFile = flag.String("gallery", "", "labeled raw metrics exported by gallery_export (.jsonl or .csv) instead of synthetic data")
+)
+
+type sample struct {
+	identity int
+	metric   []float32
+}
+
+//synthetic 人脸特征分布在低维流形上：身份是低维向量的随机投影，样本是身份加上噪声
+func synthetic(r *mrand.Rand) []sample {
+	proj := make([][]float32, *dim)
+	for i := range proj {
+		proj[i] = gaussian(r, *latent)
+	}
+	var out []sample
+	for id := 0; id < *identities; id++ {
+		z := gaussian(r, *latent)
+		center := make([]float32, *dim)
+		for i := range center {
+			center[i] = matrix.Dot(proj[i], z)
+		}
+		center = normalize(center)
+		for s := 0; s < *samples; s++ {
+			n := normalize(gaussian(r, *dim))
+			m := make([]float32, *dim)
+			for i := range m {
+				m[i] = center[i] + float32(*noise)*n[i]
+			}
+			out = append(out, sample{identity: id, metric: normalize(m)})
+		}
+	}
+	return out
+}
+
+func normalize(v []float32) []float32 {
+	var s float64
+	for _, x := range v {
+		s += float64(x) * float64(x)
+	}
+	out := make([]float32, len(v))
+	if s == 0 {
+		return out
+	}
+	n := float32(math.Sqrt(s))
+	for i, x := range v {
+		out[i] = x / n
+	}
+	return out
+}
+
+//parseMetric FaceFeature.Metric 格式的特征
+func parseMetric(s string) ([]float32, error) {
+	fields := strings.Split(strings.TrimSuffix(strings.TrimSpace(s), ","), ",")
+	m := make([]float32, len(fields))
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 32)
+		if err != nil {
+			return nil, err
+		}
+		m[i] = float32(v)
+	}
+	return m, nil
+}
+
+func gaussian(r *mrand.Rand, n int) []float32 {
+	v := make([]float32, n)
+	for i := range v {
+		v[i] = float32(r.NormFloat64())
+	}
+	return v
+}
+
+//load 读取图库导出的文件，每个人员的每个模板是一个样本
+func load(name string) ([]sample, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rr := gallery.NewRecordReader(f, gallery.FormatOf(name))
+	ids := make(map[string]int)
+	var out []sample
+	for {
+		rec, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, ok := ids[rec.PersonID]
+		if !ok {
+			id = len(ids)
+			ids[rec.PersonID] = id
+		}
+		for _, s := range rec.Metrics {
+			m, err := parseMetric(s)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: %v", rr.Row(), err)
+			}
+			out = append(out, sample{identity: id, metric: normalize(m)})
+		}
+	}
+	return out, nil
+}
+
+//pairs 同一个人的所有样本对，以及不同人的样本对（超过 max_impostor 时随机抽样）
+func pairs(r *mrand.Rand, all []sample) (genuine, impostor [][2]int) {
+	n := len(all)
+	total := n * (n - 1) / 2
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			if all[i].identity == all[j].identity {
+				genuine = append(genuine, [2]int{i, j})
+			} else if total <= *maxImpostor {
+				impostor = append(impostor, [2]int{i, j})
+			}
+		}
+	}
+	for len(impostor) < *maxImpostor && total > *maxImpostor {
+		i, j := r.Intn(n), r.Intn(n)
+		if all[i].identity != all[j].identity {
+			impostor = append(impostor, [2]int{i, j})
+		}
+	}
+	return genuine, impostor
+}
+
+func scores(a, b [][]float32, ps [][2]int) []float64 {
+	out := make([]float64, len(ps))
+	for k, p := range ps {
+		out[k] = float64(matrix.Dot(a[p[0]], b[p[1]]))
+	}
+	return out
+}
+
+func secret() []byte {
+	s := make([]byte, protect.SecretSize)
+	if _, err := rand.Read(s); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func templates(t *protect.Transform, all []sample) [][]float32 {
+	out := make([][]float32, len(all))
+	for i, s := range all {
+		out[i] = normalize(t.Apply(s.metric))
+	}
+	return out
+}
+
+func report(name string, genuine, impostor []float64, targets []float64) {
+	r, err := roc.Compute(genuine, impostor, targets)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("%-12s genuine:%.4f±%.4f impostor:%.4f±%.4f eer:%.4f", name,
+		r.Genuine.Mean, r.Genuine.Std, r.Impostor.Mean, r.Impostor.Std, r.EER)
+	for _, o := range r.Operating {
+		mark := ""
+		if !o.Reliable {
+			mark = "?"
+		}
+		fmt.Printf(" tar@%g:%.4f%s(t=%.3f)", o.TargetFAR, o.TAR, mark, o.Threshold)
+	}
+	fmt.Println()
+}
+
+func main() {
+	flag.Parse()
+	r := mrand.New(mrand.NewSource(1))
+	var targets []float64
+	for _, f := range strings.Split(*fars, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid far: %s\n", f)
+			os.Exit(2)
+		}
+		targets = append(targets, v)
+	}
+	var all []sample
+	if len(*galleryFile) > 0 {
+		var err error
+		if all, err = load(*galleryFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		all = synthetic(r)
+	}
+	genuine, impostor := pairs(r, all)
+	fmt.Printf("samples:%d genuine pairs:%d impostor pairs:%d\n", len(all), len(genuine), len(impostor))
+	if len(genuine) == 0 {
+		fmt.Fprintln(os.Stderr, "no genuine pair: every identity needs at least two samples")
+		os.Exit(1)
+	}
+
+	raw := make([][]float32, len(all))
+	for i, s := range all {
+		raw[i] = s.metric
+	}
+	report("raw", scores(raw, raw, genuine), scores(raw, raw, impostor), targets)
+	for _, f := range strings.Split(*bitsList, ",") {
+		bits, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid bits: %s\n", f)
+			os.Exit(2)
+		}
+		t, err := protect.New(secret(), bits)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(2)
+		}
+		p := templates(t, all)
+		report(fmt.Sprintf("bits=%d", bits), scores(p, p, genuine), scores(p, p, impostor), targets)
+
+		//同一个人在旧密钥下的模板和新密钥下的模板比对，分数应该和不同人一样
+		t2, _ := protect.New(secret(), bits)
+		p2 := templates(t2, all)
+		cross := scores(p, p2, genuine)
+		var mean, max float64
+		for _, s := range cross {
+			mean += s
+			max = math.Max(max, s)
+		}
+		fmt.Printf("%-12s revoked genuine mean:%.4f max:%.4f\n", "", mean/float64(len(cross)), max)
+	}
+}
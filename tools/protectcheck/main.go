@@ -0,0 +1,217 @@
+//protectcheck 检查开启模板保护以后服务器拒绝客户端提供的原始特征：
+//带着受保护模型版本的原始特征（256维浮点数）在 enroll、compare 和 compare_matrix 中都要返回参数错误，
+//服务器自己生成的模板仍然可以使用
+//
+//  go build -tags fakeengine -o faceserver .
+//  go run ./tools/protectcheck -server ./faceserver
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	mrand "math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	server = flag.String("server", "./faceserver", "faceserver built with -tags fakeengine")
+	port   = flag.Int("port", 19981, "listen port of the server")
+	dim    = flag.Int("dim", 256, "dimension of the raw metric")
+)
+
+type input struct {
+	Type         int    `json:"type,omitempty"`
+	Content      string `json:"content,omitempty"`
+	Metric       string `json:"metric,omitempty"`
+	ModelVersion string `json:"model_version,omitempty"`
+}
+
+type request struct {
+	ID       string  `json:"id"`
+	Cmd      string  `json:"cmd"`
+	PersonID string  `json:"person_id,omitempty"`
+	Type     int     `json:"type,omitempty"`
+	Content  string  `json:"content,omitempty"`
+	Inputs   []input `json:"inputs,omitempty"`
+	Targets  []input `json:"targets,omitempty"`
+}
+
+type response struct {
+	ID      string `json:"id"`
+	Result  int    `json:"result"`
+	Content []struct {
+		Metric       string `json:"metric"`
+		ModelVersion string `json:"model_version"`
+	} `json:"content"`
+	Data json.RawMessage `json:"data"`
+}
+
+//和 face.PErrorParameters 相同
+const errParameters = -1
+
+func main() {
+	flag.Parse()
+	bin, err := filepath.Abs(*server)
+	if err != nil {
+		fail("%v", err)
+	}
+	conf := filepath.Join(filepath.Dir(bin), "xface.json")
+	if _, err := os.Stat(conf); err != nil {
+		if err := ioutil.WriteFile(conf, []byte("{}"), 0644); err != nil {
+			fail("write %s failed: %v", conf, err)
+		}
+	}
+	dir, err := ioutil.TempDir("", "protectcheck")
+	if err != nil {
+		fail("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	keys := filepath.Join(dir, "protect.keys")
+	if err = ioutil.WriteFile(keys, []byte("*:"+base64.StdEncoding.EncodeToString(secret)+"\n"), 0600); err != nil {
+		fail("%v", err)
+	}
+	log := filepath.Join(dir, "server.log")
+	running = start(bin, dir, keys, log)
+	defer running.Process.Kill()
+
+	c, _, err := websocket.DefaultDialer.Dial(url(), nil)
+	if err != nil {
+		fail("%v", err)
+	}
+	defer c.Close()
+
+	//服务器生成的模板，用来得到受保护的模型版本
+	photo := base64.StdEncoding.EncodeToString([]byte("FAKE:person=alice\n"))
+	resp := call(c, &request{ID: "feature", Cmd: "feature", Type: 1, Content: photo})
+	if resp.Result != 0 || len(resp.Content) != 1 {
+		fail("feature failed: %d, log: %s", resp.Result, log)
+	}
+	template := input{Metric: resp.Content[0].Metric, ModelVersion: resp.Content[0].ModelVersion}
+	if !strings.Contains(template.ModelVersion, "+bio") {
+		fail("feature returned unprotected version %q, log: %s", template.ModelVersion, log)
+	}
+
+	//带着受保护版本的原始特征
+	raw := input{Metric: rawMetric(*dim), ModelVersion: template.ModelVersion}
+	failed := 0
+	expect := func(name string, got, want int) {
+		status := "ok"
+		if got != want {
+			status = "FAILED"
+			failed++
+		}
+		fmt.Printf("%-28s result:%d expect:%d %s\n", name, got, want, status)
+	}
+	expect("enroll raw", call(c, &request{ID: "enroll-raw", Cmd: "enroll", PersonID: "raw", Inputs: []input{raw}}).Result, errParameters)
+	expect("compare raw", call(c, &request{ID: "compare-raw", Cmd: "compare", Inputs: []input{raw, template}}).Result, errParameters)
+	resp = call(c, &request{ID: "matrix-raw", Cmd: "compare_matrix", Inputs: []input{raw}, Targets: []input{template}})
+	var matrix struct {
+		Failed []struct {
+			Set    string `json:"set"`
+			Result int    `json:"result"`
+		} `json:"failed"`
+	}
+	json.Unmarshal(resp.Data, &matrix)
+	code := resp.Result
+	if code == 0 {
+		for _, f := range matrix.Failed {
+			if f.Set == "inputs" {
+				code = f.Result
+			}
+		}
+	}
+	expect("compare_matrix raw", code, errParameters)
+	expect("enroll template", call(c, &request{ID: "enroll-template", Cmd: "enroll", PersonID: "alice", Inputs: []input{template}}).Result, 0)
+	expect("compare template", call(c, &request{ID: "compare-template", Cmd: "compare", Inputs: []input{template, template}}).Result, 0)
+	if failed > 0 {
+		fail("%d checks failed, log: %s", failed, log)
+	}
+}
+
+//rawMetric 随机的原始特征
+func rawMetric(n int) string {
+	b := strings.Builder{}
+	for i := 0; i < n; i++ {
+		b.WriteString(strconv.FormatFloat(mrand.NormFloat64()*0.06, 'g', -1, 32))
+		b.WriteString(",")
+	}
+	return b.String()
+}
+
+func url() string {
+	return "ws://127.0.0.1:" + strconv.Itoa(*port) + "/"
+}
+
+//start 启动开启了模板保护的服务器，等到可以连接为止
+func start(bin, dir, keys, log string) *exec.Cmd {
+	out, err := os.Create(log)
+	if err != nil {
+		fail("%v", err)
+	}
+	defer out.Close()
+	cmd := exec.Command(bin, "-listen=127.0.0.1:"+strconv.Itoa(*port), "-data="+filepath.Join(dir, "data"),
+		"-protect_keys="+keys, "-logtostderr")
+	cmd.Dir = filepath.Dir(bin)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err = cmd.Start(); err != nil {
+		fail("start %s failed: %v", bin, err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	for deadline := time.Now().Add(20 * time.Second); time.Now().Before(deadline); {
+		select {
+		case <-exited:
+			fail("server exited on start, log: %s", log)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if c, _, err := websocket.DefaultDialer.Dial(url(), nil); err == nil {
+			c.Close()
+			return cmd
+		}
+	}
+	cmd.Process.Kill()
+	fail("server not listening after 20s, log: %s", log)
+	return nil
+}
+
+func call(c *websocket.Conn, r *request) *response {
+	if err := c.WriteJSON(r); err != nil {
+		fail("%s: %v", r.ID, err)
+	}
+	resp := &response{}
+	if err := c.ReadJSON(resp); err != nil {
+		fail("%s: %v", r.ID, err)
+	}
+	if resp.ID != r.ID {
+		fail("response %s to request %s", resp.ID, r.ID)
+	}
+	return resp
+}
+
+//running 运行中的服务器，失败退出时杀死
+var running *exec.Cmd
+
+func fail(format string, args ...interface{}) {
+	if running != nil {
+		running.Process.Kill()
+	}
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
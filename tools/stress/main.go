@@ -0,0 +1,142 @@
+// +build fakeengine
+
+//stress 使用假引擎对异步特征提取做压力测试
+//图片在引擎的线程中被延迟读取，同时不停地触发GC，提交给引擎的解码以后的内存在提交返回以后立刻清零，
+//如果引擎使用的不是自己的副本，或者图片内存被回收或者移动，假引擎的校验会失败
+//
+//  GOEXPERIMENT=cgocheck2 go build -tags fakeengine -o stress ./tools/stress
+//  ./stress -n 20000 -c 16
+//
+//cgocheck2 检查 C 代码保存 Go 指针，go1.21 以后只能在编译时通过 GOEXPERIMENT=cgocheck2 打开，
+//更早的版本不需要 GOEXPERIMENT，运行时设置 GODEBUG=cgocheck=2
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"faceserver/face"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	total       = flag.Int("n", 10000, "number of requests")
+	concurrency = flag.Int("c", 8, "number of submitting goroutines")
+	inflight    = flag.Int("inflight", 128, "max requests in engine")
+	maxSize     = flag.Int("size", 256*1024, "max image size")
+)
+
+//生成一张带校验和的假图片
+func makeImage(r *rand.Rand) []byte {
+	header := []byte("FAKE:stress=1\n")
+	n := len(header) + 1 + r.Intn(*maxSize)
+	b := make([]byte, n+8)
+	copy(b, header)
+	r.Read(b[len(header):n])
+	h := fnv.New64a()
+	h.Write(b[:n])
+	binary.LittleEndian.PutUint64(b[n:], h.Sum64())
+	return b
+}
+
+func main() {
+	flag.Parse()
+
+	//XFace.Init 从程序所在目录读取引擎配置
+	dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
+	conf := filepath.Join(dir, "xface.json")
+	if _, err := os.Stat(conf); err != nil {
+		if err := ioutil.WriteFile(conf, []byte("{}"), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "write %s failed: %v\n", conf, err)
+			os.Exit(1)
+		}
+	}
+
+	var ok, failed int64
+	var done sync.WaitGroup
+	sem := make(chan struct{}, *inflight)
+	x := face.GetFaceInstance()
+	x.OnCompleted = func(connId uint32, resp face.Response) {
+		if resp.Result == 0 && len(resp.Content) == 1 {
+			atomic.AddInt64(&ok, 1)
+		} else {
+			atomic.AddInt64(&failed, 1)
+			fmt.Fprintf(os.Stderr, "request[%s] failed: %d\n", resp.ID, resp.Result)
+		}
+		<-sem
+		done.Done()
+	}
+	//提交返回以后清零解码的图片，引擎必须已经复制了一份
+	face.OnSubmitted(func(data []byte) {
+		for j := range data {
+			data[j] = 0
+		}
+	})
+	if err := x.Init(); err != nil {
+		fmt.Fprintf(os.Stderr, "init failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	quit := make(chan struct{})
+	go func() {
+		//不停地分配内存并触发GC，让没有被正确持有的内存尽快被回收
+		var garbage [][]byte
+		for {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			garbage = append(garbage, make([]byte, 64*1024))
+			if len(garbage) > 64 {
+				garbage = nil
+			}
+			runtime.GC()
+		}
+	}()
+
+	start := time.Now()
+	var seq int64
+	var wg sync.WaitGroup
+	per := *total / *concurrency
+	done.Add(per * *concurrency)
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(i)))
+			for k := 0; k < per; k++ {
+				sem <- struct{}{}
+				id := atomic.AddInt64(&seq, 1)
+				x.DoFeature(&face.Request{
+					ReqId:   id,
+					ID:      fmt.Sprintf("%d-%d", i, k),
+					Cmd:     face.CmdFeature,
+					Type:    face.TypeBase64,
+					Content: base64.StdEncoding.EncodeToString(makeImage(r)),
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	done.Wait()
+	close(quit)
+	elapsed := time.Since(start)
+	pending := x.PendingImages()
+	x.UnInit()
+
+	fmt.Printf("requests:%d ok:%d failed:%d pending images:%d elapsed:%v\n",
+		per**concurrency, ok, failed, pending, elapsed)
+	if failed > 0 || pending != 0 {
+		os.Exit(1)
+	}
+}